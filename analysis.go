@@ -0,0 +1,288 @@
+package runevm
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kinds of names a script can define.
+type symbolKind int
+
+const (
+	variableSymbol symbolKind = iota
+	functionSymbol
+	parameterSymbol
+)
+
+// A name defined by a script. Its position is the one of the first assignment to the name, or of the
+// parameter, loop variable or catch name.
+type symbol struct {
+	name   string
+	kind   symbolKind
+	file   string
+	line   int
+	col    int
+	length int
+	// Function declaration assigned by the definition, nil for other values
+	fun *expression
+	// Parameters and local variables of the function, nil for other values
+	locals *scope
+}
+
+// Names defined by a file or a function. Like the environments at runtime, a function scope sees the
+// names of the scopes enclosing it, and an assignment to a name that isn't visible yet defines it in
+// the innermost scope.
+type scope struct {
+	parent *scope
+	names  map[string]*symbol
+	// The defined symbols in source order
+	symbols []*symbol
+	// Function declaration of the scope, nil for the scope of the file
+	fun *expression
+}
+
+// A name used in the analyzed file together with its definition. Sym is nil for builtins and unknown names.
+type reference struct {
+	name   string
+	line   int
+	col    int
+	length int
+	sym    *symbol
+}
+
+// The path of an import in the analyzed file and the file it refers to, empty if the file wasn't found.
+type importRef struct {
+	line   int
+	col    int
+	length int
+	path   string
+}
+
+// Static analysis of a Rune file for the language server: which names each scope defines and which
+// definition each name in the file refers to. Definitions of imported files are added to the scope of
+// the import, just like executing the import would.
+type analysis struct {
+	file    string
+	root    *scope
+	scopes  []*scope
+	refs    []reference
+	imports []importRef
+	// Reads the source of an imported file, reports false if it doesn't exist
+	readFile func(path string) (string, bool)
+	// Directories imports are resolved against, after the directory of the importing file
+	importDirs []string
+	// Files whose definitions were added, to stop import cycles
+	loaded map[string]bool
+	// Function symbols by their declaration
+	funSymbols map[*expression]*symbol
+}
+
+// Analyzes the syntax tree of a file. The tree may be incomplete because of syntax errors.
+func analyzeFile(ast *expression, file string, readFile func(path string) (string, bool), importDirs []string) *analysis {
+	a := &analysis{
+		file:       file,
+		root:       newScope(nil, nil),
+		readFile:   readFile,
+		importDirs: importDirs,
+		loaded:     map[string]bool{file: true},
+		funSymbols: make(map[*expression]*symbol),
+	}
+	a.scopes = append(a.scopes, a.root)
+	a.define(ast, a.root)
+	a.resolve(ast, a.root)
+	return a
+}
+
+func newScope(parent *scope, fun *expression) *scope {
+	return &scope{parent: parent, names: make(map[string]*symbol), fun: fun}
+}
+
+// Returns the symbol the name refers to in the scope or its parents, nil if there is none.
+func (s *scope) lookup(name string) *symbol {
+	for sc := s; sc != nil; sc = sc.parent {
+		if sym, ok := sc.names[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+// Defines the name of the var expression in the scope. Returns nil if the name is already visible.
+func (s *scope) add(name *expression, kind symbolKind, shadow bool) *symbol {
+	n, ok := name.Value.(string)
+	if !ok || (!shadow && s.lookup(n) != nil) {
+		return nil
+	}
+	length := name.Length
+	if length == 0 {
+		length = utf8.RuneCountInString(n)
+	}
+	sym := &symbol{name: n, kind: kind, file: name.File, line: name.Line, col: name.Col, length: length}
+	s.names[n] = sym
+	s.symbols = append(s.symbols, sym)
+	return sym
+}
+
+// Returns the symbols visible in the scope. A name shadowed by an inner scope is only returned once.
+func (s *scope) visible() []*symbol {
+	var symbols []*symbol
+	seen := make(map[string]bool)
+	for sc := s; sc != nil; sc = sc.parent {
+		for _, sym := range sc.symbols {
+			if !seen[sym.name] {
+				seen[sym.name] = true
+				symbols = append(symbols, sym)
+			}
+		}
+	}
+	return symbols
+}
+
+// Adds the names defined by the expression to the scope. Function bodies get a scope of their own.
+func (a *analysis) define(exp *expression, sc *scope) {
+	if exp == nil {
+		return
+	}
+	switch exp.Type {
+	case funExpr:
+		return
+	case assignExpr:
+		// A compound assignment like a += 1 needs a to be defined already
+		if exp.Left.Index == nil && exp.Operator == "=" {
+			if sym := sc.add(exp.Left, variableSymbol, false); sym != nil && exp.Right.Type == funExpr {
+				sym.kind = functionSymbol
+				sym.fun = exp.Right
+				a.funSymbols[exp.Right] = sym
+			}
+		}
+	case forExpr, tryExpr:
+		for _, name := range exp.ParamExprs {
+			sc.add(name, variableSymbol, false)
+		}
+	case importExpr:
+		if path, source, ok := a.findImport(exp); ok && !a.loaded[path] {
+			a.loaded[path] = true
+			prog, _ := Parse(source, path)
+			a.define(prog.ast, sc)
+		}
+	}
+	for _, child := range exp.children() {
+		a.define(child, sc)
+	}
+}
+
+// Links the names used by the expression to their definitions.
+func (a *analysis) resolve(exp *expression, sc *scope) {
+	if exp == nil {
+		return
+	}
+	switch exp.Type {
+	case varExpr:
+		if exp.Index == nil {
+			if name, ok := exp.Value.(string); ok {
+				length := exp.Length
+				if length == 0 {
+					length = utf8.RuneCountInString(name)
+				}
+				a.refs = append(a.refs, reference{name: name, line: exp.Line, col: exp.Col, length: length, sym: sc.lookup(name)})
+			}
+			return
+		}
+	case funExpr:
+		locals := newScope(sc, exp)
+		a.scopes = append(a.scopes, locals)
+		if sym := a.funSymbols[exp]; sym != nil {
+			sym.locals = locals
+		}
+		for _, param := range exp.ParamExprs {
+			locals.add(param, parameterSymbol, true)
+		}
+		a.define(exp.Body, locals)
+		sc = locals
+	case importExpr:
+		if exp.Left.Type == strExpr {
+			path, _, _ := a.findImport(exp)
+			a.imports = append(a.imports, importRef{line: exp.Left.Line, col: exp.Left.Col, length: exp.Left.Length, path: path})
+		}
+	}
+	for _, child := range exp.children() {
+		a.resolve(child, sc)
+	}
+}
+
+// Finds the file of an import with a constant path. Like at runtime, the extension ".rune" is added to
+// the path. Relative paths are tried against the directory of the importing file first.
+func (a *analysis) findImport(exp *expression) (string, string, bool) {
+	path, ok := exp.Left.Value.(string)
+	if exp.Left.Type != strExpr || !ok {
+		return "", "", false
+	}
+	path = filepath.FromSlash(path + ".rune")
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Join(filepath.Dir(exp.File), path)}
+		for _, dir := range a.importDirs {
+			candidates = append(candidates, filepath.Join(dir, path))
+		}
+		candidates = append(candidates, path)
+	}
+	for _, candidate := range candidates {
+		if abs, err := filepath.Abs(candidate); err == nil {
+			candidate = abs
+		}
+		if source, ok := a.readFile(candidate); ok {
+			return candidate, source, true
+		}
+	}
+	return "", "", false
+}
+
+// Returns the reference at the given position, nil if there is none.
+func (a *analysis) refAt(line, col int) *reference {
+	for i := range a.refs {
+		ref := &a.refs[i]
+		if ref.line == line && col >= ref.col && col < ref.col+ref.length {
+			return ref
+		}
+	}
+	return nil
+}
+
+// Returns the import path at the given position, nil if there is none.
+func (a *analysis) importAt(line, col int) *importRef {
+	for i := range a.imports {
+		imp := &a.imports[i]
+		if imp.line == line && col >= imp.col && col < imp.col+imp.length {
+			return imp
+		}
+	}
+	return nil
+}
+
+// Returns the innermost scope at the given position.
+func (a *analysis) scopeAt(line, col int) *scope {
+	innermost := a.root
+	// Scopes are appended in source order, so a nested scope always comes after the scopes enclosing it
+	for _, sc := range a.scopes[1:] {
+		fun := sc.fun
+		after := line > fun.Line || (line == fun.Line && col >= fun.Col)
+		before := line < fun.EndLine || (line == fun.EndLine && col < fun.EndCol)
+		if after && before {
+			innermost = sc
+		}
+	}
+	return innermost
+}
+
+// Returns a short description of the symbol, e.g. "fun greet(name)" or "variable count".
+func (s *symbol) describe() string {
+	switch s.kind {
+	case functionSymbol:
+		return "fun " + s.name + "(" + strings.Join(s.fun.Params, ", ") + ")"
+	case parameterSymbol:
+		return "parameter " + s.name
+	default:
+		return "variable " + s.name
+	}
+}
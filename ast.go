@@ -6,6 +6,7 @@ const (
 	numExpr      exprType = "num"
 	strExpr      exprType = "str"
 	boolExpr     exprType = "bool"
+	nilExpr      exprType = "nil"
 	varExpr      exprType = "var"
 	assignExpr   exprType = "assign"
 	binaryExpr   exprType = "binary"
@@ -16,6 +17,7 @@ const (
 	callExpr     exprType = "call"
 	returnExpr   exprType = "return"
 	whileExpr    exprType = "while"
+	forExpr      exprType = "for"
 	breakExpr    exprType = "break"
 	continueExpr exprType = "continue"
 	arrayExpr    exprType = "array"
@@ -23,6 +25,8 @@ const (
 	pairExpr     exprType = "pair"
 	indexExpr    exprType = "Index"
 	importExpr   exprType = "import"
+	interpExpr   exprType = "interp"
+	tryExpr      exprType = "try"
 )
 
 type expression struct {
@@ -33,26 +37,30 @@ type expression struct {
 	Left  *expression
 	Right *expression
 
-	// Operator of binary expressions
+	// Operator of binary expressions, "?" marks an optional index or field access, "`" a raw string,
+	// "elif" an if expression written as elif and "for" a call whose result a for loop iterates over.
+	// Number literals keep their text here, their Value is the parsed int or float64.
 	Operator string
 
-	// If/While
+	// If/While, Then is also the catch and Else the finally block of a try
 	Cond *expression
 	Then *expression
 	Else *expression
 
 	// Function decl
 	Func *expression
-	// Function decl param names
+	// Function decl param names, also the loop variable names of a for loop and the error name of a catch
 	Params []string
+	// Names in Params as var expressions, holding their positions
+	ParamExprs []*expression
 
-	// Entire block
+	// Entire block, also the literal text and embedded expressions of an interpolated string
 	Block []*expression
 
 	// Function call arguments
 	Args []*expression
 
-	// Function / while bodies
+	// Function / while / for / try bodies
 	Body *expression
 
 	// Index access / Field access
@@ -63,4 +71,39 @@ type expression struct {
 	Line   int
 	Col    int
 	Length int
+	// Position just after the end of a function body, call, array or table and of a block kept for the formatter.
+	// Strings spanning multiple lines only set the line of their closing quote.
+	EndLine int
+	EndCol  int
+}
+
+// Returns the sub-expressions of the expression in source order.
+func (exp *expression) children() []*expression {
+	var children []*expression
+	add := func(exprs ...*expression) {
+		for _, expr := range exprs {
+			if expr != nil {
+				children = append(children, expr)
+			}
+		}
+	}
+	switch exp.Type {
+	case funExpr:
+		add(exp.ParamExprs...)
+		add(exp.Body)
+	case forExpr:
+		add(exp.ParamExprs...)
+		add(exp.Right, exp.Body)
+	case tryExpr:
+		add(exp.Body)
+		add(exp.ParamExprs...)
+		add(exp.Then, exp.Else)
+	case callExpr:
+		add(exp.Func)
+		add(exp.Args...)
+	default:
+		add(exp.Left, exp.Cond, exp.Then, exp.Else, exp.Index, exp.Right, exp.Body)
+		add(exp.Block...)
+	}
+	return children
 }
@@ -0,0 +1,194 @@
+package runevm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a vm on the given backend whose print and println write to out.
+func newTestVM(backend Backend, out *strings.Builder, options ...Option) *RuneVM {
+	vm := NewRuneVM(options...)
+	vm.SetBackend(backend)
+	vm.SetFun("print", func(args ...interface{}) interface{} {
+		for _, arg := range args {
+			out.WriteString(formatValue(arg))
+		}
+		return nil
+	})
+	vm.SetFun("println", func(args ...interface{}) interface{} {
+		for _, arg := range args {
+			out.WriteString(formatValue(arg))
+		}
+		out.WriteString("\n")
+		return nil
+	})
+	return vm
+}
+
+// Runs the source on the given backend and returns what it printed.
+func runScript(backend Backend, source string, options ...Option) (string, error) {
+	var out strings.Builder
+	err := newTestVM(backend, &out, options...).Run(source, "test.rune")
+	return out.String(), err
+}
+
+// Runs the source on both backends, fails the test if they print different output or report
+// different errors, and returns the output and error of the tree walker.
+func runBoth(t *testing.T, source string, options ...Option) (string, error) {
+	t.Helper()
+	out, err := runScript(TreeWalker, source, options...)
+	bcOut, bcErr := runScript(Bytecode, source, options...)
+	if out != bcOut {
+		t.Errorf("backends print different output\ntree-walker:\n%s\nbytecode:\n%s", out, bcOut)
+	}
+	if errorText(err) != errorText(bcErr) {
+		t.Errorf("backends report different errors\ntree-walker: %s\nbytecode:    %s", errorText(err), errorText(bcErr))
+	}
+	return out, err
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
+
+func TestBackendsAgree(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"arithmetic", `println(1 + 2 * 3, " ", 7 / 2, " ", 7 // 2, " ", 7 % 3, " ", 1.5 * 2)`, "7 3.5 3 1 3\n"},
+		{"strings", `s = "ab" + "cd"
+println(s, " ", len(s), " ", "${s}!")`, "abcd 4 abcd!\n"},
+		{"closures", `counter = fun() {
+    n = 0
+    fun() { n = n + 1 }
+}
+c = counter()
+c()
+println(c())`, "2\n"},
+		{"recursion", `fib = fun(n) {
+    if n < 2 then return = n
+    fib(n - 1) + fib(n - 2)
+}
+println(fib(15))`, "610\n"},
+		{"methods", `p = table{"x": 1, "move": fun(self, dx) { self.x = self.x + dx }}
+p.move(4)
+println(p.x)`, "5\n"},
+		{"loops", `sum = 0
+for i in range(10) {
+    if i == 7 then break
+    if i % 2 == 0 then continue
+    sum = sum + i
+}
+i = 0
+while i < 3 { i = i + 1 }
+println(sum, " ", i)`, "9 3\n"},
+		{"collections", `a = array{3, 1, 2}
+a = append(a, 4)
+t = table{"b": 2, "a": 1}
+for k, v in t { print(k, v, " ") }
+println(a, " ", len(t))`, "b2 a1 [3, 1, 2, 4] 2\n"},
+		{"try", `try {
+    throw("boom")
+} catch e {
+    println(e.message)
+} finally {
+    println("done")
+}`, "boom\ndone\n"},
+		{"nil", `t = table{}
+println(t?.missing ?? "default")`, "default\n"},
+		{"compound assignment", `a = array{1, 2}
+a[1] += 5
+n = 2
+n *= a[1]
+println(a, " ", n)`, "[1, 7] 14\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runBoth(t, tt.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got output %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendsAgreeOnErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"undefined variable", "x = 1\nprintln(y)", "runtime error (test.rune:2:9): Undefined variable 'y'"},
+		{"type mismatch", `x = "a" - 1`, "Expected number but got string"},
+		{"index out of bounds", "a = array{1}\na[3]", "Index '3' out of bounds"},
+		{"uncaught throw", `throw("boom")`, "boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runBoth(t, tt.source)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// The scripts of the example directories assert their own results.
+func TestExampleScripts(t *testing.T) {
+	for _, path := range []string{"example/precedence.rune", "example/bench/calls.rune", "example/bench/locals.rune", "example/bench/loop.rune", "example/bench/methods.rune"} {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			if _, err := runBoth(t, string(source)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkTreeWalker(b *testing.B) {
+	benchmarkScripts(b, TreeWalker)
+}
+
+func BenchmarkBytecode(b *testing.B) {
+	benchmarkScripts(b, Bytecode)
+}
+
+// Runs each script of example/bench once per iteration. The scripts are compiled once up front.
+func benchmarkScripts(b *testing.B, backend Backend) {
+	paths, err := filepath.Glob("example/bench/*.rune")
+	if err != nil || len(paths) == 0 {
+		b.Fatalf("no benchmark scripts found: %v", err)
+	}
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		prog, err := Compile(string(source), path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(strings.TrimSuffix(filepath.Base(path), ".rune"), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				vm := NewRuneVM()
+				vm.SetBackend(backend)
+				if err := vm.Exec(prog); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
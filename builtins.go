@@ -3,11 +3,13 @@ package runevm
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Returns the vm version in the format: `x.x.x`
@@ -26,14 +28,7 @@ func builtin_VmVersion(args ...interface{}) interface{} {
 // Function to print elements
 func builtin_Print(args ...interface{}) interface{} {
 	for _, arg := range args {
-		switch v := arg.(type) {
-		case []interface{}:
-			fmt.Print(formatArray(v))
-		case map[string]interface{}:
-			fmt.Print(formatMap(v))
-		default:
-			fmt.Print(v)
-		}
+		fmt.Print(formatValue(arg))
 	}
 	return nil
 }
@@ -41,20 +36,15 @@ func builtin_Print(args ...interface{}) interface{} {
 // Function to print elements with a newline
 func builtin_Println(args ...interface{}) interface{} {
 	for _, arg := range args {
-		switch v := arg.(type) {
-		case []interface{}:
-			fmt.Print(formatArray(v))
-		case map[string]interface{}:
-			fmt.Print(formatMap(v))
-		default:
-			fmt.Print(v)
-		}
+		fmt.Print(formatValue(arg))
 	}
 	fmt.Print("\n")
 	return nil
 }
 
-func builtin_Wait(args ...interface{}) interface{} {
+// Sleeps for the given number of milliseconds. Returns early with ErrCanceled or ErrTimeout
+// if the context of the running script is done.
+func (r *RuneVM) builtin_Wait(args ...interface{}) interface{} {
 	if len(args) != 1 {
 		return fmt.Errorf("wait requires exactly 1 argument")
 	}
@@ -66,9 +56,19 @@ func builtin_Wait(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type int, got: %T", args[0])
 	}
 
-	time.Sleep(time.Duration(ms) * time.Millisecond)
+	if r.ctx == nil {
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		return nil
+	}
 
-	return nil
+	timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.ctx.Done():
+		return contextError(r.ctx.Err())
+	}
 }
 
 func builtin_Millisecs(args ...interface{}) interface{} {
@@ -77,19 +77,27 @@ func builtin_Millisecs(args ...interface{}) interface{} {
 	}
 
 	// Get the current time and return the milliseconds since the Unix epoch
-	return time.Now().UnixNano() / int64(time.Millisecond)
+	return int(time.Now().UnixMilli())
 }
 
+// Ends the script with the given exit code, 0 if omitted. Run returns an ExitError holding the code.
 func builtin_Exit(args ...interface{}) interface{} {
-	if len(args) != 0 {
-		return fmt.Errorf("exit requires no arguments")
+	if len(args) > 1 {
+		return fmt.Errorf("exit requires at most 1 argument")
 	}
-	os.Exit(0)
-	return nil
+	code := 0
+	if len(args) == 1 {
+		var ok bool
+		code, ok = args[0].(int)
+		if !ok {
+			return fmt.Errorf("argument must be of type int, got: %T", args[0])
+		}
+	}
+	return &ExitError{Code: code}
 }
 
 // Read the contents of a file and return them as a string
-func builtin_ReadFileStr(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_ReadFileStr(args ...interface{}) interface{} {
 	if len(args) != 1 {
 		return fmt.Errorf("readfile requires exactly 1 argument")
 	}
@@ -100,6 +108,11 @@ func builtin_ReadFileStr(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
+	filename, err := r.sandbox.resolve(filename)
+	if err != nil {
+		return err
+	}
+
 	// Read the contents of the file
 	content, err := os.ReadFile(filename)
 	if err != nil {
@@ -110,7 +123,7 @@ func builtin_ReadFileStr(args ...interface{}) interface{} {
 }
 
 // Write a string to a file
-func builtin_WriteFileStr(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_WriteFileStr(args ...interface{}) interface{} {
 	if len(args) != 2 {
 		return fmt.Errorf("writefile requires exactly 2 arguments")
 	}
@@ -122,8 +135,13 @@ func builtin_WriteFileStr(args ...interface{}) interface{} {
 		return fmt.Errorf("arguments must be of type string, got: %T and %T", args[0], args[1])
 	}
 
+	filename, err := r.sandbox.resolve(filename)
+	if err != nil {
+		return err
+	}
+
 	// Write the contents to the file
-	err := os.WriteFile(filename, []byte(content), 0644)
+	err = os.WriteFile(filename, []byte(content), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write file: %v", err)
 	}
@@ -132,7 +150,7 @@ func builtin_WriteFileStr(args ...interface{}) interface{} {
 }
 
 // Returns true if the given file exists, otherwise false
-func builtin_FileExists(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_FileExists(args ...interface{}) interface{} {
 	if len(args) != 1 {
 		return fmt.Errorf("fileexists requires exactly 1 argument")
 	}
@@ -143,8 +161,13 @@ func builtin_FileExists(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
+	filename, err := r.sandbox.resolve(filename)
+	if err != nil {
+		return err
+	}
+
 	// Check if the file exists
-	_, err := os.Stat(filename)
+	_, err = os.Stat(filename)
 	if err == nil {
 		return true
 	}
@@ -155,7 +178,7 @@ func builtin_FileExists(args ...interface{}) interface{} {
 }
 
 // Returns true if the given directory exists, otherwise false
-func builtin_DirExists(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_DirExists(args ...interface{}) interface{} {
 	if len(args) != 1 {
 		return fmt.Errorf("direxists requires exactly 1 argument")
 	}
@@ -166,6 +189,11 @@ func builtin_DirExists(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
+	dirname, err := r.sandbox.resolve(dirname)
+	if err != nil {
+		return err
+	}
+
 	// Check if the directory exists
 	info, err := os.Stat(dirname)
 	if err == nil {
@@ -178,7 +206,7 @@ func builtin_DirExists(args ...interface{}) interface{} {
 }
 
 // Checks if a given path is a file or directory. Returns 0 if the path does not exist, 1 when it is a file, 2 when it is a directory
-func builtin_IsFileOrDir(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_IsFileOrDir(args ...interface{}) interface{} {
 	if len(args) != 1 {
 		return fmt.Errorf("isfileordir requires exactly 1 argument")
 	}
@@ -189,6 +217,11 @@ func builtin_IsFileOrDir(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
+	path, err := r.sandbox.resolve(path)
+	if err != nil {
+		return err
+	}
+
 	// Check if the path is a file or directory
 	info, err := os.Stat(path)
 	if err != nil {
@@ -282,12 +315,13 @@ func builtin_IsDigit(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
-	if len(char) != 1 {
-		return fmt.Errorf("argument must be a single character, got a string of length %d", len(char))
+	if utf8.RuneCountInString(char) != 1 {
+		return fmt.Errorf("argument must be a single character, got a string of length %d", utf8.RuneCountInString(char))
 	}
 
 	// Check if the character is a digit
-	return unicode.IsDigit(rune(char[0]))
+	ch, _ := utf8.DecodeRuneInString(char)
+	return unicode.IsDigit(ch)
 }
 
 // Check if a given string character is an alphabetical character
@@ -302,12 +336,13 @@ func builtin_IsAlpha(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
-	if len(char) != 1 {
-		return fmt.Errorf("argument must be a single character, got a string of length %d", len(char))
+	if utf8.RuneCountInString(char) != 1 {
+		return fmt.Errorf("argument must be a single character, got a string of length %d", utf8.RuneCountInString(char))
 	}
 
 	// Check if the character is an alphabetical character
-	return unicode.IsLetter(rune(char[0]))
+	ch, _ := utf8.DecodeRuneInString(char)
+	return unicode.IsLetter(ch)
 }
 
 // Check if a given string character is a whitespace character
@@ -322,16 +357,17 @@ func builtin_IsWhite(args ...interface{}) interface{} {
 		return fmt.Errorf("argument must be of type string, got: %T", args[0])
 	}
 
-	if len(char) != 1 {
-		return fmt.Errorf("argument must be a single character, got a string of length %d", len(char))
+	if utf8.RuneCountInString(char) != 1 {
+		return fmt.Errorf("argument must be a single character, got a string of length %d", utf8.RuneCountInString(char))
 	}
 
 	// Check if the character is a whitespace character
-	return unicode.IsSpace(rune(char[0]))
+	ch, _ := utf8.DecodeRuneInString(char)
+	return unicode.IsSpace(ch)
 }
 
 // Replace occurrences of a substring within a string with another substring
-func builtin_Replace(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_Replace(args ...interface{}) interface{} {
 	if len(args) != 3 {
 		return fmt.Errorf("replace requires exactly 3 arguments")
 	}
@@ -344,6 +380,11 @@ func builtin_Replace(args ...interface{}) interface{} {
 		return fmt.Errorf("arguments must be of type string, got: %T, %T, and %T", args[0], args[1], args[2])
 	}
 
+	// Check the length of the result before building it
+	if err := r.usage.limits.checkString(utf8.RuneCountInString(str) + strings.Count(str, old)*(utf8.RuneCountInString(new)-utf8.RuneCountInString(old))); err != nil {
+		return err
+	}
+
 	// Replace occurrences of the old substring with the new substring
 	return strings.ReplaceAll(str, old, new)
 }
@@ -475,7 +516,147 @@ func builtin_TypeOf(args ...interface{}) interface{} {
 		return fmt.Errorf("typeof requires exactly 1 argument")
 	}
 
-	switch args[0].(type) {
+	return typeName(args[0])
+}
+
+// Formats the arguments according to the format string, e.g. format("%s is %d years old", name, age).
+// Supports the verbs %v, %s, %q, %d, %x, %X, %o, %b, %c, %f, %F, %e, %E, %g, %G and %t with flags,
+// width and precision. Numeric verbs convert between ints and floats, other mismatches are errors.
+func (r *RuneVM) builtin_Format(args ...interface{}) interface{} {
+	if len(args) < 1 {
+		return fmt.Errorf("format requires at least 1 argument")
+	}
+
+	format, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("first argument must be of type string, got: %T", args[0])
+	}
+
+	var sb strings.Builder
+	// Characters of the result so far, counted up to byte counted of sb
+	chars, counted := 0, 0
+	values := args[1:]
+	next := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+		spec, verb, end, err := parseFormatSpec(format, i, r.usage.limits)
+		if err != nil {
+			return err
+		}
+		i = end
+		if verb == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		if next >= len(values) {
+			return fmt.Errorf("format string '%s' needs more than the %d given arguments", format, len(values))
+		}
+		value, err := formatArg(verb, values[next])
+		if err != nil {
+			// The format string is the first argument
+			return fmt.Errorf("argument %d of format: %v", next+2, err)
+		}
+		next++
+		// Widths are within MaxStringLength and the argument is a value of the script, so each piece is
+		// bounded before it is built
+		sb.WriteString(fmt.Sprintf(spec, value))
+		chars += utf8.RuneCountInString(sb.String()[counted:])
+		counted = sb.Len()
+		if err := r.usage.limits.checkString(chars); err != nil {
+			return err
+		}
+	}
+	if next < len(values) {
+		return fmt.Errorf("format string '%s' uses %d of the %d given arguments", format, next, len(values))
+	}
+	return sb.String()
+}
+
+// Widths and precisions above this are rejected, Go's fmt package doesn't support them either
+const maxFormatWidth = 1000000
+
+// Parses the format specifier starting with the % at format[start]. Returns the specifier for fmt.Sprintf,
+// its verb and the index of the verb.
+func parseFormatSpec(format string, start int, limits Limits) (spec string, verb byte, end int, err error) {
+	i := start + 1
+	for i < len(format) && strings.IndexByte("-+# 0", format[i]) >= 0 {
+		i++
+	}
+	for _, part := range []string{"width", "precision"} {
+		if part == "precision" {
+			if i >= len(format) || format[i] != '.' {
+				break
+			}
+			i++
+		}
+		n := 0
+		for ; i < len(format) && format[i] >= '0' && format[i] <= '9'; i++ {
+			if n = n*10 + int(format[i]-'0'); n > maxFormatWidth {
+				return "", 0, 0, fmt.Errorf("%s in format string '%s' is too large", part, format)
+			}
+		}
+		if err := limits.checkString(n); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	if i >= len(format) {
+		return "", 0, 0, fmt.Errorf("format string '%s' ends within a verb", format)
+	}
+	verb = format[i]
+	if verb == '%' && i == start+1 {
+		return "", '%', i, nil
+	}
+	if strings.IndexByte("vsqdxXobcfFeEgGt", verb) < 0 {
+		return "", 0, 0, fmt.Errorf("unknown verb '%%%c' in format string '%s'", verb, format)
+	}
+	return format[start : i+1], verb, i, nil
+}
+
+// Converts the argument to the Go value the verb formats. Arrays, tables and nil are formatted the
+// same way print does.
+func formatArg(verb byte, arg interface{}) (interface{}, error) {
+	switch verb {
+	case 'v', 's':
+		return formatValue(arg), nil
+	case 'q':
+		if str, ok := arg.(string); ok {
+			return str, nil
+		}
+	case 't':
+		if b, ok := arg.(bool); ok {
+			return b, nil
+		}
+	case 'x', 'X':
+		// %x of a string formats the hex codes of its bytes
+		if str, ok := arg.(string); ok {
+			return str, nil
+		}
+		fallthrough
+	case 'd', 'o', 'b', 'c':
+		switch n := arg.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+				return int(n), nil
+			}
+			return nil, fmt.Errorf("%%%c expects an integer, got %s", verb, formatValue(n))
+		}
+	default:
+		// The float verbs
+		if f, ok := toFloat(arg); ok {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%%%c can't format a value of type %s", verb, typeName(arg))
+}
+
+// Returns the Rune name of the type of the given value.
+func typeName(value interface{}) string {
+	switch value.(type) {
 	case int:
 		return "int"
 	case float64:
@@ -486,15 +667,19 @@ func builtin_TypeOf(args ...interface{}) interface{} {
 		return "string"
 	case []interface{}:
 		return "array"
-	case map[string]interface{}:
+	case *Table:
 		return "table"
+	case nil:
+		return "nil"
+	case func(args ...interface{}) interface{}:
+		return "function"
 	default:
 		return "unknown"
 	}
 }
 
 // Appends the given value to the given array, table or string. Returns the new array, table or string.
-func builtin_append(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_append(args ...interface{}) interface{} {
 	if len(args) < 2 {
 		return fmt.Errorf("append requires exactly 2 arguments for array/string or 3 arguments for map")
 	}
@@ -502,10 +687,17 @@ func builtin_append(args ...interface{}) interface{} {
 	// First argument should be the array, string, or map
 	switch arg := args[0].(type) {
 	case []interface{}:
+		if err := r.usage.limits.checkSize(len(arg) + 1); err != nil {
+			return err
+		}
 		return append(arg, args[1])
 	case string:
-		return arg + fmt.Sprint(args[1])
-	case map[string]interface{}:
+		str := formatValue(args[1])
+		if err := r.usage.limits.checkString(utf8.RuneCountInString(arg) + utf8.RuneCountInString(str)); err != nil {
+			return err
+		}
+		return arg + str
+	case *Table:
 		if len(args) != 3 {
 			return fmt.Errorf("append requires 3 arguments for map: map, key, value")
 		}
@@ -513,7 +705,12 @@ func builtin_append(args ...interface{}) interface{} {
 		if !ok {
 			return fmt.Errorf("second argument must be a string key for a map")
 		}
-		arg[key] = args[2]
+		if !arg.Has(key) {
+			if err := r.usage.limits.checkSize(arg.Len() + 1); err != nil {
+				return err
+			}
+		}
+		arg.Set(key, args[2])
 		return arg
 	default:
 		return fmt.Errorf("first argument must be an array, string, or map, got %T", args[0])
@@ -542,19 +739,19 @@ func builtin_remove(args ...interface{}) interface{} {
 		if !ok {
 			return fmt.Errorf("second argument must be a valid index")
 		}
-		if index < 0 || index >= len(arg) {
-			return fmt.Errorf("index %d out of bounds for string[%d]", index, len(arg))
+		chars := []rune(arg)
+		if index < 0 || index >= len(chars) {
+			return fmt.Errorf("index %d out of bounds for string[%d]", index, len(chars))
 		}
-		return arg[:index] + arg[index+1:]
-	case map[string]interface{}:
+		return string(chars[:index]) + string(chars[index+1:])
+	case *Table:
 		key, ok := args[1].(string)
 		if !ok {
 			return fmt.Errorf("second argument must be a string key for a map")
 		}
-		if _, exists := arg[key]; !exists {
+		if !arg.Delete(key) {
 			return fmt.Errorf("key '%s' does not exist in map", key)
 		}
-		delete(arg, key)
 		return arg
 	default:
 		return fmt.Errorf("first argument must be an array, string, or map, got %T", args[0])
@@ -568,7 +765,7 @@ func builtin_hasKey(args ...interface{}) interface{} {
 	}
 
 	// First argument should be the map
-	argMap, ok := args[0].(map[string]interface{})
+	argMap, ok := args[0].(*Table)
 	if !ok {
 		return fmt.Errorf("first argument must be a map, got %T", args[0])
 	}
@@ -579,8 +776,7 @@ func builtin_hasKey(args ...interface{}) interface{} {
 		return fmt.Errorf("second argument must be a string key, got %T", args[1])
 	}
 
-	_, exists := argMap[key]
-	return exists
+	return argMap.Has(key)
 }
 
 // Returns a slice of the given array, table, or string from the start index to the end index.
@@ -605,24 +801,17 @@ func builtin_slice(args ...interface{}) interface{} {
 			return fmt.Errorf("index out of bounds for array slice")
 		}
 		return arg[start:end]
-	case map[string]interface{}:
-		keys := make([]string, 0, len(arg))
-		for k := range arg {
-			keys = append(keys, k)
-		}
-		if start < 0 || end > len(keys) || start > end {
+	case *Table:
+		if start < 0 || end > arg.Len() || start > end {
 			return fmt.Errorf("index out of bounds for map slice")
 		}
-		slicedMap := make(map[string]interface{})
-		for _, k := range keys[start:end] {
-			slicedMap[k] = arg[k]
-		}
-		return slicedMap
+		return arg.slice(start, end)
 	case string:
-		if start < 0 || end > len(arg) || start > end {
+		chars := []rune(arg)
+		if start < 0 || end > len(chars) || start > end {
 			return fmt.Errorf("index out of bounds for string slice")
 		}
-		return arg[start:end]
+		return string(chars[start:end])
 	default:
 		return fmt.Errorf("first argument must be an array, map, or string, got %T", args[0])
 	}
@@ -645,24 +834,17 @@ func builtin_sliceLeft(args ...interface{}) interface{} {
 			return fmt.Errorf("index out of bounds for array slice")
 		}
 		return arg[:end]
-	case map[string]interface{}:
-		keys := make([]string, 0, len(arg))
-		for k := range arg {
-			keys = append(keys, k)
-		}
-		if end > len(keys) || end < 0 {
+	case *Table:
+		if end > arg.Len() || end < 0 {
 			return fmt.Errorf("index out of bounds for map slice")
 		}
-		slicedMap := make(map[string]interface{})
-		for _, k := range keys[:end] {
-			slicedMap[k] = arg[k]
-		}
-		return slicedMap
+		return arg.slice(0, end)
 	case string:
-		if end > len(arg) || end < 0 {
+		chars := []rune(arg)
+		if end > len(chars) || end < 0 {
 			return fmt.Errorf("index out of bounds for string slice")
 		}
-		return arg[:end]
+		return string(chars[:end])
 	default:
 		return fmt.Errorf("first argument must be an array, map, or string, got %T", args[0])
 	}
@@ -685,24 +867,17 @@ func builtin_sliceRight(args ...interface{}) interface{} {
 			return fmt.Errorf("index out of bounds for array slice")
 		}
 		return arg[start:]
-	case map[string]interface{}:
-		keys := make([]string, 0, len(arg))
-		for k := range arg {
-			keys = append(keys, k)
-		}
-		if start < 0 || start > len(keys) {
+	case *Table:
+		if start < 0 || start > arg.Len() {
 			return fmt.Errorf("index out of bounds for map slice")
 		}
-		slicedMap := make(map[string]interface{})
-		for _, k := range keys[start:] {
-			slicedMap[k] = arg[k]
-		}
-		return slicedMap
+		return arg.slice(start, arg.Len())
 	case string:
-		if start < 0 || start > len(arg) {
+		chars := []rune(arg)
+		if start < 0 || start > len(chars) {
 			return fmt.Errorf("index out of bounds for string slice")
 		}
-		return arg[start:]
+		return string(chars[start:])
 	default:
 		return fmt.Errorf("first argument must be an array, map, or string, got %T", args[0])
 	}
@@ -718,24 +893,94 @@ func builtin_Len(args ...interface{}) interface{} {
 	case []interface{}:
 		return len(arg)
 	case string:
-		return len(arg)
-	case map[string]interface{}:
-		return len(arg)
+		// The length of a string is the number of characters, not bytes
+		return utf8.RuneCountInString(arg)
+	case *Table:
+		return arg.Len()
 	default:
 		return fmt.Errorf("argument must be an array, string, or map, got %T", args[0])
 	}
 }
 
+// Returns an array of the ints from start up to, but not including, end. With a single argument start is 0.
+// The optional third argument is the step, which may be negative to count down.
+func (r *RuneVM) builtin_Range(args ...interface{}) interface{} {
+	start, step, count, err := rangeBounds(args)
+	if err != nil {
+		return err
+	}
+	if count > maxRangeSize {
+		return fmt.Errorf("range of %d elements is too large, the maximum is %d", count, maxRangeSize)
+	}
+	if err := r.usage.limits.checkSize(int(count)); err != nil {
+		return err
+	}
+
+	arr := make([]interface{}, count)
+	value := start
+	for i := range arr {
+		arr[i] = value
+		value += step
+	}
+	return arr
+}
+
+// Number of elements range creates at most, even without a MaxCollectionSize limit. A for loop over
+// range has no limit, it counts without creating the array.
+const maxRangeSize = 1 << 30
+
+// Returns the start, the step and the number of ints of a range from the arguments of range.
+func rangeBounds(args []interface{}) (int, int, uint64, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return 0, 0, 0, fmt.Errorf("range requires 1 to 3 arguments")
+	}
+	bounds := []int{0, 0, 1}
+	for i, arg := range args {
+		n, ok := arg.(int)
+		if !ok {
+			return 0, 0, 0, fmt.Errorf("arguments must be of type int, got: %T", arg)
+		}
+		bounds[i] = n
+	}
+	start, end, step := bounds[0], bounds[1], bounds[2]
+	if len(args) == 1 {
+		start, end = 0, bounds[0]
+	}
+	if step == 0 {
+		return 0, 0, 0, fmt.Errorf("step must not be 0")
+	}
+
+	// The distance between start and end may not fit into an int, but always fits into an uint64
+	var span, stride uint64
+	if step > 0 && start < end {
+		span, stride = uint64(end)-uint64(start), uint64(step)
+	} else if step < 0 && start > end {
+		span, stride = uint64(start)-uint64(end), -uint64(step)
+	}
+	count := uint64(0)
+	if span > 0 {
+		count = (span-1)/stride + 1
+	}
+	return start, step, count, nil
+}
+
 // Returns a deep copy of the given array or table.
-func builtin_New(args ...interface{}) interface{} {
+func (r *RuneVM) builtin_New(args ...interface{}) interface{} {
 	if len(args) != 1 {
 		return fmt.Errorf("new requires exactly 1 argument")
 	}
 
+	// Every nested array or table is copied, so all but the returned copy count as extra allocations
+	if r.usage.limits.MaxAllocations > 0 {
+		if err := r.usage.allocate(countCollections(args[0]) - 1); err != nil {
+			return err
+		}
+	}
+
 	switch v := args[0].(type) {
 	case []interface{}:
 		return deepCopyArray(v)
-	case map[string]interface{}:
+	case *Table:
 		return deepCopyMap(v)
 	default:
 		return fmt.Errorf("new can only create copies of arrays or tables, got %T", args[0])
@@ -806,16 +1051,42 @@ func builtin_Assert(args ...interface{}) interface{} {
 	return nil
 }
 
+// Raises a runtime error that a try block can catch. The catch block receives the thrown value in the
+// 'value' field of the error table.
+func builtin_Throw(args ...interface{}) interface{} {
+	if len(args) != 1 {
+		return fmt.Errorf("throw requires exactly 1 argument")
+	}
+
+	return &ThrownError{Value: args[0]}
+}
+
 // //////////////////////////////////////////////////////////////////////////////
 // Helper Functions
 // //////////////////////////////////////////////////////////////////////////////
 
+// Returns the string representation of a value, as used by print, string concatenation and interpolation
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		return formatArray(v)
+	case *Table:
+		return formatMap(v)
+	case nil:
+		return "nil"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
 // Helper function to format arrays for pretty printing
 func formatArray(arr []interface{}) string {
 	var sb strings.Builder
 	sb.WriteString("[")
 	for i, elem := range arr {
-		sb.WriteString(fmt.Sprintf("%v", elem))
+		sb.WriteString(formatValue(elem))
 		if i < len(arr)-1 {
 			sb.WriteString(", ")
 		}
@@ -824,21 +1095,19 @@ func formatArray(arr []interface{}) string {
 	return sb.String()
 }
 
-// Helper function to format maps for pretty printing
-func formatMap(m map[string]interface{}) string {
+// Helper function to format tables for pretty printing, in insertion order
+func formatMap(t *Table) string {
 	var sb strings.Builder
 	sb.WriteString("{")
-	i := 0
-	for key, value := range m {
-		sb.WriteString(fmt.Sprintf("%v: %v", key, value))
-		if i < len(m)-1 {
+	for i, key := range t.Keys() {
+		value, _ := t.Get(key)
+		sb.WriteString(fmt.Sprintf("%v: %s", key, formatValue(value)))
+		if i < t.Len()-1 {
 			sb.WriteString(", ")
 		}
-		i++
 	}
 	sb.WriteString("}")
 	return sb.String()
-
 }
 
 func deepCopyArray(arr []interface{}) []interface{} {
@@ -849,19 +1118,39 @@ func deepCopyArray(arr []interface{}) []interface{} {
 	return newArr
 }
 
-func deepCopyMap(m map[string]interface{}) map[string]interface{} {
-	newMap := make(map[string]interface{})
-	for k, v := range m {
-		newMap[k] = deepCopyValue(v)
+func deepCopyMap(t *Table) *Table {
+	newMap := NewTable()
+	for _, k := range t.Keys() {
+		v, _ := t.Get(k)
+		newMap.Set(k, deepCopyValue(v))
 	}
 	return newMap
 }
 
+// Returns the number of arrays and tables in the given value, including the value itself.
+func countCollections(value interface{}) int {
+	n := 0
+	switch v := value.(type) {
+	case []interface{}:
+		n++
+		for _, elem := range v {
+			n += countCollections(elem)
+		}
+	case *Table:
+		n++
+		for _, key := range v.Keys() {
+			elem, _ := v.Get(key)
+			n += countCollections(elem)
+		}
+	}
+	return n
+}
+
 func deepCopyValue(value interface{}) interface{} {
 	switch v := value.(type) {
 	case []interface{}:
 		return deepCopyArray(v)
-	case map[string]interface{}:
+	case *Table:
 		return deepCopyMap(v)
 	default:
 		return v
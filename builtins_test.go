@@ -0,0 +1,254 @@
+package runevm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{`"%.2f", 2`, "2.00"},
+		{`"%d", 3.0`, "3"},
+		{`"%5d|%-5d|%05d", 42, 7, -3`, "   42|7    |-0003"},
+		{`"%s %v %s", nil, array{1, "a"}, table{"k": 2}`, "nil [1, a] {k: 2}"},
+		{`"%s is %d years old", "Ann", 30`, "Ann is 30 years old"},
+		{`"%q %t %x %X %o %b %c", "hi", true, 255, "hi", 8, 5, 65`, `"hi" true ff 6869 10 101 A`},
+		{`"%e %g %8.3f%%", 12345, 0.5, 3.14159`, "1.234500e+04 0.5    3.142%"},
+		{`"%-6s|", "ab"`, "ab    |"},
+		{`"no verbs"`, "no verbs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			out, err := runBoth(t, "print(format("+tt.args+"))")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{`"%d"`, "needs more than the 0 given arguments"},
+		{`"%d %d", 1`, "needs more than the 1 given arguments"},
+		{`"%d", 1, 2`, "uses 1 of the 2 given arguments"},
+		{`"%d", "a"`, "argument 2 of format: %d can't format a value of type string"},
+		{`"%s %d", "a", 2.5`, "argument 3 of format: %d expects an integer, got 2.5"},
+		{`"%t", 1`, "%t can't format a value of type int"},
+		{`"%y", 1`, "unknown verb '%y'"},
+		{`"%*d", 1, 2`, "unknown verb '%*'"},
+		{`"abc%"`, "ends within a verb"},
+		{`"%2000000000d", 1`, "width in format string '%2000000000d' is too large"},
+		{`"%.2000000000f", 1`, "precision in format string '%.2000000000f' is too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			_, err := runBoth(t, "format("+tt.args+")")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMaxStringLength(t *testing.T) {
+	for _, args := range []string{`"%100d", 1`, `"%.100f", 1`, `"%s%s", "abcdef", "ghijkl"`} {
+		t.Run(args, func(t *testing.T) {
+			_, err := runBoth(t, "format("+args+")", withLimits(Limits{MaxStringLength: 10}))
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != "MaxStringLength" {
+				t.Errorf("got %v, want a MaxStringLength error", err)
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"5", "[0, 1, 2, 3, 4]"},
+		{"2, 5", "[2, 3, 4]"},
+		{"10, 0, -3", "[10, 7, 4, 1]"},
+		{"0, 10, 4", "[0, 4, 8]"},
+		{"3, 3", "[]"},
+		{"5, 1", "[]"},
+		{"-9223372036854775807, 9223372036854775807, 4611686018427387904", "[-9223372036854775807, -4611686018427387903, 1, 4611686018427387905]"},
+		{"9223372036854775807, -9223372036854775807, -4611686018427387904", "[9223372036854775807, 4611686018427387903, -1, -4611686018427387905]"},
+		{"-9223372036854775807, 9223372036854775807, 9223372036854775807", "[-9223372036854775807, 0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			out, err := runBoth(t, "print(range("+tt.args+"))")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+
+			// A for loop counts through the range without the array, but visits the same ints
+			out, err = runBoth(t, "a = array{}\nfor i in range("+tt.args+") { a = append(a, i) }\nprint(a)")
+			if err != nil {
+				t.Fatalf("unexpected error in the loop: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("loop got %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeInForLoop(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"huge range", "for i in range(1000000000000) {\n    if i == 3 then break\n    print(i)\n}", "012"},
+		{"whole int range", "for i in range(-9000000000000000000, 9000000000000000000, 3000000000000000000) { print(i, \" \") }",
+			"-9000000000000000000 -6000000000000000000 -3000000000000000000 0 3000000000000000000 6000000000000000000 "},
+		{"index and value", "for i, v in range(10, 13) { print(i, \":\", v, \" \") }", "0:10 1:11 2:12 "},
+		{"range redefined by the script", "range = fun(n) { array{\"x\", \"y\"} }\nfor v in range(5) { print(v) }", "xy"},
+		{"range as value", "r = range(3)\nfor v in r { print(v) }\nprint(r)", "012[0, 1, 2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runBoth(t, tt.source, withLimits(Limits{MaxCollectionSize: 100}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	// The arguments are checked like those of range
+	_, err := runBoth(t, "for i in range(1, \"5\") {}")
+	if err == nil || !strings.Contains(err.Error(), "Error in function call: 'arguments must be of type int, got: string'") {
+		t.Errorf("got %v, want the error of range", err)
+	}
+	_, err = runBoth(t, "for i in range(1, 5, 0) {}")
+	if err == nil || !strings.Contains(err.Error(), "step must not be 0") {
+		t.Errorf("got %v, want the error of range", err)
+	}
+}
+
+func TestRangeTooLarge(t *testing.T) {
+	_, err := runBoth(t, "range(-9000000000000000000, 9000000000000000000)")
+	var runeErr *RuneError
+	if !errors.As(err, &runeErr) || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("got %v, want a runtime error about the size", err)
+	}
+
+	_, err = runBoth(t, "range(1000)", withLimits(Limits{MaxCollectionSize: 100}))
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxCollectionSize" {
+		t.Errorf("got %v, want a MaxCollectionSize error", err)
+	}
+}
+
+func TestAppendToString(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`"y"`, "xy"},
+		{"1", "x1"},
+		{"2.5", "x2.5"},
+		{"true", "xtrue"},
+		{"nil", "xnil"},
+		{`array{1, "a"}`, "x[1, a]"},
+		{`table{"a": 1}`, "x{a: 1}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			// append formats the value the same way print and string interpolation do
+			source := "v = " + tt.value + "\nprintln(append(\"x\", v))\nprintln(\"x${v}\")"
+			out, err := runBoth(t, source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := tt.want + "\n" + tt.want + "\n"; out != want {
+				t.Errorf("got %q, want %q", out, want)
+			}
+		})
+	}
+}
+
+func TestTableLiteralKeys(t *testing.T) {
+	out, err := runBoth(t, `k = nil
+n = 1.5
+println(table{k: 1, n: 2, "s": 3})`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "{nil: 1, 1.5: 2, s: 3}\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// String builtins count characters, not bytes
+func TestStringBuiltinsUseCharacters(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`len("äöü")`, "3"},
+		{`len("😀a")`, "2"},
+		{`len("e` + "́" + `")`, "2"},
+		{`slice("häßlich", 1, 4)`, "äßl"},
+		{`slice("😀😁😂", 1, 2)`, "😁"},
+		{`sliceleft("größe", 3)`, "grö"},
+		{`sliceright("größe", 3)`, "ße"},
+		{`remove("häß", 1)`, "hß"},
+		{`remove("😀a", 0)`, "a"},
+		{`isalpha("ß")`, "true"},
+		{`isalpha("😀")`, "false"},
+		{`strupper("äöü")`, "ÄÖÜ"},
+		{`strlower("ÄÖÜ")`, "äöü"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			out, err := runBoth(t, "print("+tt.source+")")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringBuiltinBounds(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`slice("äö", 0, 3)`, "index out of bounds for string slice"},
+		{`sliceleft("äö", 3)`, "index out of bounds for string slice"},
+		{`remove("äö", 2)`, "index 2 out of bounds for string[2]"},
+		{`remove("😀", -1)`, "index -1 out of bounds for string[1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := runBoth(t, tt.source)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
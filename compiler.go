@@ -0,0 +1,632 @@
+package runevm
+
+// The bytecode backend compiles the AST of a program into a flat list of instructions per function
+// which are executed by the stack machine in machine.go.
+//
+// The parameters and the variables a function assigns to are resolved to local slots at compile time.
+// Locals that are captured by nested functions live in cells that are shared with the closures. The
+// variables of the program and of functions that import files stay in the Environment.
+//
+// An assignment updates an existing variable of an enclosing scope or defines a new one, so a local
+// other than a parameter starts out undefined. Until it is assigned, it is looked up like the tree
+// walker does: in the enclosing functions, then in the Environment. Such lookups follow a path of
+// locations resolved at compile time, from the innermost function outwards.
+
+type opcode uint8
+
+const (
+	opConst        opcode = iota // push consts[arg]
+	opPop                        // discard the top value
+	opPopN                       // discard the top arg values
+	opDup                        // push the top value again
+	opDup2                       // a, b -> a, b, a, b
+	opGetVar                     // push the variable names[arg] from the environment
+	opSetVar                     // assign the top value to the variable names[arg]
+	opGetLocal                   // push local slot arg
+	opSetLocal                   // assign the top value to local slot arg
+	opGetCell                    // push the captured local slot arg
+	opSetCell                    // assign the top value to the captured local slot arg
+	opGetUpval                   // push upvalue arg of the closure
+	opSetUpval                   // assign the top value to upvalue arg of the closure
+	opGetPath                    // push the first defined variable along paths[arg]
+	opSetPath                    // assign the top value to the first defined variable along paths[arg], or define it
+	opGetIndex                   // container, index -> value
+	opSetIndex                   // container, index, value -> value
+	opBinary                     // a, b -> a <operator of the source expression> b
+	opUnary                      // a -> <unary operator of the source expression> a
+	opJump                       // continue at pc arg
+	opJumpIfFalse                // pop the condition and continue at pc arg if it is falsy
+	opJumpIfNotNil               // continue at pc arg if the top value is not nil, otherwise pop it
+	opArray                      // arg values -> array
+	opTable                      // arg key/value pairs -> table
+	opClosure                    // push a closure of protos[arg]
+	opCall                       // fn, arg arguments -> result
+	opCallMethod                 // container, fn, arg arguments -> result, passing the container as self if it is a table
+	opReturn                     // return the top value from the current function
+	opImport                     // path -> nil, runs the imported file in the current environment
+	opInterp                     // arg values -> string joining the parts of an interpolated string
+	opIter                       // array or table -> iterator assigning arg loop variables
+	opIterNext                   // push the loop variables of the next iteration, or continue at pc arg when done
+	opTry                        // install a handler that continues at pc arg with the caught error pushed
+	opEndTry                     // remove the innermost handler
+	opCatch                      // caught error -> error table
+	opRethrow                    // raise the caught error on top of the stack again
+)
+
+type instruction struct {
+	op  opcode
+	arg int
+}
+
+type upvalDesc struct {
+	// Capture a cell of the enclosing function if true, otherwise one of the enclosing function's upvalues
+	local bool
+	index int
+}
+
+// Where a variable may be stored.
+type varLocation uint8
+
+const (
+	localLocation varLocation = iota
+	upvalLocation
+	envLocation
+)
+
+// One of the places a variable is looked up in: a local slot, an upvalue or, with the index of its name,
+// the Environment.
+type varPlace struct {
+	location varLocation
+	index    int
+}
+
+// Value of a local that isn't assigned yet.
+type undefinedLocal struct{}
+
+// A compiled function or program.
+type funcProto struct {
+	numParams int
+	numLocals int
+	code      []instruction
+	// Source expression of each instruction, used for error reporting
+	exprs  []*expression
+	consts []interface{}
+	names  []string
+	// Lookup paths of the variables that may be undefined
+	paths  [][]varPlace
+	protos []*funcProto
+	upvals []upvalDesc
+	// Local slots captured by nested functions
+	captured []bool
+	hasCells bool
+	// The function defines variables dynamically, so each call needs its own Environment
+	newScope bool
+	// The function contains try blocks, so its frames have to recover errors
+	hasTry bool
+}
+
+type loopState struct {
+	exp    *expression
+	start  int
+	depth  int
+	breaks []int
+}
+
+// A try or catch block whose handler is installed while its code runs.
+type tryState struct {
+	finally *expression
+	// Number of loops enclosing the block
+	loops int
+}
+
+// A local slot of the function of a compiler, captured as upvalue by a nested function.
+type upvalKey struct {
+	owner *compiler
+	slot  int
+}
+
+type compiler struct {
+	parent     *compiler
+	proto      *funcProto
+	locals     map[string]int
+	upvalIndex map[upvalKey]int
+	nameIndex  map[string]int
+	pathIndex  map[string]int
+	loops      []*loopState
+	tries      []*tryState
+	// Number of values on the operand stack at the current instruction
+	depth int
+}
+
+func newCompiler(parent *compiler, params []string) *compiler {
+	c := &compiler{
+		parent:     parent,
+		proto:      &funcProto{numParams: len(params), numLocals: len(params), captured: make([]bool, len(params))},
+		locals:     make(map[string]int),
+		upvalIndex: make(map[upvalKey]int),
+		nameIndex:  make(map[string]int),
+		pathIndex:  make(map[string]int),
+	}
+	for i, name := range params {
+		c.locals[name] = i
+	}
+	return c
+}
+
+// Creates the compiler of a function and gives a local slot to each variable its body assigns to.
+// A function that imports files defines the variables of the imports in its Environment, so its
+// variables stay there as well.
+func newFunctionCompiler(parent *compiler, exp *expression) *compiler {
+	c := newCompiler(parent, exp.Params)
+	names, hasImport := assignedNames(exp.Body)
+	if hasImport {
+		return c
+	}
+	for _, name := range names {
+		if _, ok := c.locals[name]; !ok {
+			c.locals[name] = c.proto.numLocals
+			c.proto.numLocals++
+			c.proto.captured = append(c.proto.captured, false)
+		}
+	}
+	return c
+}
+
+// Returns the names the code assigns to, including loop and catch variables, without those of nested
+// functions. Reports whether the code imports files.
+func assignedNames(exp *expression) (names []string, hasImport bool) {
+	var walk func(exp *expression)
+	walk = func(exp *expression) {
+		switch exp.Type {
+		case funExpr:
+			return
+		case importExpr:
+			hasImport = true
+		case assignExpr:
+			if exp.Left.Index == nil {
+				names = append(names, exp.Left.Value.(string))
+			}
+		case forExpr, tryExpr:
+			names = append(names, exp.Params...)
+		}
+		for _, child := range exp.children() {
+			walk(child)
+		}
+	}
+	walk(exp)
+	return names, hasImport
+}
+
+// Compiles the AST of a program. Lex and parse errors are reported by Compile, so the only errors
+// raised here are invalid literals.
+func compileBytecode(ast *expression) (proto *funcProto, err error) {
+	defer recoverError(&err)
+	c := newCompiler(nil, nil)
+	c.compile(ast)
+	c.emit(opReturn, 0, ast)
+	proto = c.finish()
+	// A program defines its variables in the environment it runs in, like the tree walker does,
+	// so they are kept for later runs
+	proto.newScope = false
+	return proto, nil
+}
+
+func (c *compiler) finish() *funcProto {
+	proto := c.proto
+	// Locals that turned out to be captured are only known after the whole function was compiled
+	for i, ins := range proto.code {
+		if ins.op == opGetLocal && proto.captured[ins.arg] {
+			proto.code[i].op = opGetCell
+		} else if ins.op == opSetLocal && proto.captured[ins.arg] {
+			proto.code[i].op = opSetCell
+		}
+	}
+	for _, captured := range proto.captured {
+		proto.hasCells = proto.hasCells || captured
+	}
+	return proto
+}
+
+func stackEffect(op opcode, arg int) int {
+	switch op {
+	case opDup2:
+		return 2
+	case opConst, opDup, opGetVar, opGetLocal, opGetCell, opGetUpval, opGetPath, opClosure:
+		return 1
+	case opPop, opGetIndex, opBinary, opJumpIfFalse, opJumpIfNotNil, opReturn, opRethrow:
+		return -1
+	case opPopN:
+		return -arg
+	case opSetIndex:
+		return -2
+	case opArray, opInterp:
+		return 1 - arg
+	case opTable:
+		return 1 - 2*arg
+	case opCall:
+		return -arg
+	case opCallMethod:
+		return -arg - 1
+	default:
+		return 0
+	}
+}
+
+func (c *compiler) emit(op opcode, arg int, exp *expression) int {
+	c.proto.code = append(c.proto.code, instruction{op: op, arg: arg})
+	c.proto.exprs = append(c.proto.exprs, exp)
+	c.depth += stackEffect(op, arg)
+	return len(c.proto.code) - 1
+}
+
+// Points the jump instruction at the given pc to the next instruction.
+func (c *compiler) patchJump(at int) {
+	c.proto.code[at].arg = len(c.proto.code)
+}
+
+func (c *compiler) constant(value interface{}) int {
+	c.proto.consts = append(c.proto.consts, value)
+	return len(c.proto.consts) - 1
+}
+
+func (c *compiler) name(name string) int {
+	if idx, ok := c.nameIndex[name]; ok {
+		return idx
+	}
+	c.proto.names = append(c.proto.names, name)
+	c.nameIndex[name] = len(c.proto.names) - 1
+	return len(c.proto.names) - 1
+}
+
+// Returns the upvalue of the function that captures the local slot of the enclosing function of owner.
+func (c *compiler) capture(owner *compiler, slot int) int {
+	key := upvalKey{owner: owner, slot: slot}
+	if idx, ok := c.upvalIndex[key]; ok {
+		return idx
+	}
+	desc := upvalDesc{local: true, index: slot}
+	if c.parent == owner {
+		owner.proto.captured[slot] = true
+	} else {
+		desc = upvalDesc{local: false, index: c.parent.capture(owner, slot)}
+	}
+	c.proto.upvals = append(c.proto.upvals, desc)
+	c.upvalIndex[key] = len(c.proto.upvals) - 1
+	return len(c.proto.upvals) - 1
+}
+
+// Returns the places the variable is looked up in, innermost first: the locals of this and the enclosing
+// functions, then the Environment. Parameters are always defined, so the path ends at the first one.
+func (c *compiler) resolve(name string) []varPlace {
+	var path []varPlace
+	for fn := c; fn.parent != nil; fn = fn.parent {
+		slot, ok := fn.locals[name]
+		if !ok {
+			continue
+		}
+		if fn == c {
+			path = append(path, varPlace{location: localLocation, index: slot})
+		} else {
+			path = append(path, varPlace{location: upvalLocation, index: c.capture(fn, slot)})
+		}
+		if slot < fn.proto.numParams {
+			return path
+		}
+	}
+	return append(path, varPlace{location: envLocation, index: c.name(name)})
+}
+
+// Returns the index of the lookup path of the variable in paths.
+func (c *compiler) path(name string, path []varPlace) int {
+	if idx, ok := c.pathIndex[name]; ok {
+		return idx
+	}
+	c.proto.paths = append(c.proto.paths, path)
+	c.pathIndex[name] = len(c.proto.paths) - 1
+	return len(c.proto.paths) - 1
+}
+
+func (c *compiler) emitGet(name string, exp *expression) {
+	path := c.resolve(name)
+	switch {
+	case len(path) > 1:
+		c.emit(opGetPath, c.path(name, path), exp)
+	case path[0].location == localLocation:
+		c.emit(opGetLocal, path[0].index, exp)
+	case path[0].location == upvalLocation:
+		c.emit(opGetUpval, path[0].index, exp)
+	default:
+		c.emit(opGetVar, path[0].index, exp)
+	}
+}
+
+func (c *compiler) emitSet(name string, exp *expression) {
+	path := c.resolve(name)
+	switch {
+	case len(path) > 1:
+		c.emit(opSetPath, c.path(name, path), exp)
+	case path[0].location == localLocation:
+		c.emit(opSetLocal, path[0].index, exp)
+	case path[0].location == upvalLocation:
+		c.emit(opSetUpval, path[0].index, exp)
+	default:
+		c.emit(opSetVar, path[0].index, exp)
+	}
+	if path[0].location != localLocation && c.parent != nil {
+		// The variable may be defined in the Environment of the function
+		c.proto.newScope = true
+	}
+}
+
+// Emits the instructions that leave the value of the expression on top of the stack.
+func (c *compiler) compile(exp *expression) {
+	switch exp.Type {
+	case numExpr, strExpr, boolExpr:
+		c.emit(opConst, c.constant(exp.Value), exp)
+
+	case nilExpr:
+		c.emit(opConst, c.constant(nil), exp)
+
+	case varExpr:
+		if exp.Index != nil {
+			c.compile(exp.Left)
+			c.compile(exp.Index)
+			c.emit(opGetIndex, 0, exp)
+			return
+		}
+		c.emitGet(exp.Value.(string), exp)
+
+	case assignExpr:
+		// A compound assignment reads the old value and applies its operator before assigning
+		compound := exp.Operator != "="
+		if exp.Left.Index != nil {
+			c.compile(exp.Left.Left)
+			c.compile(exp.Left.Index)
+			if compound {
+				c.emit(opDup2, 0, exp)
+				c.emit(opGetIndex, 0, exp.Left)
+			}
+			c.compile(exp.Right)
+			if compound {
+				c.emit(opBinary, 0, exp)
+			}
+			c.emit(opSetIndex, 0, exp)
+			return
+		}
+		name := exp.Left.Value.(string)
+		if compound {
+			c.emitGet(name, exp.Left)
+		}
+		c.compile(exp.Right)
+		if compound {
+			c.emit(opBinary, 0, exp)
+		}
+		c.emitSet(name, exp)
+
+	case binaryExpr:
+		c.compile(exp.Left)
+		if exp.Operator == "??" {
+			jumpEnd := c.emit(opJumpIfNotNil, 0, exp)
+			c.compile(exp.Right)
+			c.patchJump(jumpEnd)
+			return
+		}
+		c.compile(exp.Right)
+		c.emit(opBinary, 0, exp)
+
+	case unaryExpr:
+		c.compile(exp.Right)
+		c.emit(opUnary, 0, exp)
+
+	case funExpr:
+		child := newFunctionCompiler(c, exp)
+		child.compile(exp.Body)
+		child.emit(opReturn, 0, exp)
+		c.proto.protos = append(c.proto.protos, child.finish())
+		c.emit(opClosure, len(c.proto.protos)-1, exp)
+
+	case ifExpr:
+		c.compile(exp.Cond)
+		jumpElse := c.emit(opJumpIfFalse, 0, exp)
+		c.compile(exp.Then)
+		jumpEnd := c.emit(opJump, 0, exp)
+		c.patchJump(jumpElse)
+		// Only one of both branches is executed
+		c.depth--
+		if exp.Else != nil {
+			c.compile(exp.Else)
+		} else {
+			c.emit(opConst, c.constant(false), exp)
+		}
+		c.patchJump(jumpEnd)
+
+	case whileExpr:
+		loop := &loopState{exp: exp, start: len(c.proto.code), depth: c.depth}
+		c.loops = append(c.loops, loop)
+		c.compile(exp.Cond)
+		jumpEnd := c.emit(opJumpIfFalse, 0, exp)
+		c.compile(exp.Body)
+		c.emit(opPop, 0, exp)
+		c.emit(opJump, loop.start, exp)
+		c.patchJump(jumpEnd)
+		for _, at := range loop.breaks {
+			c.patchJump(at)
+		}
+		c.loops = c.loops[:len(c.loops)-1]
+		c.emit(opConst, c.constant(false), exp)
+
+	case forExpr:
+		// The iterator stays on the stack while the loop runs
+		c.compile(exp.Right)
+		c.emit(opIter, len(exp.Params), exp)
+		loop := &loopState{exp: exp, start: len(c.proto.code), depth: c.depth}
+		c.loops = append(c.loops, loop)
+		jumpEnd := c.emit(opIterNext, 0, exp)
+		c.depth += len(exp.Params)
+		for i := len(exp.Params) - 1; i >= 0; i-- {
+			c.emitSet(exp.Params[i], exp)
+			c.emit(opPop, 0, exp)
+		}
+		c.compile(exp.Body)
+		c.emit(opPop, 0, exp)
+		c.emit(opJump, loop.start, exp)
+		c.patchJump(jumpEnd)
+		for _, at := range loop.breaks {
+			c.patchJump(at)
+		}
+		c.loops = c.loops[:len(c.loops)-1]
+		c.emit(opPop, 0, exp)
+		c.emit(opConst, c.constant(false), exp)
+
+	case tryExpr:
+		c.compileTry(exp)
+
+	case breakExpr, continueExpr:
+		// Leave the try blocks within the loop
+		n := 0
+		for n < len(c.tries) && c.tries[len(c.tries)-1-n].loops == len(c.loops) {
+			n++
+		}
+		c.exitTries(n, exp)
+		loop := c.loops[len(c.loops)-1]
+		depth := c.depth
+		if c.depth > loop.depth {
+			c.emit(opPopN, c.depth-loop.depth, exp)
+		}
+		if exp.Type == breakExpr {
+			loop.breaks = append(loop.breaks, c.emit(opJump, 0, exp))
+		} else {
+			c.emit(opJump, loop.start, exp)
+		}
+		// The jump never falls through, but the expression has a value like any other
+		c.depth = depth + 1
+
+	case interpExpr:
+		for _, part := range exp.Block {
+			c.compile(part)
+		}
+		c.emit(opInterp, len(exp.Block), exp)
+
+	case arrayExpr:
+		for _, element := range exp.Block {
+			c.compile(element)
+		}
+		c.emit(opArray, len(exp.Block), exp)
+
+	case tableExpr:
+		for _, pair := range exp.Block {
+			c.compile(pair.Left)
+			c.compile(pair.Right)
+		}
+		c.emit(opTable, len(exp.Block), exp)
+
+	case blockExpr:
+		if len(exp.Block) == 0 {
+			c.emit(opConst, c.constant(false), exp)
+			return
+		}
+		for i, ex := range exp.Block {
+			if i > 0 {
+				c.emit(opPop, 0, ex)
+			}
+			c.compile(ex)
+		}
+
+	case callExpr:
+		if exp.Func.Type == varExpr && exp.Func.Index != nil {
+			c.compile(exp.Func.Left)
+			c.emit(opDup, 0, exp.Func)
+			c.compile(exp.Func.Index)
+			c.emit(opGetIndex, 0, exp.Func)
+			for _, arg := range exp.Args {
+				c.compile(arg)
+			}
+			c.emit(opCallMethod, len(exp.Args), exp)
+			return
+		}
+		c.compile(exp.Func)
+		for _, arg := range exp.Args {
+			c.compile(arg)
+		}
+		c.emit(opCall, len(exp.Args), exp)
+
+	case returnExpr:
+		c.compile(exp.Right)
+		c.exitTries(len(c.tries), exp)
+		c.emit(opReturn, 0, exp)
+		c.depth++
+
+	case importExpr:
+		c.compile(exp.Left)
+		c.emit(opImport, 0, exp)
+		c.proto.newScope = true
+
+	default:
+		evalError(exp, "I don't know how to compile %v", exp.Type)
+	}
+}
+
+// Compiles a try expression. The handler of the try block continues at the catch block, or at a copy of the
+// finally block that raises the error again if there is no catch block. The handler of a catch block with
+// a finally block continues at the same copy.
+func (c *compiler) compileTry(exp *expression) {
+	c.proto.hasTry = true
+	depth := c.depth
+	handler := c.emit(opTry, 0, exp)
+	c.tries = append(c.tries, &tryState{finally: exp.Else, loops: len(c.loops)})
+	c.compile(exp.Body)
+	c.tries = c.tries[:len(c.tries)-1]
+	c.emit(opEndTry, 0, exp)
+	jumpDone := c.emit(opJump, 0, exp)
+
+	if exp.Then != nil {
+		c.patchJump(handler)
+		// The handler pushes the caught error
+		c.depth = depth + 1
+		c.emit(opCatch, 0, exp)
+		if len(exp.Params) > 0 {
+			c.emitSet(exp.Params[0], exp)
+		}
+		c.emit(opPop, 0, exp)
+		if exp.Else != nil {
+			handler = c.emit(opTry, 0, exp)
+			c.tries = append(c.tries, &tryState{finally: exp.Else, loops: len(c.loops)})
+		}
+		c.compile(exp.Then)
+		if exp.Else != nil {
+			c.tries = c.tries[:len(c.tries)-1]
+			c.emit(opEndTry, 0, exp)
+		}
+	}
+	c.patchJump(jumpDone)
+	if exp.Else == nil {
+		return
+	}
+
+	c.compile(exp.Else)
+	c.emit(opPop, 0, exp)
+	jumpEnd := c.emit(opJump, 0, exp)
+	c.patchJump(handler)
+	c.depth = depth + 1
+	c.compile(exp.Else)
+	c.emit(opPop, 0, exp)
+	c.emit(opRethrow, 0, exp)
+	c.patchJump(jumpEnd)
+	c.depth = depth + 1
+}
+
+// Removes the handlers of the n innermost try and catch blocks and runs their finally blocks, before a
+// break, continue or return jumps out of them.
+func (c *compiler) exitTries(n int, exp *expression) {
+	tries := c.tries
+	for i := len(tries) - 1; i >= len(tries)-n; i-- {
+		c.emit(opEndTry, 0, exp)
+		if tries[i].finally != nil {
+			// A jump within the finally block only leaves the blocks enclosing it
+			c.tries = tries[:i]
+			c.compile(tries[i].finally)
+			c.emit(opPop, 0, exp)
+		}
+	}
+	c.tries = tries
+}
@@ -0,0 +1,170 @@
+package runevm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var backends = []Backend{TreeWalker, Bytecode}
+
+func backendName(backend Backend) string {
+	if backend == Bytecode {
+		return "bytecode"
+	}
+	return "tree-walker"
+}
+
+func TestTimeout(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backendName(backend), func(t *testing.T) {
+			for _, source := range []string{"while true {}", "for i in range(1000000000000) {}", "f = fun() { f() + 0 }\nwhile true { try { f() } catch {} }"} {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				var out strings.Builder
+				start := time.Now()
+				err := newTestVM(backend, &out).RunContext(ctx, source, "test.rune")
+				cancel()
+				if !errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+					t.Errorf("%q: got %v, want ErrTimeout", source, err)
+				}
+				var runeErr *RuneError
+				if !errors.As(err, &runeErr) || runeErr.Line == 0 || runeErr.Message != ErrTimeout.Error() {
+					t.Errorf("%q: got %v, want a runtime error at the position of the interruption", source, err)
+				}
+				if elapsed := time.Since(start); elapsed > 2*time.Second {
+					t.Errorf("%q: stopped after %v", source, elapsed)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelInLoop(t *testing.T) {
+	source := `n = 0
+while true {
+    n += 1
+    tick(n)
+}`
+	for _, backend := range backends {
+		t.Run(backendName(backend), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var out strings.Builder
+			vm := newTestVM(backend, &out)
+			vm.SetFun("tick", func(args ...interface{}) interface{} {
+				if args[0] == 5 {
+					cancel()
+				}
+				return nil
+			})
+			err := vm.RunContext(ctx, source, "test.rune")
+			if !errors.Is(err, ErrCanceled) {
+				t.Fatalf("got %v, want ErrCanceled", err)
+			}
+			// The loop stops at the start of the next iteration
+			if n, _ := vm.GetInt("n"); n != 5 {
+				t.Errorf("the loop ran %d times, want 5", n)
+			}
+			if want := "runtime error (test.rune:2:1): execution canceled"; err.Error() != want {
+				t.Errorf("got error %q, want %q", err.Error(), want)
+			}
+
+			// The vm can run again with another context
+			if err := vm.RunContext(context.Background(), "n = 0", "test.rune"); err != nil {
+				t.Errorf("unexpected error after the cancellation: %v", err)
+			}
+		})
+	}
+}
+
+func TestCancellationCantBeCaught(t *testing.T) {
+	source := `try {
+    while true {}
+} catch e {
+    println("caught")
+} finally {
+    println("finally")
+}`
+	for _, backend := range backends {
+		t.Run(backendName(backend), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			var out strings.Builder
+			err := newTestVM(backend, &out).RunContext(ctx, source, "test.rune")
+			if !errors.Is(err, ErrTimeout) {
+				t.Errorf("got %v, want ErrTimeout", err)
+			}
+			if out.Len() > 0 {
+				t.Errorf("the script printed %q, want the catch and finally blocks to be skipped", out.String())
+			}
+		})
+	}
+}
+
+func TestWaitReturnsEarly(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backendName(backend), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				cancel()
+			}()
+			var out strings.Builder
+			start := time.Now()
+			err := newTestVM(backend, &out).RunContext(ctx, "println(\"before\")\nwait(60000)\nprintln(\"after\")", "test.rune")
+			if !errors.Is(err, ErrCanceled) {
+				t.Errorf("got %v, want ErrCanceled", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("wait returned after %v", elapsed)
+			}
+			if out.String() != "before\n" {
+				t.Errorf("got output %q, want only the line before wait", out.String())
+			}
+			if want := "runtime error (test.rune:2:5): execution canceled"; err == nil || err.Error() != want {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+
+			ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			err = newTestVM(backend, &out).RunContext(ctx, "wait(60000)", "test.rune")
+			if !errors.Is(err, ErrTimeout) {
+				t.Errorf("got %v, want ErrTimeout", err)
+			}
+		})
+	}
+}
+
+func TestContextDoneBeforeRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, backend := range backends {
+		var out strings.Builder
+		err := newTestVM(backend, &out).RunContext(ctx, "println(\"ran\")", "test.rune")
+		if !errors.Is(err, ErrCanceled) || out.Len() > 0 {
+			t.Errorf("%s: got %v and output %q, want ErrCanceled before the script runs", backendName(backend), err, out.String())
+		}
+	}
+}
+
+// The context only applies to the call it was passed to.
+func TestContextDoesntOutliveRun(t *testing.T) {
+	for _, backend := range backends {
+		ctx, cancel := context.WithCancel(context.Background())
+		var out strings.Builder
+		vm := newTestVM(backend, &out)
+		if err := vm.RunContext(ctx, "count = fun() { n = 0\nfor i in range(10) { n += 1 }\nn }", "test.rune"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cancel()
+		count, err := vm.GetFun("count")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(); n != 10 {
+			t.Errorf("%s: got %v, want the function to run after the context was canceled", backendName(backend), n)
+		}
+	}
+}
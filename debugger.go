@@ -0,0 +1,373 @@
+package runevm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How a paused script continues.
+type stepMode int
+
+const (
+	// Run until the next breakpoint
+	stepContinue stepMode = iota
+	// Pause at the next line, also within called functions
+	stepIn
+	// Pause at the next line of the current function
+	stepOver
+	// Pause once the current function returned
+	stepOut
+)
+
+// A source line within the Rune call stack.
+type debugLocation struct {
+	file  string
+	line  int
+	depth int
+}
+
+type breakpoint struct {
+	// File path as given by the user, a name without directory matches files of that name in any directory
+	file string
+	line int
+}
+
+// Debugger runs a script with the tree walker and pauses it at breakpoints or after each step. While the
+// script is paused, the debugger reads commands from its input, e.g. to inspect variables and the call
+// stack. Type help at the prompt to list the commands.
+type Debugger struct {
+	vm        *RuneVM
+	in        *bufio.Scanner
+	out       io.Writer
+	evaluator *Evaluator
+
+	breakpoints []breakpoint
+	mode        stepMode
+	// Location the script was resumed at. The debugger doesn't pause there again before the script
+	// moved on to another line of the same or an outer function.
+	start debugLocation
+	away  bool
+
+	// Lines of the files shown by list, by file path
+	sources map[string][]string
+	// Names defined before the script ran, e.g. the builtins, are left out when printing the global scope
+	predefined map[string]bool
+	// Set while the debugger evaluates the expression of a print command
+	evaluating bool
+}
+
+// Creates a debugger that runs scripts in the given vm and talks to the user via in and out.
+func NewDebugger(vm *RuneVM, in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{vm: vm, in: bufio.NewScanner(in), out: out, sources: make(map[string][]string)}
+}
+
+// Runs the program and pauses before its first line, so breakpoints can be set. The result is the same
+// as the one of RuneVM.Exec. If the user quits the debugger, the returned error is an *ExitError with code 0.
+func (d *Debugger) Run(prog *Program) (err error) {
+	if len(prog.errors) > 0 {
+		return prog.errors[0].runeError()
+	}
+	r := d.vm
+	r.filepath = prog.filepath
+	r.source = prog.source
+	d.sources[prog.filepath] = strings.Split(prog.source, "\n")
+	d.predefined = make(map[string]bool)
+	for name := range r.env.vars {
+		d.predefined[name] = true
+	}
+
+	defer recoverError(&err)
+
+	r.usage = &usage{limits: r.limits}
+	d.evaluator = newEvaluator(r.usage, &r.sandbox)
+	d.evaluator.debug = d
+	d.mode = stepIn
+	d.away = true
+	fmt.Fprintf(d.out, "Debugging %s, type help to list the commands\n", prog.filepath)
+	d.evaluator.evaluate(prog.ast, r.env)
+	return nil
+}
+
+// Pauses the script if the expression starts a line the user wants to stop at.
+func (d *Debugger) OnExpression(exp *expression, env *Environment) {
+	// Blocks don't start a line of their own, their statements do
+	if d.evaluating || exp.Line == 0 || exp.Type == blockExpr {
+		return
+	}
+	loc := debugLocation{file: exp.File, line: exp.Line, depth: len(d.evaluator.callStack)}
+	if loc.depth <= d.start.depth && (loc.file != d.start.file || loc.line != d.start.line) {
+		d.away = true
+	}
+	if !d.away && loc == d.start {
+		return
+	}
+	pause := false
+	switch d.mode {
+	case stepIn:
+		pause = true
+	case stepOver:
+		pause = loc.depth <= d.start.depth
+	case stepOut:
+		pause = loc.depth < d.start.depth
+	}
+	if pause || d.hasBreakpoint(loc) {
+		d.pause(loc, exp, env)
+	}
+}
+
+func (d *Debugger) hasBreakpoint(loc debugLocation) bool {
+	for _, bp := range d.breakpoints {
+		if bp.line == loc.line && matchesFile(bp.file, loc.file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the file path given by the user refers to the file.
+func matchesFile(given string, file string) bool {
+	if filepath.Clean(given) == filepath.Clean(file) {
+		return true
+	}
+	return !strings.ContainsAny(given, `/\`) && filepath.Base(file) == given
+}
+
+// Shows the location and reads commands until one of them resumes the script.
+func (d *Debugger) pause(loc debugLocation, exp *expression, env *Environment) {
+	d.printLine(loc.file, loc.line)
+	for {
+		fmt.Fprint(d.out, "(debug) ")
+		if !d.in.Scan() {
+			// Without input the script runs to the end
+			fmt.Fprintln(d.out)
+			d.breakpoints = nil
+			d.resume(stepContinue, loc)
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimSpace(d.in.Text()), " ")
+		arg = strings.TrimSpace(arg)
+		switch command {
+		case "s", "step":
+			d.resume(stepIn, loc)
+			return
+		case "n", "next":
+			d.resume(stepOver, loc)
+			return
+		case "o", "out":
+			d.resume(stepOut, loc)
+			return
+		case "c", "continue":
+			d.resume(stepContinue, loc)
+			return
+		case "b", "break":
+			d.setBreakpoint(arg, loc)
+		case "d", "delete":
+			d.deleteBreakpoint(arg, loc)
+		case "bt", "stack":
+			d.printStack(exp)
+		case "env":
+			d.printEnv(env)
+		case "p", "print":
+			d.print(arg, env)
+		case "l", "list":
+			d.list(loc)
+		case "q", "quit":
+			panic(&ExitError{Code: 0})
+		case "h", "help":
+			d.printHelp()
+		case "":
+		default:
+			fmt.Fprintf(d.out, "Unknown command '%s', type help to list the commands\n", command)
+		}
+	}
+}
+
+func (d *Debugger) resume(mode stepMode, loc debugLocation) {
+	d.mode = mode
+	d.start = loc
+	d.away = false
+}
+
+func (d *Debugger) printHelp() {
+	fmt.Fprintln(d.out, `Commands:
+  s, step                 run to the next line, stepping into called functions
+  n, next                 run to the next line of the current function
+  o, out                  run until the current function returned
+  c, continue             run to the next breakpoint
+  b, break [file:]line    set a breakpoint, without argument list the breakpoints
+  d, delete [file:]line   remove a breakpoint, without argument remove all of them
+  bt, stack               print the call stack
+  env                     print the variables of the current scope and the scopes enclosing it
+  p, print <expr>         evaluate an expression in the current scope and print its value
+  l, list                 show the source around the current line
+  q, quit                 abort the script`)
+}
+
+// Parses "line" or "file:line". Without a file, the line refers to the file the script is paused in.
+func parseBreakpoint(arg string, loc debugLocation) (breakpoint, bool) {
+	file := loc.file
+	lineStr := arg
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		file, lineStr = arg[:i], arg[i+1:]
+	}
+	line, err := strconv.Atoi(lineStr)
+	if err != nil || line < 1 || file == "" {
+		return breakpoint{}, false
+	}
+	return breakpoint{file: file, line: line}, true
+}
+
+func (d *Debugger) setBreakpoint(arg string, loc debugLocation) {
+	if arg == "" {
+		if len(d.breakpoints) == 0 {
+			fmt.Fprintln(d.out, "No breakpoints")
+		}
+		for _, bp := range d.breakpoints {
+			fmt.Fprintf(d.out, "%s:%d\n", bp.file, bp.line)
+		}
+		return
+	}
+	bp, ok := parseBreakpoint(arg, loc)
+	if !ok {
+		fmt.Fprintf(d.out, "Invalid breakpoint '%s', expecting a line or file:line\n", arg)
+		return
+	}
+	d.breakpoints = append(d.breakpoints, bp)
+	fmt.Fprintf(d.out, "Breakpoint set at %s:%d\n", bp.file, bp.line)
+}
+
+func (d *Debugger) deleteBreakpoint(arg string, loc debugLocation) {
+	if arg == "" {
+		d.breakpoints = nil
+		fmt.Fprintln(d.out, "All breakpoints deleted")
+		return
+	}
+	bp, ok := parseBreakpoint(arg, loc)
+	if !ok {
+		fmt.Fprintf(d.out, "Invalid breakpoint '%s', expecting a line or file:line\n", arg)
+		return
+	}
+	for i, other := range d.breakpoints {
+		if other == bp {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			fmt.Fprintf(d.out, "Breakpoint deleted at %s:%d\n", bp.file, bp.line)
+			return
+		}
+	}
+	fmt.Fprintf(d.out, "No breakpoint at %s:%d\n", bp.file, bp.line)
+}
+
+// Prints the Rune call stack, most recent call first, like a traceback in reverse.
+func (d *Debugger) printStack(exp *expression) {
+	calls := d.evaluator.callStack
+	function := "<script>"
+	if len(calls) > 0 {
+		function = calleeName(calls[len(calls)-1].Func)
+	}
+	fmt.Fprintf(d.out, "#0  %s:%d:%d in %s\n", exp.File, exp.Line, exp.Col, function)
+	for i := len(calls) - 1; i >= 0; i-- {
+		function = "<script>"
+		if i > 0 {
+			function = calleeName(calls[i-1].Func)
+		}
+		fmt.Fprintf(d.out, "#%d  %s:%d:%d in %s\n", len(calls)-i, calls[i].File, calls[i].Line, calls[i].Col, function)
+	}
+}
+
+// Prints the variables of the environment chain, innermost scope first.
+func (d *Debugger) printEnv(env *Environment) {
+	for scope, level := env, 0; scope != nil; scope, level = scope.parent, level+1 {
+		var names []string
+		for name := range scope.vars {
+			if scope.parent != nil || !d.predefined[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		switch {
+		case scope.parent == nil:
+			fmt.Fprintln(d.out, "Global scope:")
+		case level == 0:
+			fmt.Fprintln(d.out, "Local scope:")
+		default:
+			fmt.Fprintf(d.out, "Enclosing scope %d:\n", level)
+		}
+		if len(names) == 0 {
+			fmt.Fprintln(d.out, "  (empty)")
+		}
+		for _, name := range names {
+			fmt.Fprintf(d.out, "  %s = %s\n", name, displayValue(scope.vars[name]))
+		}
+	}
+}
+
+// Evaluates the expression in the environment of the paused script and prints its value.
+func (d *Debugger) print(source string, env *Environment) {
+	if source == "" {
+		fmt.Fprintln(d.out, "Expecting an expression to print")
+		return
+	}
+	prog, err := Compile(source, "<debug>")
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	d.evaluating = true
+	defer func() { d.evaluating = false }()
+	value, err := d.evaluate(prog.ast, env)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	fmt.Fprintln(d.out, displayValue(value))
+}
+
+func (d *Debugger) evaluate(exp *expression, env *Environment) (value interface{}, err error) {
+	defer recoverError(&err)
+	return d.evaluator.evaluate(exp, env), nil
+}
+
+// Shows the lines around the current one. The current line is marked with "->", breakpoints with "*".
+func (d *Debugger) list(loc debugLocation) {
+	lines := d.sourceLines(loc.file)
+	for line := loc.line - 3; line <= loc.line+3; line++ {
+		if line < 1 || line > len(lines) {
+			continue
+		}
+		marker := "  "
+		if line == loc.line {
+			marker = "->"
+		} else if d.hasBreakpoint(debugLocation{file: loc.file, line: line}) {
+			marker = "* "
+		}
+		fmt.Fprintf(d.out, "%s %4d  %s\n", marker, line, lines[line-1])
+	}
+}
+
+func (d *Debugger) printLine(file string, line int) {
+	text := ""
+	if lines := d.sourceLines(file); line <= len(lines) {
+		text = strings.TrimSpace(lines[line-1])
+	}
+	fmt.Fprintf(d.out, "%s:%d  %s\n", file, line, text)
+}
+
+// Returns the lines of a source file. Imported files are read on first use.
+func (d *Debugger) sourceLines(file string) []string {
+	if lines, ok := d.sources[file]; ok {
+		return lines
+	}
+	source, err := os.ReadFile(file)
+	if err != nil {
+		d.sources[file] = nil
+		return nil
+	}
+	d.sources[file] = strings.Split(string(source), "\n")
+	return d.sources[file]
+}
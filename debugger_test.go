@@ -0,0 +1,81 @@
+package runevm
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const debugSource = `add = fun(a, b) {
+    sum = a + b
+    return = sum
+}
+x = add(1, 2)
+y = add(x, 3)
+println(y)`
+
+// Lines the debugger shows when it pauses, e.g. "test.rune:3  return = sum"
+var debugStop = regexp.MustCompile(`(?m)test\.rune:(\d+)  `)
+
+// Runs the script in the debugger with the given commands, one per line, and returns the lines it
+// paused at and everything it wrote.
+func debugScript(t *testing.T, source string, commands string) ([]int, string) {
+	t.Helper()
+	prog, errs := Parse(source, "test.rune")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected syntax errors: %v", errs)
+	}
+	var out, scriptOut strings.Builder
+	debugger := NewDebugger(newTestVM(TreeWalker, &scriptOut), strings.NewReader(commands), &out)
+	if err := debugger.Run(prog); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var stops []int
+	for _, match := range debugStop.FindAllStringSubmatch(out.String(), -1) {
+		line, _ := strconv.Atoi(match[1])
+		stops = append(stops, line)
+	}
+	return stops, out.String()
+}
+
+func TestDebuggerStops(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands string
+		want     []int
+	}{
+		{"step into calls", "s\ns\ns\ns\ns\ns\ns\n", []int{1, 5, 2, 3, 6, 2, 3, 7}},
+		{"step over calls", "n\nn\nn\nn\n", []int{1, 5, 6, 7}},
+		{"step out of a call", "s\ns\no\no\n", []int{1, 5, 2, 6}},
+		{"step out of the script", "o\n", []int{1}},
+		{"breakpoint in a function", "b 3\nc\nc\nc\n", []int{1, 3, 3}},
+		{"breakpoint with file", "b test.rune:6\nc\nn\n", []int{1, 6, 7}},
+		{"deleted breakpoint", "b 3\nb 6\nd 3\nc\nc\n", []int{1, 6}},
+		{"next stops at breakpoints in calls", "b 2\nn\nn\nn\n", []int{1, 5, 2, 3}},
+		{"continue without breakpoints", "c\n", []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stops, out := debugScript(t, debugSource, tt.commands)
+			if !slices.Equal(stops, tt.want) {
+				t.Errorf("paused at lines %v, want %v\noutput:\n%s", stops, tt.want, out)
+			}
+		})
+	}
+}
+
+func TestDebuggerInspects(t *testing.T) {
+	_, out := debugScript(t, debugSource, "b 3\nc\np sum * 2\nbt\nenv\n")
+	for _, want := range []string{
+		"Breakpoint set at test.rune:3\n",
+		"(debug) 6\n",
+		"#0  test.rune:3:5 in add\n#1  test.rune:5:8 in <script>\n",
+		"Local scope:\n  a = 1\n  b = 2\n  sum = 3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
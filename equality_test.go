@@ -0,0 +1,59 @@
+package runevm
+
+import "testing"
+
+func TestEquality(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"1 == 1.0", true},
+		{`1 == "1"`, false},
+		{`"abc" == "abc"`, true},
+		{"nil == nil", true},
+		{"nil == false", false},
+		{"array{} == array{}", true},
+		{"array{1, 2} == array{1, 2}", true},
+		{"array{1, 2} == array{2, 1}", false},
+		{"array{1, 2} == array{1, 2, 3}", false},
+		{`array{array{1, "a"}, nil} == array{array{1.0, "a"}, nil}`, true},
+		{"array{} == table{}", false},
+		{"table{} == table{}", false},
+		{"print == print", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			out, err := runBoth(t, "println("+tt.expr+")")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := "false\n"
+			if tt.want {
+				want = "true\n"
+			}
+			if out != want {
+				t.Errorf("got %q, want %q", out, want)
+			}
+		})
+	}
+}
+
+func TestEqualityOfSharedValues(t *testing.T) {
+	source := `a = array{1, 2}
+b = a
+t = table{"a": a}
+u = t
+println(a == b, " ", a == new(a), " ", t == u, " ", t == new(t))
+c = array{0}
+c[0] = c
+d = array{0}
+d[0] = d
+println(c == c, " ", c == d)`
+	out, err := runBoth(t, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "true true true false\ntrue true\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,246 @@
+package runevm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind describes in which phase a RuneError was raised.
+type ErrorKind int
+
+const (
+	// The source contains a character or literal the lexer can't tokenize
+	LexError ErrorKind = iota
+	// The token stream doesn't form a valid program
+	ParseError
+	// Evaluating the program failed
+	RuntimeError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case LexError:
+		return "lex error"
+	case ParseError:
+		return "parse error"
+	case RuntimeError:
+		return "runtime error"
+	default:
+		return "error"
+	}
+}
+
+var (
+	// The context passed to RunContext or ExecContext was canceled
+	ErrCanceled = errors.New("execution canceled")
+	// The deadline of the context passed to RunContext or ExecContext was exceeded
+	ErrTimeout = errors.New("execution timed out")
+)
+
+// StackFrame is a single entry of the Rune call stack, pointing to the call site of a function.
+type StackFrame struct {
+	// Name the function was called by, e.g. "greet" or "person.greet", or "<anonymous>"
+	Function string
+	File     string
+	Line     int
+	Col      int
+}
+
+// RuneError is the error returned by the vm when a script fails to lex, parse or run.
+type RuneError struct {
+	Kind    ErrorKind
+	File    string
+	Line    int
+	Col     int
+	Message string
+	// Rune call stack at the time of the error, outermost call first. Only set for runtime errors.
+	Stack []StackFrame
+	// Underlying cause, e.g. ErrTimeout or an error returned by a Go function. May be nil.
+	Err error
+	// Number of characters of the token a lex or parse error was raised at
+	length int
+}
+
+func (e *RuneError) Error() string {
+	var msg string
+	if e.File == "" && e.Line == 0 {
+		msg = fmt.Sprintf("%s: %s", e.Kind, e.Message)
+	} else {
+		msg = fmt.Sprintf("%s (%s:%d:%d): %s", e.Kind, e.File, e.Line, e.Col, e.Message)
+	}
+	if len(e.Stack) == 0 {
+		return msg
+	}
+	return msg + "\n" + e.Traceback()
+}
+
+// Returns the Rune call stack of a runtime error formatted like:
+//
+//	Traceback (most recent call last):
+//	  main.rune:12:1 in <script>
+//	  main.rune:8:5 in outer
+//	  main.rune:3:9 in inner
+//
+// Each line shows the position within a function, the first one the position within the top level of
+// the script and the last one the position of the error. Consecutive identical lines, e.g. of a
+// recursion, are shown once followed by the number of repetitions, and of very deep call stacks only
+// the outermost and the most recent lines are shown. Returns "" if the error has no call stack.
+func (e *RuneError) Traceback() string {
+	if len(e.Stack) == 0 {
+		return ""
+	}
+	var lines []string
+	function := "<script>"
+	for _, frame := range e.Stack {
+		lines = append(lines, fmt.Sprintf("  %s:%d:%d in %s", frame.File, frame.Line, frame.Col, function))
+		function = frame.Function
+	}
+	lines = append(lines, fmt.Sprintf("  %s:%d:%d in %s", e.File, e.Line, e.Col, function))
+
+	var collapsed []string
+	for i := 0; i < len(lines); {
+		n := 1
+		for i+n < len(lines) && lines[i+n] == lines[i] {
+			n++
+		}
+		collapsed = append(collapsed, lines[i])
+		if n == 2 {
+			collapsed = append(collapsed, lines[i])
+		} else if n > 2 {
+			collapsed = append(collapsed, fmt.Sprintf("  ... repeated %d more times", n-1))
+		}
+		i += n
+	}
+	if len(collapsed) > maxTracebackLines {
+		// Keep a third of the lines from the start and the rest from the end
+		head := maxTracebackLines / 3
+		tail := maxTracebackLines - head
+		shown := append([]string{}, collapsed[:head]...)
+		shown = append(shown, fmt.Sprintf("  ... %d more lines", len(collapsed)-head-tail))
+		collapsed = append(shown, collapsed[len(collapsed)-tail:]...)
+	}
+	return "Traceback (most recent call last):\n" + strings.Join(collapsed, "\n")
+}
+
+// Number of lines a traceback shows at most, not counting the lines that tell how many were left out
+const maxTracebackLines = 30
+
+// SyntaxError is a lex or parse error reported by Parse. The error spans Length characters from Line and Col.
+type SyntaxError struct {
+	Kind    ErrorKind
+	File    string
+	Line    int
+	Col     int
+	Length  int
+	Message string
+}
+
+func (e SyntaxError) Error() string {
+	return e.runeError().Error()
+}
+
+// Returns the error the way Compile and Run report it.
+func (e SyntaxError) runeError() *RuneError {
+	return &RuneError{Kind: e.Kind, File: e.File, Line: e.Line, Col: e.Col, Message: e.Message, length: e.Length}
+}
+
+// ExitError is returned by Run and Exec when the script called exit. Code is the exit code passed
+// to exit, or 0 if none was given.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ThrownError is the cause of the RuneError raised by the throw builtin. Value is the thrown value.
+type ThrownError struct {
+	Value interface{}
+}
+
+func (e *ThrownError) Error() string {
+	// Rethrowing a caught error keeps its message
+	if t, ok := e.Value.(*Table); ok {
+		if msg, ok := t.Get("message"); ok {
+			if s, ok := msg.(string); ok {
+				return s
+			}
+		}
+	}
+	return formatValue(e.Value)
+}
+
+// Returns the underlying cause so errors.Is and errors.As can look through a RuneError.
+func (e *RuneError) Unwrap() error {
+	return e.Err
+}
+
+// Maps the error of a done context to ErrCanceled or ErrTimeout.
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrCanceled
+}
+
+// Raises an error at the position of the given token. The error unwinds the lexer, parser or evaluator
+// and is turned into a returned error by RuneVM.Run.
+func raiseError(kind ErrorKind, tok *Token, msg string) {
+	err := &RuneError{Kind: kind, Message: msg}
+	if tok != nil {
+		err.File = tok.File
+		err.Line = tok.Line
+		err.Col = tok.Col
+		err.length = tok.Length
+	}
+	panic(err)
+}
+
+// Returns the error if a try block may catch it. Only runtime errors can be caught. Canceled executions
+// can't be caught, so scripts can't escape them, and exit always ends the script. Exhausted limits can be
+// caught, but a budget that is used up stays so: after MaxSteps the first step of the catch block fails again.
+func catchable(rec interface{}) (*RuneError, bool) {
+	err, ok := rec.(*RuneError)
+	if !ok || err.Kind != RuntimeError {
+		return nil, false
+	}
+	if errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+		return nil, false
+	}
+	return err, true
+}
+
+// Returns the table a catch block receives for a caught error. Value holds the value passed to throw,
+// or the message for any other error.
+func errorTable(err *RuneError) *Table {
+	t := NewTable()
+	t.Set("message", err.Message)
+	t.Set("file", err.File)
+	t.Set("line", err.Line)
+	t.Set("col", err.Col)
+	var thrown *ThrownError
+	if errors.As(err, &thrown) {
+		t.Set("value", thrown.Value)
+	} else {
+		t.Set("value", err.Message)
+	}
+	return t
+}
+
+// Recovers a RuneError raised by raiseError or evalError, or the ExitError raised by exit, and stores it in err.
+// Any other panic is a bug in the vm and is propagated.
+func recoverError(err *error) {
+	if rec := recover(); rec != nil {
+		switch e := rec.(type) {
+		case *RuneError:
+			*err = e
+		case *ExitError:
+			*err = e
+		default:
+			panic(rec)
+		}
+	}
+}
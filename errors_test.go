@@ -0,0 +1,89 @@
+package runevm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTraceback(t *testing.T) {
+	source := `f = fun(n) {
+    if n == 0 then throw("bottom")
+    f(n - 1)
+}
+g = fun() { f(5) }
+g()`
+	_, err := runBoth(t, source)
+	var runeErr *RuneError
+	if !errors.As(err, &runeErr) {
+		t.Fatalf("got %v, want a RuneError", err)
+	}
+	want := `Traceback (most recent call last):
+  test.rune:6:2 in <script>
+  test.rune:5:14 in g
+  test.rune:3:6 in f
+  ... repeated 4 more times
+  test.rune:2:25 in f`
+	if got := runeErr.Traceback(); got != want {
+		t.Errorf("got traceback\n%s\nwant\n%s", got, want)
+	}
+	if len(runeErr.Stack) != 7 {
+		t.Errorf("got %d stack frames, want all 7 of them", len(runeErr.Stack))
+	}
+}
+
+func TestTracebackTwoIdenticalLines(t *testing.T) {
+	_, err := runBoth(t, "f = fun(n) {\n    if n == 0 then throw(\"bottom\")\n    f(n - 1)\n}\nf(2)")
+	want := `Traceback (most recent call last):
+  test.rune:5:2 in <script>
+  test.rune:3:6 in f
+  test.rune:3:6 in f
+  test.rune:2:25 in f`
+	var runeErr *RuneError
+	if !errors.As(err, &runeErr) || runeErr.Traceback() != want {
+		t.Errorf("got %v, want traceback\n%s", err, want)
+	}
+}
+
+func TestTracebackOfDeepRecursion(t *testing.T) {
+	for _, source := range []string{
+		"f = fun(n) {\n    f(n + 1)\n}\nf(0)",
+		// Mutual recursion doesn't repeat single lines, so the traceback is cut
+		"f = fun(n) { g(n) }\ng = fun(n) { f(n) }\nf(0)",
+	} {
+		for _, backend := range []Backend{TreeWalker, Bytecode} {
+			_, err := runScript(backend, source)
+			var runeErr *RuneError
+			if !errors.As(err, &runeErr) || !strings.Contains(runeErr.Message, "Maximum recursion depth exceeded") {
+				t.Fatalf("got %v, want a recursion error", err)
+			}
+			traceback := runeErr.Traceback()
+			if lines := strings.Count(traceback, "\n"); lines > maxTracebackLines+2 {
+				t.Errorf("traceback has %d lines, want at most %d:\n%s", lines, maxTracebackLines+2, traceback)
+			}
+			if !strings.Contains(traceback, "more times") && !strings.Contains(traceback, "more lines") {
+				t.Errorf("traceback doesn't tell how many lines were left out:\n%s", traceback)
+			}
+		}
+	}
+}
+
+// The recursion limit counts calls, not nested expressions, so both backends stop at the same call.
+func TestRecursionLimitCountsCalls(t *testing.T) {
+	_, err := runBoth(t, "f = fun(n) { f(n + 1) }\nf(0)")
+	var runeErr *RuneError
+	if !errors.As(err, &runeErr) || runeErr.Line != 1 || runeErr.Col != 15 || len(runeErr.Stack) != MaxRecursionDepth+1 {
+		t.Errorf("got %v, want a recursion error at 1:15 after %d calls", err, MaxRecursionDepth)
+	}
+
+	// Expressions nested deeper than the limit don't count as recursion
+	source := "x = " + strings.Repeat("(1 + ", MaxRecursionDepth+100) + "1" + strings.Repeat(")", MaxRecursionDepth+100) + "\nprintln(x)"
+	if out, err := runBoth(t, source); err != nil || out != fmt.Sprintf("%d\n", MaxRecursionDepth+101) {
+		t.Errorf("got %q and %v, want the sum", out, err)
+	}
+	out, err := runBoth(t, "f = fun(n) { if n == 0 then return = 0\n1 + f(n - 1) }\nprintln(f(2000))")
+	if err != nil || out != "2000\n" {
+		t.Errorf("got %q and %v, want 2000 nested calls to work", out, err)
+	}
+}
@@ -1,26 +1,71 @@
 package runevm
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math"
 	"os"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
+// Maximum depth of nested function calls on both backends
 const MaxRecursionDepth = 3000
 
 type Evaluator struct {
 	// Keep track of file path that have been imported by the import statement.
-	importedPaths  map[string]bool
-	recursionDepth int
+	importedPaths map[string]bool
+	// Call expressions of the functions that are currently being executed
+	callStack []*expression
+	// Value stack of the bytecode machine, holding the locals and operands of all active frames
+	stack []interface{}
+	// Context of the current execution, checked on every loop iteration and function call
+	ctx  context.Context
+	done <-chan struct{}
+	// Resource budgets of the current execution, shared with the builtins of the vm
+	usage *usage
+	// Decides whether and from where files can be imported
+	sandbox *sandbox
+	// Notified before each expression is evaluated while a debugger is attached
+	debug debugHook
 }
 
-func newEvaluator() *Evaluator {
-	e := &Evaluator{importedPaths: make(map[string]bool), recursionDepth: 0}
+// A debug hook is notified by the tree walker before each expression is evaluated, with the environment
+// the expression is evaluated in.
+type debugHook interface {
+	OnExpression(exp *expression, env *Environment)
+}
+
+func newEvaluator(usage *usage, sandbox *sandbox) *Evaluator {
+	e := &Evaluator{importedPaths: make(map[string]bool), usage: usage, sandbox: sandbox}
 	return e
 }
 
+// Sets the context that can cancel the execution. A nil context disables cancellation.
+func (e *Evaluator) setContext(ctx context.Context) {
+	e.ctx = ctx
+	e.done = nil
+	if ctx != nil {
+		e.done = ctx.Done()
+	}
+}
+
+// Aborts the execution with ErrCanceled or ErrTimeout if the context is done.
+func (e *Evaluator) checkContext(exp *expression) {
+	if e.done == nil {
+		return
+	}
+	select {
+	case <-e.done:
+		cause := contextError(e.ctx.Err())
+		err := newEvalError(exp, "%v", cause)
+		err.Err = cause
+		panic(err)
+	default:
+	}
+}
+
 type ReturnValue struct {
 	Value interface{}
 }
@@ -39,220 +84,183 @@ func (e *Evaluator) evaluate(exp *expression, env *Environment) interface{} {
 		return nil
 	}
 
-	e.recursionDepth++
-	defer func() { e.recursionDepth-- }()
+	if e.usage.limits.MaxSteps > 0 {
+		e.step(exp)
+	}
 
-	if e.recursionDepth > MaxRecursionDepth {
-		evalError(exp, "Maximum recursion depth exceeded")
+	if e.debug != nil {
+		e.debug.OnExpression(exp, env)
 	}
 
 	switch exp.Type {
 	case numExpr:
-		return parseNumber(exp.Value.(string), exp)
+		return exp.Value
 
 	case strExpr, boolExpr:
 		return exp.Value
 
+	case nilExpr:
+		return nil
+
 	case varExpr:
-		value := env.get(exp.Value.(string), exp)
 		if exp.Index != nil {
-			switch v := value.(type) {
-			case []interface{}:
-				index := e.evaluate(exp.Index, env).(int)
-				if index < 0 || index >= len(v) {
-					evalError(exp, "Index '%d' out of bounds for array '%v[%d]'", index, exp.Value, len(v))
-				}
-				return v[index]
-			case map[string]interface{}:
-				key := e.evaluate(exp.Index, env).(string)
-				val, ok := v[key]
-				if !ok {
-					evalError(exp, "Key '%s' not found in table '%v'", key, exp.Value)
-				}
-				return val
-			default:
-				evalError(exp, "Variable %v is not an array or table", exp.Value)
-			}
+			container := e.evaluate(exp.Left, env)
+			return indexValue(container, e.evaluate(exp.Index, env), exp)
 		}
-
-		return value
+		return env.get(exp.Value.(string), exp)
 
 	case assignExpr:
-		if exp.Left.Type == varExpr && exp.Left.Index != nil {
-			arrayOrTable := e.evaluate(exp.Left.Left, env)
-			if arrayOrTable == nil {
-				evalError(exp, "Cannot assign to an index on a null expression")
-				return nil
-			}
+		if exp.Left.Index != nil {
+			container := e.evaluate(exp.Left.Left, env)
 			index := e.evaluate(exp.Left.Index, env)
-			value := e.evaluate(exp.Right, env)
-
-			switch arr := arrayOrTable.(type) {
-			case []interface{}:
-				idx, ok := index.(int)
-				if !ok {
-					evalError(exp, "Array index must be an integer")
-					return nil
-				}
-				if idx < 0 || idx >= len(arr) {
-					evalError(exp, "Array index out of bounds")
-					return nil
-				}
-				arr[idx] = value
-				return value
-			case map[string]interface{}:
-				key, ok := index.(string)
-				if !ok {
-					evalError(exp, "Table key must be a string")
-					return nil
-				}
-				arr[key] = value
-				return value
-			default:
-				evalError(exp, "Cannot index into type %T", arrayOrTable)
-				return nil
+			if exp.Operator != "=" {
+				old := indexValue(container, index, exp.Left)
+				return e.setIndexValue(container, index, e.applyBinaryOp(compoundOperator(exp), old, e.evaluate(exp.Right, env), exp), exp)
 			}
-		} else if exp.Left.Type == varExpr && exp.Left.Value != nil {
-			if exp.Left.Left != nil {
-				// Handle field assignment
-				obj := e.evaluate(exp.Left.Left, env)
-				field := exp.Left.Value.(string)
-				value := e.evaluate(exp.Right, env)
-				if m, ok := obj.(map[string]interface{}); ok {
-					m[field] = value
-					return value
-				} else {
-					evalError(exp, "Cannot assign to field %v on non-table object", field)
-					return nil
-				}
-			}
-			// Handle variable assignment
-			return env.set(exp.Left.Value.(string), e.evaluate(exp.Right, env))
+			return e.setIndexValue(container, index, e.evaluate(exp.Right, env), exp)
 		}
-
-		if exp.Left.Type != varExpr {
-			evalError(exp, "Cannot assign to %v", exp.Left)
+		name := exp.Left.Value.(string)
+		if exp.Operator != "=" {
+			old := env.get(name, exp.Left)
+			return env.set(name, e.applyBinaryOp(compoundOperator(exp), old, e.evaluate(exp.Right, env), exp))
 		}
-		return env.set(exp.Left.Value.(string), e.evaluate(exp.Right, env))
+		return env.set(name, e.evaluate(exp.Right, env))
 
 	case binaryExpr:
 		a := e.evaluate(exp.Left, env)
-		b := e.evaluate(exp.Right, env)
-		if a_, ok := a.(ReturnValue); ok {
-			a = a_.Value
+		if isJump(a) {
+			return a
 		}
-		if b_, ok := b.(ReturnValue); ok {
-			b = b_.Value
+		// ?? only evaluates its right operand if the left one is nil
+		if exp.Operator == "??" {
+			if a != nil {
+				return a
+			}
+			return e.evaluate(exp.Right, env)
+		}
+		b := e.evaluate(exp.Right, env)
+		if isJump(b) {
+			return b
 		}
-		result := applyBinaryOp(exp.Operator, a, b, exp)
+		result := e.applyBinaryOp(exp.Operator, a, b, exp)
 		return result
 
 	case unaryExpr:
-		return applyUnaryOp(exp.Operator,
-			e.evaluate(exp.Right, env), exp)
+		a := e.evaluate(exp.Right, env)
+		if isJump(a) {
+			return a
+		}
+		return applyUnaryOp(exp.Operator, a, exp)
 
 	case funExpr:
-		return e.makeFun(env, exp)
+		fn := e.makeFun(env, exp)
+		e.alloc(fn, exp)
+		return fn
 
 	case ifExpr:
-		cond := e.evaluate(exp.Cond, env)
-		if cond != false {
+		if isTruthy(e.evaluate(exp.Cond, env)) {
 			return e.evaluate(exp.Then, env)
 		}
+		// elif branches are nested if expressions in the else branch
 		if exp.Else != nil {
-			if exp.Else.Type == blockExpr {
-				for _, elif := range exp.Else.Block {
-					if elif.Type == ifExpr {
-						elifCond := e.evaluate(elif.Cond, env)
-						if elifCond != false {
-							return e.evaluate(elif.Then, env)
-						}
-					} else {
-						return e.evaluate(elif, env)
-					}
-				}
-			} else {
-				return e.evaluate(exp.Else, env)
-			}
+			return e.evaluate(exp.Else, env)
 		}
 		return false
 
 	case whileExpr:
+		for isTruthy(e.evaluate(exp.Cond, env)) {
+			e.checkContext(exp)
+			switch result := e.evaluate(exp.Body, env).(type) {
+			case BreakValue:
+				return false
+			case ReturnValue:
+				return result
+			}
+		}
+		return false
+
+	case forExpr:
+		it := newIterator(e.evaluate(exp.Right, env), len(exp.Params), exp)
 		for {
-			cond := e.evaluate(exp.Cond, env)
-			if !cond.(bool) {
+			values, ok := it.next()
+			if !ok {
 				break
 			}
-			shouldContinue := false
-			for _, exp := range exp.Body.Block {
-				result := e.evaluate(exp, env)
-				if _, ok := result.(BreakValue); ok {
-					return false
-				} else if _, ok := result.(ContinueValue); ok {
-					shouldContinue = true
-					break
-				}
+			e.checkContext(exp)
+			for i, name := range exp.Params {
+				env.set(name, values[i])
 			}
-			if shouldContinue {
-				shouldContinue = false
-				continue
+			switch result := e.evaluate(exp.Body, env).(type) {
+			case BreakValue:
+				return false
+			case ReturnValue:
+				return result
 			}
 		}
 		return false
 
+	case tryExpr:
+		return e.evalTry(exp, env)
+
+	case interpExpr:
+		parts := make([]interface{}, len(exp.Block))
+		for i, part := range exp.Block {
+			parts[i] = e.evaluate(part, env)
+			if isJump(parts[i]) {
+				return parts[i]
+			}
+		}
+		return e.interpolate(parts, exp)
+
 	case arrayExpr:
 		var arr []interface{}
 		for _, element := range exp.Block {
 			arr = append(arr, e.evaluate(element, env))
 		}
+		e.alloc(arr, exp)
 		return arr
 
 	case tableExpr:
-		m := make(map[string]interface{})
+		t := NewTable()
 		for _, pair := range exp.Block {
 			key := e.evaluate(pair.Left, env)
 			value := e.evaluate(pair.Right, env)
-			m[fmt.Sprint(key)] = value
+			t.Set(formatValue(key), value)
 		}
-		return m
+		e.alloc(t, exp)
+		return t
 
 	case blockExpr:
 		var val interface{} = false
 		for _, ex := range exp.Block {
-			result := e.evaluate(ex, env)
-			if ret, ok := result.(ReturnValue); ok {
-				return ret.Value
+			val = e.evaluate(ex, env)
+			if isJump(val) {
+				// Skip the rest of the block, the enclosing loop or function handles the jump
+				return val
 			}
-			val = result
 		}
 		return val
 
 	case callExpr:
-		fn, ok := e.evaluate(exp.Func, env).(func(args ...interface{}) interface{})
-		if !ok {
-			evalError(exp, "'%s' is not a function", exp.Func.Value)
-		}
-
+		var fn interface{}
 		var args []interface{}
 
-		// Check if caller is a go-map/rune-table ...
-		callerName := exp.Func.Value
-		caller, ok := env.get(callerName.(string), exp).(map[string]interface{})
-		// if so:
-		if ok {
-			// inject its reference as the first argument (similar to pythons 'self' argument on methods)
-			args = append(args, caller)
+		if exp.Func.Type == varExpr && exp.Func.Index != nil {
+			container := e.evaluate(exp.Func.Left, env)
+			fn = indexValue(container, e.evaluate(exp.Func.Index, env), exp.Func)
+			// Check if caller is a go-map/rune-table ...
+			if caller, ok := container.(*Table); ok {
+				// if so: inject its reference as the first argument (similar to pythons 'self' argument on methods)
+				args = append(args, caller)
+			}
+		} else {
+			fn = e.evaluate(exp.Func, env)
 		}
 
 		for _, arg := range exp.Args {
 			args = append(args, e.evaluate(arg, env))
 		}
-
-		ret := fn(args...)
-		if err, ok := ret.(error); ok {
-			evalError(exp, "Error in function call: '%v'", err)
-		}
-		return ret
+		return e.callFunction(fn, args, exp)
 
 	case returnExpr:
 		return ReturnValue{Value: e.evaluate(exp.Right, env)}
@@ -264,32 +272,280 @@ func (e *Evaluator) evaluate(exp *expression, env *Environment) interface{} {
 		return ContinueValue{Value: false}
 
 	case importExpr:
-		path := e.evaluate(exp.Left, env).(string) + ".rune"
-		if _, alreadyImported := e.importedPaths[path]; alreadyImported {
-			evalError(exp, "Duplicate import detected: '%s' was already imported", path)
+		importProg := e.loadImport(e.evaluate(exp.Left, env), exp)
+		e.evaluate(importProg.ast, env)
+		return nil
+
+	default:
+		evalError(exp, "I don't know how to evaluate %v", exp.Type)
+		return nil
+	}
+}
+
+// Evaluates a try expression. The finally block runs after the try and catch blocks, even if they raised
+// a catchable error or left the block with return, break or continue. A jump in the finally block wins.
+func (e *Evaluator) evalTry(exp *expression, env *Environment) (result interface{}) {
+	if exp.Else != nil {
+		defer func() {
+			rec := recover()
+			if rec != nil {
+				if _, ok := catchable(rec); !ok {
+					panic(rec)
+				}
+			}
+			if fin := e.evaluate(exp.Else, env); isJump(fin) {
+				result = fin
+				return
+			}
+			if rec != nil {
+				panic(rec)
+			}
+		}()
+	}
+	if exp.Then == nil {
+		return e.evaluate(exp.Body, env)
+	}
+	return e.evalTryCatch(exp, env)
+}
+
+// Evaluates the try block and, if it raises a catchable error, the catch block.
+func (e *Evaluator) evalTryCatch(exp *expression, env *Environment) (result interface{}) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err, ok := catchable(rec)
+			if !ok {
+				panic(rec)
+			}
+			if len(exp.Params) > 0 {
+				env.set(exp.Params[0], errorTable(err))
+			}
+			result = e.evaluate(exp.Then, env)
 		}
+	}()
+	return e.evaluate(exp.Body, env)
+}
 
-		e.importedPaths[path] = true
+// Reports whether the value is the result of a return, break or continue expression.
+func isJump(value interface{}) bool {
+	switch value.(type) {
+	case ReturnValue, BreakValue, ContinueValue:
+		return true
+	}
+	return false
+}
 
-		importedSource, err := os.ReadFile(path)
-		if err != nil {
-			evalError(exp, "Failed to import file '%s': %v", path, err)
+// Calls a Rune or Go function and turns an error returned by it into a runtime error at the call site.
+func (e *Evaluator) callFunction(fnVal interface{}, args []interface{}, exp *expression) interface{} {
+	fn, ok := fnVal.(func(args ...interface{}) interface{})
+	if !ok {
+		evalError(exp, "'%s' is not a function", exp.Func.Value)
+	}
+	if exp.Operator == "for" && isRangeBuiltin(fn) {
+		// A for loop counts through the range without building the array
+		fn = builtin_rangeIterator
+	}
+	ret := e.invoke(fn, args, exp)
+	if err, ok := ret.(error); ok {
+		if exitErr, isExit := err.(*ExitError); isExit {
+			// Unwind the whole script, Exec returns the ExitError
+			panic(exitErr)
+		}
+		if _, isLimit := err.(*LimitError); isLimit {
+			limitError(exp, err)
 		}
+		if thrown, isThrown := err.(*ThrownError); isThrown {
+			runeErr := newEvalError(exp, "%s", thrown.Error())
+			runeErr.Err = thrown
+			panic(runeErr)
+		}
+		runeErr := newEvalError(exp, "Error in function call: '%v'", err)
+		if err == ErrCanceled || err == ErrTimeout {
+			runeErr.Message = err.Error()
+		}
+		runeErr.Err = err
+		panic(runeErr)
+	}
+	switch v := ret.(type) {
+	case int, float64, bool:
+	case string, []interface{}, *Table:
+		e.alloc(ret, exp)
+	case map[string]interface{}:
+		// Go functions may return plain maps, Rune only knows ordered tables
+		t := TableFromMap(v)
+		e.alloc(t, exp)
+		return t
+	default:
+		// Go functions may return any numeric type, Rune only knows int and float
+		if n, ok := normalizeNumber(ret); ok {
+			return n
+		}
+	}
+	return ret
+}
+
+func (e *Evaluator) invoke(fn func(args ...interface{}) interface{}, args []interface{}, exp *expression) interface{} {
+	e.callStack = append(e.callStack, exp)
+	defer e.popFrame()
+	if len(e.callStack) > MaxRecursionDepth {
+		evalError(exp, "Maximum recursion depth exceeded")
+	}
+	if e.usage.limits.MaxCallDepth > 0 && len(e.callStack) > e.usage.limits.MaxCallDepth {
+		limitError(exp, &LimitError{Limit: "MaxCallDepth", Max: e.usage.limits.MaxCallDepth})
+	}
+	e.checkContext(exp)
+	return fn(args...)
+}
+
+// Pops the innermost call frame. If the call raised a runtime error, the call stack is recorded on the error first.
+func (e *Evaluator) popFrame() {
+	if rec := recover(); rec != nil {
+		if err, ok := rec.(*RuneError); ok && err.Kind == RuntimeError && err.Stack == nil {
+			err.Stack = make([]StackFrame, len(e.callStack))
+			for i, call := range e.callStack {
+				err.Stack[i] = StackFrame{Function: calleeName(call.Func), File: call.File, Line: call.Line, Col: call.Col}
+			}
+		}
+		e.callStack = e.callStack[:len(e.callStack)-1]
+		panic(rec)
+	}
+	e.callStack = e.callStack[:len(e.callStack)-1]
+}
+
+// Returns the name a function is called by in a call expression: "greet" for greet(), "person.greet" for
+// person.greet() and person["greet"](), or "<anonymous>" if the function isn't called by a name.
+func calleeName(fn *expression) string {
+	if fn == nil || fn.Type != varExpr {
+		return "<anonymous>"
+	}
+	if fn.Index == nil {
+		return fn.Value.(string)
+	}
+	field, ok := fn.Index.Value.(string)
+	if fn.Index.Type != strExpr || !ok {
+		return "<anonymous>"
+	}
+	return calleeName(fn.Left) + "." + field
+}
+
+// Reads and compiles the file an import expression refers to. Each file can only be imported once.
+func (e *Evaluator) loadImport(pathVal interface{}, exp *expression) *Program {
+	path, ok := pathVal.(string)
+	if !ok {
+		evalError(exp, "Import path must be a string")
+	}
+	if !e.sandbox.has(CapImport) {
+		evalError(exp, "Import is not allowed in this vm")
+	}
+	path, err := e.sandbox.resolve(path + ".rune")
+	if err != nil {
+		evalError(exp, "Failed to import file: %v", err)
+	}
+	if _, alreadyImported := e.importedPaths[path]; alreadyImported {
+		evalError(exp, "Duplicate import detected: '%s' was already imported", path)
+	}
 
-		importStream := newInputStream(string(importedSource), path)
-		importTokenStream := newTokenStream(importStream)
-		importParser := newParser(importTokenStream)
-		importAST := importParser.parseProgram()
+	e.importedPaths[path] = true
+
+	importedSource, err := os.ReadFile(path)
+	if err != nil {
+		evalError(exp, "Failed to import file '%s': %v", path, err)
+	}
+
+	importProg, err := Compile(string(importedSource), path)
+	if err != nil {
+		// Propagate the lex/parse error of the imported file as is
+		panic(err)
+	}
+	return importProg
+}
 
-		e.evaluate(importAST, env)
+// Returns the element of an array at the given index or the value of a table at the given key.
+// An optional access (a?.b, a?[i]) returns nil if the container is nil or the index or key doesn't exist.
+func indexValue(container interface{}, index interface{}, exp *expression) interface{} {
+	optional := exp.Operator == "?"
+	if optional && container == nil {
 		return nil
+	}
+	switch v := container.(type) {
+	case []interface{}:
+		idx, ok := index.(int)
+		if !ok {
+			evalError(exp, "Array index must be an integer")
+		}
+		if idx < 0 || idx >= len(v) {
+			if optional {
+				return nil
+			}
+			evalError(exp, "Index '%d' out of bounds for array '%v[%d]'", idx, exp.Value, len(v))
+		}
+		return v[idx]
+	case *Table:
+		key, ok := index.(string)
+		if !ok {
+			evalError(exp, "Table key must be a string")
+		}
+		val, ok := v.Get(key)
+		if !ok {
+			if optional {
+				return nil
+			}
+			evalError(exp, "Key '%s' not found in table '%v'", key, exp.Value)
+		}
+		return val
+	default:
+		evalError(exp, "Variable %v is not an array or table", exp.Value)
+		return nil
+	}
+}
 
+// Stores the value in an array at the given index or in a table at the given key. Returns the value.
+func (e *Evaluator) setIndexValue(container interface{}, index interface{}, value interface{}, exp *expression) interface{} {
+	switch arr := container.(type) {
+	case []interface{}:
+		idx, ok := index.(int)
+		if !ok {
+			evalError(exp, "Array index must be an integer")
+		}
+		if idx < 0 || idx >= len(arr) {
+			evalError(exp, "Array index out of bounds")
+		}
+		arr[idx] = value
+		return value
+	case *Table:
+		key, ok := index.(string)
+		if !ok {
+			evalError(exp, "Table key must be a string")
+		}
+		if !arr.Has(key) {
+			if err := e.usage.limits.checkSize(arr.Len() + 1); err != nil {
+				limitError(exp, err)
+			}
+		}
+		arr.Set(key, value)
+		return value
 	default:
-		evalError(exp, "I don't know how to evaluate %v", exp.Type)
+		evalError(exp, "Cannot index into type %T", container)
 		return nil
 	}
 }
 
+// Reports whether a value counts as true in conditions. The values nil, false, 0, 0.0 and "" are falsy,
+// every other value is truthy.
+func isTruthy(x interface{}) bool {
+	switch v := x.(type) {
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return x != nil
+	}
+}
+
 func parseNumber(val string, exp *expression) interface{} {
 	if strings.Contains(val, ".") {
 		f, err := strconv.ParseFloat(val, 64)
@@ -299,6 +555,9 @@ func parseNumber(val string, exp *expression) interface{} {
 		return f
 	}
 	i, err := strconv.Atoi(val)
+	if errors.Is(err, strconv.ErrRange) {
+		evalError(exp, "Integer %s is out of range", val)
+	}
 	if err != nil {
 		evalError(exp, "Expected number but got %T", val)
 	}
@@ -306,119 +565,213 @@ func parseNumber(val string, exp *expression) interface{} {
 }
 
 func applyUnaryOp(op string, a interface{}, exp *expression) interface{} {
-	boolVal := func(x interface{}) bool {
-		switch v := x.(type) {
-		case bool:
-			return v
-		case string:
-			if b, err := strconv.ParseBool(v); err == nil {
-				return b
-			}
-		case int:
-			return v != 0
-		case float64:
-			return v != 0
-		default:
-			if x != nil {
-				return false
-			} else {
-				evalError(exp, fmt.Sprintf("Unary operator '%s' needs a valid operand", op))
-			}
-		}
-		return false
-	}
 	switch op {
-	case "not":
-		return !boolVal(a)
+	case "not", "!":
+		return !isTruthy(a)
+	case "-":
+		// Negating the smallest int overflows, like 0 - x
+		if x, ok := toNumber(a, exp).(int); ok {
+			return intArith("-", 0, x, exp)
+		}
+		return -asFloat(toNumber(a, exp))
+	case "+":
+		return toNumber(a, exp)
 	default:
 		evalError(exp, "Can't apply unary operator %s", op)
 		return nil
 	}
 }
 
-func applyBinaryOp(op string, a, b interface{}, exp *expression) interface{} {
-	num := func(x interface{}) float64 {
-		switch v := x.(type) {
-		case string:
-			return parseNumber(v, exp).(float64)
-		case int:
-			return float64(v)
-		case int32:
-			return float64(v)
-		case int64:
-			return float64(v)
-		case float32:
-			return float64(v)
-		case float64:
-			return float64(v)
-		default:
-			evalError(exp, "Expected number but got %T", x)
-			return 0
-		}
-	}
-	div := func(x interface{}) float64 {
-		if num(x) == 0 {
-			evalError(exp, "Divide by zero")
-		}
-		return num(x)
-	}
-	boolVal := func(x interface{}) bool {
-		switch v := x.(type) {
-		case bool:
-			return v
-		case string:
-			if b, err := strconv.ParseBool(v); err == nil {
-				return b
+// Returns the binary operator a compound assignment applies, e.g. + for +=.
+func compoundOperator(exp *expression) string {
+	return strings.TrimSuffix(exp.Operator, "=")
+}
+
+func (e *Evaluator) applyBinaryOp(op string, a, b interface{}, exp *expression) interface{} {
+	// Fast path for the most common case of two integer operands
+	if x, ok := a.(int); ok {
+		if y, ok := b.(int); ok {
+			switch op {
+			case "<":
+				return x < y
+			case ">":
+				return x > y
+			case "<=":
+				return x <= y
+			case ">=":
+				return x >= y
+			case "==":
+				return x == y
+			case "!=":
+				return x != y
+			case "+", "-", "*", "/", "//", "%":
+				return intArith(op, x, y, exp)
 			}
-		case int:
-			return v != 0
-		case float64:
-			return v != 0
-		default:
-			evalError(exp, "Expected bool but got %v", x)
-		}
-		return false
-	}
-	roundIfInt := func(value float64) interface{} {
-		if math.Abs(value-math.Round(value)) < 1e-9 {
-			return int(value)
 		}
-		return value
 	}
 
 	switch op {
-	case "+":
-		return roundIfInt(num(a) + num(b))
-	case "-":
-		return roundIfInt(num(a) - num(b))
-	case "*":
-		return roundIfInt(num(a) * num(b))
-	case "/":
-		return roundIfInt(num(a) / div(b))
-	case "%":
-		return int(num(a)) % int(num(b))
 	case "&&":
-		return boolVal(a) && boolVal(b)
+		return isTruthy(a) && isTruthy(b)
 	case "||":
-		return boolVal(a) || boolVal(b)
+		return isTruthy(a) || isTruthy(b)
 	case "<":
-		return num(a) < num(b)
+		return compareValues(a, b, exp) < 0
 	case ">":
-		return num(a) > num(b)
+		return compareValues(a, b, exp) > 0
 	case "<=":
-		return num(a) <= num(b)
+		return compareValues(a, b, exp) <= 0
 	case ">=":
-		return num(a) >= num(b)
+		return compareValues(a, b, exp) >= 0
 	case "==":
-		return num(a) == num(b)
+		return valuesEqual(a, b)
 	case "!=":
-		return num(a) != num(b)
+		return !valuesEqual(a, b)
+	case "+", "-", "*", "/", "//", "%":
+		// + concatenates if either operand is a string
+		if op == "+" {
+			_, aIsStr := a.(string)
+			_, bIsStr := b.(string)
+			if aIsStr || bIsStr {
+				return e.concat(formatValue(a), formatValue(b), exp)
+			}
+		}
+		x := toNumber(a, exp)
+		y := toNumber(b, exp)
+		if xi, ok := x.(int); ok {
+			if yi, ok := y.(int); ok {
+				return intArith(op, xi, yi, exp)
+			}
+		}
+		return floatArith(op, asFloat(x), asFloat(y), exp)
 	default:
 		evalError(exp, "Can't apply operator %s", op)
 		return nil
 	}
 }
 
+// Concatenates two strings, checking the result against the string and allocation limits first.
+func (e *Evaluator) concat(a, b string, exp *expression) string {
+	if err := e.usage.limits.checkString(utf8.RuneCountInString(a) + utf8.RuneCountInString(b)); err != nil {
+		limitError(exp, err)
+	}
+	if err := e.usage.allocate(1); err != nil {
+		limitError(exp, err)
+	}
+	return a + b
+}
+
+// Joins the evaluated parts of an interpolated string.
+func (e *Evaluator) interpolate(parts []interface{}, exp *expression) string {
+	var sb strings.Builder
+	chars := 0
+	for _, part := range parts {
+		str := formatValue(part)
+		chars += utf8.RuneCountInString(str)
+		if err := e.usage.limits.checkString(chars); err != nil {
+			limitError(exp, err)
+		}
+		sb.WriteString(str)
+	}
+	if err := e.usage.allocate(1); err != nil {
+		limitError(exp, err)
+	}
+	return sb.String()
+}
+
+// Reports whether two values are equal. Numbers are equal if they have the same value, no matter if
+// they are ints or floats. Strings and bools are compared by value, arrays by their elements and tables
+// by identity. Values of different types and functions are never equal.
+func valuesEqual(a, b interface{}) bool {
+	return equalValues(a, b, nil)
+}
+
+func equalValues(a, b interface{}, seen map[[2]*interface{}]bool) bool {
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	case []interface{}:
+		y, ok := b.([]interface{})
+		return ok && arraysEqual(x, y, seen)
+	case *Table:
+		y, ok := b.(*Table)
+		return ok && x == y
+	case nil:
+		return b == nil
+	case int:
+		if y, ok := b.(int); ok {
+			return x == y
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return false
+}
+
+// Compares two arrays element by element. Pairs of arrays that are already being compared count as
+// equal, so arrays that contain themselves don't recurse forever.
+func arraysEqual(x, y []interface{}, seen map[[2]*interface{}]bool) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	if len(x) == 0 || &x[0] == &y[0] {
+		return true
+	}
+	pair := [2]*interface{}{&x[0], &y[0]}
+	if seen[pair] {
+		return true
+	}
+	if seen == nil {
+		seen = make(map[[2]*interface{}]bool)
+	}
+	seen[pair] = true
+	for i := range x {
+		if !equalValues(x[i], y[i], seen) {
+			return false
+		}
+	}
+	return true
+}
+
+// Orders two numbers or two strings. Strings are ordered lexicographically by their bytes.
+// Returns a negative number if a < b, zero if a == b and a positive number if a > b.
+func compareValues(a, b interface{}, exp *expression) int {
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	}
+	if x, ok := a.(int); ok {
+		if y, ok := b.(int); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	x, okA := toFloat(a)
+	y, okB := toFloat(b)
+	if !okA || !okB {
+		evalError(exp, "Can't compare %s with %s", typeName(a), typeName(b))
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
 func (e *Evaluator) makeFun(env *Environment, exp *expression) func(args ...interface{}) interface{} {
 	return func(args ...interface{}) interface{} {
 		scope := env.extend()
@@ -427,20 +780,29 @@ func (e *Evaluator) makeFun(env *Environment, exp *expression) func(args ...inte
 			if i < len(args) {
 				scope.def(name, args[i])
 			} else {
-				scope.def(name, false)
+				scope.def(name, nil)
 			}
 		}
 
-		return e.evaluate(exp.Body, scope)
+		result := e.evaluate(exp.Body, scope)
+		if ret, ok := result.(ReturnValue); ok {
+			return ret.Value
+		}
+		return result
 	}
 }
 
+// Raises a runtime error at the position of the given expression.
 func evalError(exp *expression, format string, a ...interface{}) {
-	msg := fmt.Sprintf(format, a...)
+	panic(newEvalError(exp, format, a...))
+}
+
+func newEvalError(exp *expression, format string, a ...interface{}) *RuneError {
+	err := &RuneError{Kind: RuntimeError, Message: fmt.Sprintf(format, a...)}
 	if exp != nil {
-		fmt.Printf("error (%s:%d:%d): %s\n", exp.File, exp.Line, exp.Col, msg)
-	} else {
-		fmt.Printf("error: %s\n", msg)
+		err.File = exp.File
+		err.Line = exp.Line
+		err.Col = exp.Col
 	}
-	os.Exit(0)
+	return err
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/RednibCoding/runevm"
+)
+
+/*********************************************************
+*
+* Compares the tree-walking evaluator with the bytecode backend.
+* Run from the repository root with: go run ./example/bench
+* The same scripts run as Go benchmarks with: go test -run - -bench .
+*
+**********************************************************/
+
+//go:embed *.rune
+var scripts embed.FS
+
+func main() {
+	runs := flag.Int("runs", 5, "number of runs per script and backend, the fastest run is reported")
+	flag.Parse()
+
+	entries, err := scripts.ReadDir(".")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-16s %14s %14s %9s\n", "script", "tree-walker", "bytecode", "speedup")
+	for _, entry := range entries {
+		source, err := scripts.ReadFile(entry.Name())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		prog, err := runevm.Compile(string(source), entry.Name())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		treeWalker := measure(prog, runevm.TreeWalker, *runs)
+		bytecode := measure(prog, runevm.Bytecode, *runs)
+		fmt.Printf("%-16s %14v %14v %8.1fx\n", entry.Name(), treeWalker.Round(time.Microsecond),
+			bytecode.Round(time.Microsecond), float64(treeWalker)/float64(bytecode))
+	}
+}
+
+// Returns the fastest of the given number of runs of the program.
+func measure(prog *runevm.Program, backend runevm.Backend, runs int) time.Duration {
+	var best time.Duration
+	for i := 0; i < runs; i++ {
+		vm := runevm.NewRuneVM()
+		vm.SetBackend(backend)
+
+		start := time.Now()
+		if err := vm.Exec(prog); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		elapsed := time.Since(start)
+
+		if i == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best
+}
@@ -24,5 +24,7 @@ func main() {
 	filepath := args[1]
 
 	vm := runevm.NewRuneVM()
-	vm.Run(string(source), filepath)
+	if err := vm.Run(string(source), filepath); err != nil {
+		fmt.Println(err)
+	}
 }
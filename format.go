@@ -0,0 +1,562 @@
+package runevm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Number of spaces per indentation level of formatted code
+const formatIndent = 4
+
+// Formats Rune source code in the canonical style: one statement per line, four spaces of indentation,
+// braces around every block instead of 'then', one space around binary operators and after commas, and
+// at most one blank line between statements. Comments are kept. Formatting the result again doesn't
+// change it. If the source has syntax errors, the returned error is a *RuneError describing the first one.
+func Format(source string, filepath string) (string, error) {
+	stream := newInputStream(source, filepath)
+	tokenStream := newTokenStream(stream)
+	tokenStream.keepComments = true
+	parser := newParser(tokenStream)
+	parser.recovering = true
+	parser.keepBlocks = true
+	ast := parser.parseProgram()
+	if len(parser.errors) > 0 {
+		return "", parser.errors[0].runeError()
+	}
+
+	f := &formatter{comments: tokenStream.comments, blockStart: true}
+	f.statements(ast.Block, 0, "")
+	// Comments after the last statement
+	f.commentsBefore(int(^uint(0) >> 1))
+	if f.sb.Len() > 0 {
+		f.write("\n")
+	}
+	return f.sb.String(), nil
+}
+
+// Prints a syntax tree in the canonical style. Comments are printed before the first statement that
+// starts after them, or at the end of the line of the statement they follow. Comments between the
+// arguments of a call or before else, catch and finally stay there.
+type formatter struct {
+	sb     bytes.Buffer
+	indent int
+	// Comments of the source in order, next is the first one not printed yet
+	comments []*Token
+	next     int
+	// Last source line printed, used to keep blank lines between statements
+	lastLine int
+	// Set until the first statement or comment of a block is printed
+	blockStart bool
+}
+
+func (f *formatter) write(s string) {
+	f.sb.WriteString(s)
+}
+
+func (f *formatter) newline() {
+	f.write("\n")
+	f.write(strings.Repeat(" ", f.indent*formatIndent))
+}
+
+// Starts a new line for a statement or comment that starts at the given source line. A blank line
+// between the previous statement and this one is kept.
+func (f *formatter) startLine(line int) {
+	if !f.blockStart && line > f.lastLine+1 {
+		f.write("\n")
+	}
+	if f.sb.Len() > 0 {
+		f.newline()
+	} else {
+		f.write(strings.Repeat(" ", f.indent*formatIndent))
+	}
+	f.blockStart = false
+}
+
+// Prints the comments that start before the given source line, each on its own line.
+func (f *formatter) commentsBefore(line int) {
+	for f.next < len(f.comments) && f.comments[f.next].Line < line {
+		comment := f.comments[f.next]
+		f.startLine(comment.Line)
+		f.write("#" + comment.Value)
+		f.lastLine = comment.Line
+		f.next++
+	}
+}
+
+// Prints a comment that follows the code of the given source line at the end of the output line.
+func (f *formatter) trailingComment(line int) {
+	if f.next < len(f.comments) && f.comments[f.next].Line == line {
+		f.write(" #" + f.comments[f.next].Value)
+		f.next++
+	}
+}
+
+// Prints a comment after an opening brace or parenthesis on the given line, unless the first
+// element follows on that line and the comment belongs to it.
+func (f *formatter) openingComment(line int, elems []*expression) {
+	if len(elems) == 0 || firstLine(elems[0]) > line {
+		f.trailingComment(line)
+	}
+}
+
+// Prints each expression on its own line followed by the suffix, with the comments before and after
+// them. EndLine is the line of the closing brace, comments before it are printed after the last statement.
+func (f *formatter) statements(stmts []*expression, endLine int, suffix string) {
+	for i, stmt := range stmts {
+		start := firstLine(stmt)
+		f.commentsBefore(start)
+		f.startLine(start)
+		f.expr(stmt)
+		f.write(suffix)
+		end := lastLine(stmt)
+		// A comment after several elements on one line follows the last of them, and one after the
+		// closing brace follows the block
+		if (i < len(stmts)-1 && firstLine(stmts[i+1]) > end) || (i == len(stmts)-1 && (endLine == 0 || end < endLine)) {
+			f.trailingComment(end)
+		}
+		if end > f.lastLine {
+			f.lastLine = end
+		}
+	}
+	if endLine > 0 {
+		f.commentsBefore(endLine)
+	}
+}
+
+// Reports whether comments are left before the given source line.
+func (f *formatter) hasCommentsBefore(line int) bool {
+	return f.next < len(f.comments) && f.comments[f.next].Line < line
+}
+
+// Reports whether comments are left between the elements of a list ending at the given line, rather
+// than inside one of them. Such comments need each element on its own line to stay where they are.
+func (f *formatter) hasCommentsBetween(elems []*expression, endLine int) bool {
+	for _, comment := range f.comments[f.next:] {
+		if comment.Line >= endLine {
+			return false
+		}
+		inside := false
+		for _, elem := range elems {
+			if firstLine(elem) <= comment.Line && comment.Line < lastLine(elem) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return true
+		}
+	}
+	return false
+}
+
+// Prints a keyword that continues a statement after the part ending at the given line, like else or
+// catch. It follows on the same line, unless there are comments before the next part starting at
+// nextLine. Then the comments keep their lines and the keyword starts the line after them.
+func (f *formatter) continuation(keyword string, endLine int, nextLine int) {
+	if !f.hasCommentsBefore(nextLine) {
+		f.write(" " + keyword + " ")
+		return
+	}
+	f.trailingComment(endLine)
+	if endLine > f.lastLine {
+		f.lastLine = endLine
+	}
+	f.commentsBefore(nextLine)
+	f.newline()
+	f.write(keyword + " ")
+}
+
+// Prints a block in braces. A body that isn't a block, like the expression after 'then', becomes a
+// block with a single statement.
+func (f *formatter) block(body *expression) {
+	stmts := []*expression{body}
+	endLine := 0
+	if body.Type == blockExpr {
+		stmts = body.Block
+		endLine = body.EndLine
+	}
+	if len(stmts) == 0 && !f.hasCommentsBefore(endLine) {
+		f.write("{}")
+		return
+	}
+	f.write("{")
+	if body.Type == blockExpr {
+		f.openingComment(body.Line, stmts)
+	}
+	f.enter(func() {
+		f.statements(stmts, endLine, "")
+	})
+	f.newline()
+	f.write("}")
+}
+
+// Prints the elements of an array or table, on one line if the literal was written on one line,
+// otherwise each on its own line with a trailing comma.
+func (f *formatter) elements(exp *expression) {
+	if exp.EndLine <= exp.Line || (len(exp.Block) == 0 && !f.hasCommentsBefore(exp.EndLine)) {
+		// Elements spanning multiple lines themselves, like functions, get a line of their own as well
+		next, lastLine := f.next, f.lastLine
+		start := f.sb.Len()
+		f.write("{")
+		for i, elem := range exp.Block {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.expr(elem)
+		}
+		f.write("}")
+		if !bytes.Contains(f.sb.Bytes()[start:], []byte("\n")) {
+			return
+		}
+		f.sb.Truncate(start)
+		f.next, f.lastLine = next, lastLine
+	}
+	f.write("{")
+	f.openingComment(exp.Line, exp.Block)
+	f.enter(func() {
+		f.statements(exp.Block, exp.EndLine, ",")
+	})
+	f.newline()
+	f.write("}")
+}
+
+// Runs fn one indentation level deeper, as the first statements of a new block.
+func (f *formatter) enter(fn func()) {
+	f.indent++
+	f.blockStart = true
+	fn()
+	f.indent--
+	f.blockStart = false
+}
+
+func (f *formatter) expr(exp *expression) {
+	switch exp.Type {
+	case numExpr:
+		f.write(exp.Operator)
+
+	case strExpr:
+		if exp.Operator == "`" {
+			f.write("`" + exp.Value.(string) + "`")
+		} else {
+			f.write(`"` + quoteString(exp.Value.(string)) + `"`)
+		}
+
+	case boolExpr:
+		if exp.Value.(bool) {
+			f.write("true")
+		} else {
+			f.write("false")
+		}
+
+	case nilExpr:
+		f.write("nil")
+
+	case interpExpr:
+		f.write(`"`)
+		for _, part := range exp.Block {
+			if part.Type == strExpr {
+				f.write(quoteString(part.Value.(string)))
+			} else {
+				f.write("${")
+				f.expr(part)
+				f.write("}")
+			}
+		}
+		f.write(`"`)
+
+	case varExpr:
+		f.access(exp, exp.Operator == "?")
+
+	case assignExpr, binaryExpr:
+		f.binary(exp)
+
+	case unaryExpr:
+		f.write(exp.Operator)
+		if exp.Operator == "not" {
+			f.write(" ")
+		}
+		// A binary operand needs parentheses, and so does a unary one after a symbol, so -(-x) isn't written as --x
+		if exp.Right.Type == binaryExpr || exp.Right.Type == assignExpr || (exp.Right.Type == unaryExpr && exp.Operator != "not") {
+			f.write("(")
+			f.expr(exp.Right)
+			f.write(")")
+		} else {
+			f.expr(exp.Right)
+		}
+
+	case funExpr:
+		f.write("fun(" + strings.Join(exp.Params, ", ") + ") ")
+		f.block(exp.Body)
+
+	case ifExpr:
+		f.write("if ")
+		f.expr(exp.Cond)
+		f.write(" ")
+		f.block(exp.Then)
+		for exp.Else != nil {
+			if exp.Else.Type == ifExpr && endsWithElse(exp.Else) {
+				f.continuation("elif", lastLine(exp.Then), firstLine(exp.Else))
+				exp = exp.Else
+				f.expr(exp.Cond)
+				f.write(" ")
+				f.block(exp.Then)
+				continue
+			}
+			f.continuation("else", lastLine(exp.Then), firstLine(exp.Else))
+			if exp.Else.Type == ifExpr {
+				f.expr(exp.Else)
+			} else {
+				f.block(exp.Else)
+			}
+			break
+		}
+
+	case blockExpr:
+		f.block(exp)
+
+	case callExpr:
+		f.primary(exp.Func)
+		if f.hasCommentsBetween(exp.Args, exp.EndLine) {
+			f.write("(")
+			f.openingComment(exp.Line, exp.Args)
+			f.enter(func() {
+				f.statements(exp.Args, exp.EndLine, ",")
+			})
+			f.newline()
+			f.write(")")
+			break
+		}
+		f.write("(")
+		for i, arg := range exp.Args {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.expr(arg)
+		}
+		f.write(")")
+
+	case returnExpr:
+		f.write("return")
+		if exp.Right != FALSE {
+			f.write(" = ")
+			f.expr(exp.Right)
+		}
+
+	case whileExpr:
+		f.write("while ")
+		f.expr(exp.Cond)
+		f.write(" ")
+		f.block(exp.Body)
+
+	case forExpr:
+		f.write("for " + strings.Join(exp.Params, ", ") + " in ")
+		f.expr(exp.Right)
+		f.write(" ")
+		f.block(exp.Body)
+
+	case tryExpr:
+		f.write("try ")
+		f.block(exp.Body)
+		last := exp.Body
+		if exp.Then != nil {
+			f.continuation("catch", lastLine(last), firstLine(exp.Then))
+			if len(exp.Params) > 0 {
+				f.write(exp.Params[0] + " ")
+			}
+			f.block(exp.Then)
+			last = exp.Then
+		}
+		if exp.Else != nil {
+			f.continuation("finally", lastLine(last), firstLine(exp.Else))
+			f.block(exp.Else)
+		}
+
+	case breakExpr:
+		f.write("break")
+
+	case continueExpr:
+		f.write("continue")
+
+	case arrayExpr:
+		f.write("array")
+		f.elements(exp)
+
+	case tableExpr:
+		f.write("table")
+		f.elements(exp)
+
+	case pairExpr:
+		f.expr(exp.Left)
+		f.write(": ")
+		f.expr(exp.Right)
+
+	case importExpr:
+		f.write("import ")
+		f.expr(exp.Left)
+	}
+}
+
+// Prints a variable or an index or field access. Keys that are plain names are written as field access.
+func (f *formatter) access(exp *expression, optional bool) {
+	if exp.Index == nil {
+		f.write(exp.Value.(string))
+		return
+	}
+	f.primary(exp.Left)
+	if optional {
+		f.write("?")
+	}
+	f.key(exp.Index)
+}
+
+// Prints the access chain on the left of ??. The parser makes every access of the chain optional, so
+// no '?' is written.
+func (f *formatter) defaultedAccess(exp *expression) {
+	if exp.Index == nil {
+		f.write(exp.Value.(string))
+		return
+	}
+	if exp.Left.Type == varExpr {
+		f.defaultedAccess(exp.Left)
+	} else {
+		f.primary(exp.Left)
+	}
+	f.key(exp.Index)
+}
+
+// Prints the key of an index or field access.
+func (f *formatter) key(index *expression) {
+	if key, ok := index.Value.(string); ok && index.Type == strExpr && isFieldName(key) {
+		f.write("." + key)
+		return
+	}
+	f.write("[")
+	f.expr(index)
+	f.write("]")
+}
+
+// Prints a binary expression.
+func (f *formatter) binary(exp *expression) {
+	prec := precedence[exp.Operator]
+	if exp.Operator == "??" && exp.Left.Type == varExpr {
+		f.defaultedAccess(exp.Left)
+	} else {
+		f.operand(exp.Left, prec, false)
+	}
+	f.write(" " + exp.Operator + " ")
+	f.operand(exp.Right, prec, true)
+}
+
+// Prints the operand of a binary expression, in parentheses if the parser would group it differently
+// without them. Operators of the same precedence group to the left, assignments to the right.
+func (f *formatter) operand(exp *expression, prec int, right bool) {
+	if exp.Type != assignExpr && exp.Type != binaryExpr {
+		f.expr(exp)
+		return
+	}
+	opPrec := precedence[exp.Operator]
+	groups := !right
+	if exp.Type == assignExpr {
+		groups = right
+	}
+	if opPrec > prec || (opPrec == prec && groups) {
+		f.binary(exp)
+		return
+	}
+	f.write("(")
+	f.expr(exp)
+	f.write(")")
+}
+
+// Prints the expression a call or access applies to, in parentheses unless it is a simple value.
+func (f *formatter) primary(exp *expression) {
+	switch exp.Type {
+	case varExpr, callExpr, numExpr, strExpr, boolExpr, nilExpr, interpExpr, arrayExpr, tableExpr:
+		f.expr(exp)
+	default:
+		f.write("(")
+		f.expr(exp)
+		f.write(")")
+	}
+}
+
+// Reports whether a chain of if and elif expressions ends with an else. Only then it can be written
+// with elif, which requires an else.
+func endsWithElse(exp *expression) bool {
+	for exp.Type == ifExpr {
+		if exp.Else == nil {
+			return false
+		}
+		exp = exp.Else
+	}
+	return true
+}
+
+// Reports whether a table key can be written as a field name after a dot.
+func isFieldName(key string) bool {
+	if key == "" || keywords[key] {
+		return false
+	}
+	for i, ch := range key {
+		letter := ch == '_' || unicode.IsLetter(ch)
+		if !letter && (i == 0 || !unicode.IsDigit(ch)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Escapes the characters of a string value that end or change a string literal, and the control
+// characters, so the literal fits on one line.
+func quoteString(s string) string {
+	var sb strings.Builder
+	for i, ch := range s {
+		switch {
+		case ch == '\\' || ch == '"':
+			sb.WriteByte('\\')
+			sb.WriteRune(ch)
+		case ch == '$' && strings.HasPrefix(s[i:], "${"):
+			sb.WriteString(`\$`)
+		case ch == '\n':
+			sb.WriteString(`\n`)
+		case ch == '\t':
+			sb.WriteString(`\t`)
+		case ch == '\r':
+			sb.WriteString(`\r`)
+		case ch == 0:
+			sb.WriteString(`\0`)
+		case unicode.IsControl(ch):
+			fmt.Fprintf(&sb, `\u{%X}`, ch)
+		default:
+			sb.WriteRune(ch)
+		}
+	}
+	return sb.String()
+}
+
+// Returns the first source line of an expression.
+func firstLine(exp *expression) int {
+	line := exp.Line
+	for _, child := range exp.children() {
+		if childLine := firstLine(child); childLine > 0 && (line == 0 || childLine < line) {
+			line = childLine
+		}
+	}
+	return line
+}
+
+// Returns the last source line of an expression, including the closing brace of blocks.
+func lastLine(exp *expression) int {
+	line := exp.Line
+	if exp.EndLine > line {
+		line = exp.EndLine
+	}
+	for _, child := range exp.children() {
+		if childLine := lastLine(child); childLine > line {
+			line = childLine
+		}
+	}
+	return line
+}
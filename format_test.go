@@ -0,0 +1,98 @@
+package runevm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Formats each testdata/format/*.rune script and compares the result with the .golden file next to it
+func TestFormatGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/format/*.rune")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no scripts in testdata/format: %v", err)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			source, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(strings.TrimSuffix(path, ".rune") + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Format(string(source), path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// Formatting formatted code again must not change it
+func TestFormatIdempotent(t *testing.T) {
+	paths, err := filepath.Glob("testdata/format/*.rune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	examples, err := filepath.Glob("example/*.rune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bench, err := filepath.Glob("example/bench/*.rune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = append(append(paths, examples...), bench...)
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			source, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			once, err := Format(string(source), path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			twice, err := Format(once, path)
+			if err != nil {
+				t.Fatalf("unexpected error formatting again: %v", err)
+			}
+			if twice != once {
+				t.Errorf("formatting again changed the code from:\n%s\nto:\n%s", once, twice)
+			}
+		})
+	}
+}
+
+// Each comment must stay on the line of the code it was written next to
+func TestFormatKeepsComments(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"if a {\n    b()\n}\n# c\nelse {\n    d()\n}\n", "if a {\n    b()\n}\n# c\nelse {\n    d()\n}\n"},
+		{"if a { b() } else { d() } # c\n", "if a {\n    b()\n} else {\n    d()\n} # c\n"},
+		{"f(1, # c\n    2)\n", "f(\n    1, # c\n    2,\n)\n"},
+		{"f(1,\n    2)\n", "f(1, 2)\n"},
+		{"f(fun() { # c\n    x()\n})\n", "f(fun() { # c\n    x()\n})\n"},
+		{"try {\n    a()\n} # c\nfinally {\n    b()\n}\n", "try {\n    a()\n} # c\nfinally {\n    b()\n}\n"},
+		{"t = array{1, 2, # c\n    3}\n", "t = array{\n    1,\n    2, # c\n    3,\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			got, err := Format(tt.source, "test.rune")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
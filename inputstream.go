@@ -1,10 +1,9 @@
 package runevm
 
-import (
-	"fmt"
-	"os"
-)
+import "unicode/utf8"
 
+// InputStream reads the characters of a source text. Pos is the byte offset of the next character, line and Col
+// its position, counted in characters. Invalid UTF-8 is read as utf8.RuneError, one byte at a time.
 type InputStream struct {
 	filepath string
 	source   string
@@ -24,12 +23,12 @@ func newInputStream(source string, filepath string) *InputStream {
 	return p
 }
 
-func (p *InputStream) next() byte {
+func (p *InputStream) next() rune {
 	if p.Pos >= len(p.source) {
 		return 0
 	}
-	ch := p.source[p.Pos]
-	p.Pos++
+	ch, size := utf8.DecodeRuneInString(p.source[p.Pos:])
+	p.Pos += size
 	if ch == '\n' {
 		p.line++
 		p.Col = 1
@@ -39,11 +38,22 @@ func (p *InputStream) next() byte {
 	return ch
 }
 
-func (p *InputStream) peek() byte {
-	if p.Pos >= len(p.source) {
+func (p *InputStream) peek() rune {
+	return p.peekAt(0)
+}
+
+// Returns the character offset characters after the current one without consuming anything.
+func (p *InputStream) peekAt(offset int) rune {
+	pos := p.Pos
+	for ; offset > 0 && pos < len(p.source); offset-- {
+		_, size := utf8.DecodeRuneInString(p.source[pos:])
+		pos += size
+	}
+	if pos >= len(p.source) {
 		return 0
 	}
-	return p.source[p.Pos]
+	ch, _ := utf8.DecodeRuneInString(p.source[pos:])
+	return ch
 }
 
 func (p *InputStream) eof() bool {
@@ -53,6 +63,5 @@ func (p *InputStream) eof() bool {
 }
 
 func (p *InputStream) error(tok *Token, msg string) {
-	fmt.Printf("error [%s:%d:%d]: %s\n", tok.File, tok.Line, tok.Col, msg)
-	os.Exit(0)
+	raiseError(LexError, tok, msg)
 }
@@ -0,0 +1,95 @@
+package runevm
+
+import "reflect"
+
+// Iterates over the elements of an array, the entries of a table or the ints of a range in a for loop.
+// Both backends use it, so loops behave the same way on each of them.
+type iterator struct {
+	arr []interface{}
+	m   *Table
+	// Keys of the table in insertion order, taken when the loop starts
+	keys []string
+	pos  int
+	// Number of loop variables, 1 or 2
+	numVars int
+	// Set for a range, which yields count ints from start on, step apart
+	isRange     bool
+	start, step int
+	count       uint64
+}
+
+// Returns an iterator over the given array or table. An iterator of a range is returned as it is.
+func newIterator(value interface{}, numVars int, exp *expression) *iterator {
+	switch v := value.(type) {
+	case *iterator:
+		v.numVars = numVars
+		return v
+	case []interface{}:
+		return &iterator{arr: v, numVars: numVars}
+	case *Table:
+		keys := make([]string, v.Len())
+		copy(keys, v.Keys())
+		return &iterator{m: v, keys: keys, numVars: numVars}
+	default:
+		evalError(exp, "Can't iterate over %s", typeName(value))
+		return nil
+	}
+}
+
+// Returns the values of the loop variables for the next iteration, or false once all elements were visited.
+// A single variable gets the element of an array or the key of a table, two variables get the index and
+// element or the key and value. Table entries removed by the loop body are skipped.
+func (it *iterator) next() ([]interface{}, bool) {
+	if it.isRange {
+		if uint64(it.pos) >= it.count {
+			return nil, false
+		}
+		// pos*step may overflow, but the sum wraps around to a value within the range
+		value := it.start + it.pos*it.step
+		it.pos++
+		if it.numVars == 2 {
+			return []interface{}{it.pos - 1, value}, true
+		}
+		return []interface{}{value}, true
+	}
+	if it.m == nil {
+		if it.pos >= len(it.arr) {
+			return nil, false
+		}
+		it.pos++
+		if it.numVars == 2 {
+			return []interface{}{it.pos - 1, it.arr[it.pos-1]}, true
+		}
+		return []interface{}{it.arr[it.pos-1]}, true
+	}
+	for it.pos < len(it.keys) {
+		key := it.keys[it.pos]
+		it.pos++
+		if value, ok := it.m.Get(key); ok {
+			if it.numVars == 2 {
+				return []interface{}{key, value}, true
+			}
+			return []interface{}{key}, true
+		}
+	}
+	return nil, false
+}
+
+// Called instead of range by a for loop iterating over a call of range. Returns an iterator that counts
+// through the range without creating an array.
+func builtin_rangeIterator(args ...interface{}) interface{} {
+	start, step, count, err := rangeBounds(args)
+	if err != nil {
+		return err
+	}
+	return &iterator{isRange: true, start: start, step: step, count: count}
+}
+
+// Code of the range builtin of every vm
+var rangeBuiltin = reflect.ValueOf((&RuneVM{}).builtin_Range).Pointer()
+
+// Reports whether the function is the range builtin of a vm, not a function of the host or the script
+// that took its name.
+func isRangeBuiltin(fn func(args ...interface{}) interface{}) bool {
+	return reflect.ValueOf(fn).Pointer() == rangeBuiltin
+}
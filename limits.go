@@ -0,0 +1,115 @@
+package runevm
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits caps the resources a script may use while it is executed by Run or Exec.
+// A zero field means the budget is unlimited.
+type Limits struct {
+	// Number of evaluation steps. The tree walker counts evaluated expressions, the bytecode backend
+	// counts executed instructions, so the same script uses a different number of steps on each backend.
+	// Running out of steps is reported at the expression that took the last step, which may differ as well.
+	MaxSteps int
+	// Depth of nested function calls. MaxRecursionDepth always applies, so only smaller values have an effect.
+	MaxCallDepth int
+	// Length in characters of any string produced by the script, counted like the len builtin does.
+	// A character takes up to four bytes.
+	MaxStringLength int
+	// Number of elements of any array or entries of any table produced by the script.
+	MaxCollectionSize int
+	// Number of arrays, tables and functions created by literals, strings built by concatenation or
+	// interpolation, plus every string, array or table returned from a function call.
+	MaxAllocations int
+}
+
+// LimitError is the cause of the RuneError returned when a script exhausts one of its Limits.
+// Use errors.As to retrieve it. Scripts can catch it with try like any other runtime error.
+type LimitError struct {
+	// Name of the exhausted budget, e.g. "MaxSteps"
+	Limit string
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// Tracks the budgets used by a single execution.
+type usage struct {
+	limits Limits
+	steps  int
+	allocs int
+	// Last expression with a source position that took a step
+	last *expression
+}
+
+// Counts n allocations. Returns a LimitError if MaxAllocations is exhausted.
+func (u *usage) allocate(n int) error {
+	if u.limits.MaxAllocations > 0 {
+		u.allocs += n
+		if u.allocs > u.limits.MaxAllocations {
+			return &LimitError{Limit: "MaxAllocations", Max: u.limits.MaxAllocations}
+		}
+	}
+	return nil
+}
+
+// Returns a LimitError if a string of n characters exceeds MaxStringLength.
+func (l Limits) checkString(n int) error {
+	if l.MaxStringLength > 0 && n > l.MaxStringLength {
+		return &LimitError{Limit: "MaxStringLength", Max: l.MaxStringLength}
+	}
+	return nil
+}
+
+// Returns a LimitError if an array or table with n entries exceeds MaxCollectionSize.
+func (l Limits) checkSize(n int) error {
+	if l.MaxCollectionSize > 0 && n > l.MaxCollectionSize {
+		return &LimitError{Limit: "MaxCollectionSize", Max: l.MaxCollectionSize}
+	}
+	return nil
+}
+
+// Returns a LimitError if the given value is a string, array or table that exceeds its limit.
+func (l Limits) checkValue(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return l.checkString(utf8.RuneCountInString(v))
+	case []interface{}:
+		return l.checkSize(len(v))
+	case *Table:
+		return l.checkSize(v.Len())
+	}
+	return nil
+}
+
+// Raises a runtime error at the position of the given expression that wraps the LimitError.
+func limitError(exp *expression, err error) {
+	runeErr := newEvalError(exp, "%v", err)
+	runeErr.Err = err
+	panic(runeErr)
+}
+
+// Counts one evaluation step of the expression. Running out of steps is reported at the expression
+// that took the last one, or the last one before it with a position, e.g. for an empty block.
+func (e *Evaluator) step(exp *expression) {
+	if exp.Line > 0 {
+		e.usage.last = exp
+	}
+	e.usage.steps++
+	if e.usage.steps > e.usage.limits.MaxSteps {
+		limitError(e.usage.last, &LimitError{Limit: "MaxSteps", Max: e.usage.limits.MaxSteps})
+	}
+}
+
+// Counts the allocation of a value and checks its size.
+func (e *Evaluator) alloc(value interface{}, exp *expression) {
+	if err := e.usage.allocate(1); err != nil {
+		limitError(exp, err)
+	}
+	if err := e.usage.limits.checkValue(value); err != nil {
+		limitError(exp, err)
+	}
+}
@@ -0,0 +1,115 @@
+package runevm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMaxStepsPosition(t *testing.T) {
+	// The backends count steps differently, so each reports the expression it was evaluating when the
+	// budget ran out
+	tests := []struct {
+		name     string
+		source   string
+		maxSteps int
+		want     [2]string
+	}{
+		{"statements", "x = 1\ny = 2\nz = 3", 4, [2]string{"test.rune:2:5", "test.rune:2:3"}},
+		{"loop", "x = 1\nwhile true {\n    x = 2\n    x = 3\n}", 100, [2]string{"test.rune:2:7", "test.rune:2:1"}},
+		{"empty loop body", "while true {}", 100, [2]string{"test.rune:1:7", "test.rune:1:7"}},
+		{"loop in a function", "f = fun() {\n    while true {}\n}\nwhile true { f() }", 100, [2]string{"test.rune:2:11", "test.rune:2:5"}},
+	}
+	for _, tt := range tests {
+		for i, backend := range backends {
+			t.Run(tt.name+"/"+backendName(backend), func(t *testing.T) {
+				_, err := runScript(backend, tt.source, withLimits(Limits{MaxSteps: tt.maxSteps}))
+				var limitErr *LimitError
+				if !errors.As(err, &limitErr) || limitErr.Limit != "MaxSteps" {
+					t.Fatalf("got %v, want a MaxSteps error", err)
+				}
+				want := fmt.Sprintf("runtime error (%s): MaxSteps limit of %d exceeded", tt.want[i], tt.maxSteps)
+				// The traceback follows on the next lines
+				if msg, _, _ := strings.Cut(err.Error(), "\n"); msg != want {
+					t.Errorf("got error %q, want %q", msg, want)
+				}
+			})
+		}
+	}
+}
+
+func TestLimitErrorsCanBeCaught(t *testing.T) {
+	source := `try {
+    s = "abc" + "defghijkl"
+} catch e {
+    println(e.message)
+}
+println("after")`
+	out, err := runBoth(t, source, withLimits(Limits{MaxStringLength: 5}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "MaxStringLength limit of 5 exceeded\nafter\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestExhaustedBudgetsStayExhausted(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		limits Limits
+	}{
+		{"steps", `try { while true {} } catch e { println("caught") } finally { println("finally") }`, Limits{MaxSteps: 100}},
+		{"allocations", `try {
+    while true { a = array{} }
+} catch e {
+    println("caught")
+    a = array{}
+}
+println("after")`, Limits{MaxAllocations: 10}},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(tt.name+"/"+backendName(backend), func(t *testing.T) {
+				// The error is raised again where the budget is used next, which differs between the backends
+				out, err := runScript(backend, tt.source, withLimits(tt.limits))
+				var limitErr *LimitError
+				if !errors.As(err, &limitErr) {
+					t.Fatalf("got %v, want a LimitError", err)
+				}
+				if strings.Contains(out, "after") || strings.Contains(out, "finally") {
+					t.Errorf("the script went on after its budget was used up, printed %q", out)
+				}
+			})
+		}
+	}
+}
+
+func TestMaxStringLengthCountsCharacters(t *testing.T) {
+	tests := []string{
+		`"äöü" + "ß€"`,
+		`x = "€€€"` + "\n" + `"${x}ab"`,
+		`format("%s%s", "äö", "üß€")`,
+		`strreplace("aaaaa", "a", "€")`,
+		`append("äöü", "ß€")`,
+	}
+	for _, source := range tests {
+		t.Run(source, func(t *testing.T) {
+			// Five characters fit, although they take more than five bytes
+			if _, err := runBoth(t, source, withLimits(Limits{MaxStringLength: 5})); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			_, err := runBoth(t, source, withLimits(Limits{MaxStringLength: 4}))
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != "MaxStringLength" {
+				t.Errorf("got %v, want a MaxStringLength error", err)
+			}
+		})
+	}
+}
+
+func withLimits(limits Limits) Option {
+	return func(vm *RuneVM) { vm.SetLimits(limits) }
+}
@@ -0,0 +1,545 @@
+package runevm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Largest message body the server accepts. A client announcing a larger one is treated as broken.
+const maxLSPMessageSize = 64 << 20
+
+// JSON-RPC error codes
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+)
+
+// LSP kinds used by the server
+const (
+	lspSeverityError       = 1
+	lspCompletionFunction  = 3
+	lspCompletionVariable  = 6
+	lspCompletionKeyword   = 14
+	lspSymbolFunction      = 12
+	lspSymbolVariable      = 13
+	lspTextDocumentSyncAll = 1
+)
+
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *lspError       `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+}
+
+type lspMarkup struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspHover struct {
+	Contents lspMarkup `json:"contents"`
+	Range    lspRange  `json:"range"`
+}
+
+type lspCompletionItem struct {
+	Label         string     `json:"label"`
+	Kind          int        `json:"kind"`
+	Detail        string     `json:"detail,omitempty"`
+	Documentation *lspMarkup `json:"documentation,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+// Language server for Rune scripts. It keeps the text of the documents open in the editor and analyzes
+// a document again for every request, so the answers always match the current text.
+type lspServer struct {
+	out *bufio.Writer
+	// Open documents by file path
+	docs map[string]*lspDocument
+	// Directories imports are resolved against, after the directory of the importing file
+	importDirs []string
+	builtins   []builtin
+	// Positions are exchanged in UTF-16 code units unless the client supports counting characters
+	utf16 bool
+}
+
+// A document open in the editor. Its lines are split once per version, as positions are converted
+// between the server and the client for every token.
+type lspDocument struct {
+	text  string
+	lines []string
+}
+
+func newLSPDocument(text string) *lspDocument {
+	return &lspDocument{text: text, lines: strings.Split(text, "\n")}
+}
+
+// Runs a language server for Rune scripts on the given streams, usually stdin and stdout of the process.
+// The server speaks the Language Server Protocol and supports diagnostics for syntax errors, go to
+// definition, hover, document symbols and completion. It returns when the client sends the exit
+// notification or closes the input.
+func ServeLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer{
+		out:      bufio.NewWriter(out),
+		docs:     make(map[string]*lspDocument),
+		builtins: NewRuneVM().builtins(),
+		utf16:    true,
+	}
+	reader := bufio.NewReader(in)
+	for {
+		body, err := readLSPMessage(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg lspMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.reply(json.RawMessage("null"), nil, &lspError{lspParseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if msg.Method == "" {
+			// The server never sends requests, so there are no responses to handle
+			continue
+		}
+		result, rpcErr := s.handle(&msg)
+		if len(msg.ID) == 0 {
+			// Notifications get no response
+			continue
+		}
+		if err := s.reply(msg.ID, result, rpcErr); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads the body of the next message, which is preceded by a header holding its length. A body larger than
+// maxLSPMessageSize is an error.
+func readLSPMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid Content-Length header: %s", line)
+			}
+			if length > maxLSPMessageSize {
+				return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", length, maxLSPMessageSize)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *lspServer) write(msg *lspMessage) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(body))
+	s.out.Write(body)
+	return s.out.Flush()
+}
+
+func (s *lspServer) reply(id json.RawMessage, result interface{}, rpcErr *lspError) error {
+	if rpcErr != nil {
+		return s.write(&lspMessage{ID: id, Error: rpcErr})
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return s.write(&lspMessage{ID: id, Result: body})
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.write(&lspMessage{Method: method, Params: body})
+}
+
+// Handles a request or notification and returns the result of a request.
+func (s *lspServer) handle(msg *lspMessage) (interface{}, *lspError) {
+	var params struct {
+		RootURI        string          `json:"rootUri"`
+		TextDocument   lspTextDocument `json:"textDocument"`
+		Position       lspPosition     `json:"position"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+		Capabilities struct {
+			General struct {
+				PositionEncodings []string `json:"positionEncodings"`
+			} `json:"general"`
+		} `json:"capabilities"`
+	}
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+	}
+	path := uriToPath(params.TextDocument.URI)
+
+	switch msg.Method {
+	case "initialize":
+		if params.RootURI != "" {
+			s.importDirs = []string{uriToPath(params.RootURI)}
+		}
+		// Columns are counted in characters, which is UTF-32. Clients that don't support it get UTF-16.
+		encoding := "utf-16"
+		for _, offered := range params.Capabilities.General.PositionEncodings {
+			if offered == "utf-32" {
+				encoding = "utf-32"
+				s.utf16 = false
+			}
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"positionEncoding":       encoding,
+				"textDocumentSync":       lspTextDocumentSyncAll,
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]interface{}{},
+			},
+			"serverInfo": map[string]string{"name": "rune", "version": Version},
+		}, nil
+	case "initialized", "shutdown", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "textDocument/didOpen":
+		s.docs[path] = newLSPDocument(params.TextDocument.Text)
+		s.publishDiagnostics(path)
+		return nil, nil
+	case "textDocument/didChange":
+		// The server asks for full text synchronization, so the last change holds the whole document
+		if n := len(params.ContentChanges); n > 0 {
+			s.docs[path] = newLSPDocument(params.ContentChanges[n-1].Text)
+		}
+		s.publishDiagnostics(path)
+		return nil, nil
+	case "textDocument/didClose":
+		delete(s.docs, path)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": pathToURI(path), "diagnostics": []lspDiagnostic{}})
+		return nil, nil
+	case "textDocument/definition":
+		return s.definition(path, params.Position), nil
+	case "textDocument/hover":
+		return s.hover(path, params.Position), nil
+	case "textDocument/documentSymbol":
+		return s.documentSymbols(path), nil
+	case "textDocument/completion":
+		return s.completion(path, params.Position), nil
+	default:
+		return nil, &lspError{lspMethodNotFound, "Method not supported: " + msg.Method}
+	}
+}
+
+// Returns the text of an open document or reads the file from disk.
+func (s *lspServer) readFile(path string) (string, bool) {
+	if doc, ok := s.docs[path]; ok {
+		return doc.text, true
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return string(source), true
+}
+
+// Parses and analyzes the document at the given path.
+func (s *lspServer) analyze(path string) (*analysis, []SyntaxError) {
+	text, _ := s.readFile(path)
+	prog, errs := Parse(text, path)
+	return analyzeFile(prog.ast, path, s.readFile, s.importDirs), errs
+}
+
+func (s *lspServer) publishDiagnostics(path string) {
+	_, errs := s.analyze(path)
+	diagnostics := []lspDiagnostic{}
+	for _, err := range errs {
+		diagnostics = append(diagnostics, lspDiagnostic{
+			Range:    s.toLSPRange(path, err.Line, err.Col, err.Length),
+			Severity: lspSeverityError,
+			Source:   "rune",
+			Message:  err.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": pathToURI(path), "diagnostics": diagnostics})
+}
+
+func (s *lspServer) definition(path string, pos lspPosition) interface{} {
+	a, _ := s.analyze(path)
+	line, col := s.fromLSPPosition(path, pos)
+	if ref := a.refAt(line, col); ref != nil && ref.sym != nil {
+		return lspLocation{URI: pathToURI(ref.sym.file), Range: s.toLSPRange(ref.sym.file, ref.sym.line, ref.sym.col, ref.sym.length)}
+	}
+	if imp := a.importAt(line, col); imp != nil && imp.path != "" {
+		return lspLocation{URI: pathToURI(imp.path), Range: s.toLSPRange(imp.path, 1, 1, 0)}
+	}
+	return nil
+}
+
+func (s *lspServer) hover(path string, pos lspPosition) interface{} {
+	a, _ := s.analyze(path)
+	line, col := s.fromLSPPosition(path, pos)
+	ref := a.refAt(line, col)
+	if ref == nil {
+		return nil
+	}
+	var text string
+	if ref.sym != nil {
+		text = "```rune\n" + ref.sym.describe() + "\n```"
+		if ref.sym.file != path {
+			text += fmt.Sprintf("\n\nDefined in `%s:%d`", ref.sym.file, ref.sym.line)
+		}
+	} else if b, ok := s.builtin(ref.name); ok {
+		text = "```rune\n" + b.signature + "\n```\n\n" + b.doc
+	} else {
+		return nil
+	}
+	return lspHover{Contents: lspMarkup{Kind: "markdown", Value: text}, Range: s.toLSPRange(path, ref.line, ref.col, ref.length)}
+}
+
+func (s *lspServer) documentSymbols(path string) interface{} {
+	a, _ := s.analyze(path)
+	return s.scopeSymbols(a.root, path)
+}
+
+// Returns the symbols the scope defines in the given file. Functions hold their parameters and locals.
+func (s *lspServer) scopeSymbols(sc *scope, path string) []lspDocumentSymbol {
+	symbols := []lspDocumentSymbol{}
+	for _, sym := range sc.symbols {
+		if sym.file != path {
+			continue
+		}
+		selection := s.toLSPRange(path, sym.line, sym.col, sym.length)
+		docSym := lspDocumentSymbol{Name: sym.name, Kind: lspSymbolVariable, Range: selection, SelectionRange: selection}
+		if sym.kind == functionSymbol {
+			docSym.Kind = lspSymbolFunction
+			docSym.Detail = sym.describe()
+			docSym.Range.End = lspPosition{Line: sym.fun.EndLine - 1, Character: s.toLSPCharacter(path, sym.fun.EndLine, sym.fun.EndCol)}
+			if sym.locals != nil {
+				docSym.Children = s.scopeSymbols(sym.locals, path)
+			}
+		}
+		symbols = append(symbols, docSym)
+	}
+	return symbols
+}
+
+// Completes the names visible at the position: variables and functions of the script, builtins and keywords.
+func (s *lspServer) completion(path string, pos lspPosition) interface{} {
+	a, _ := s.analyze(path)
+	line, col := s.fromLSPPosition(path, pos)
+	items := []lspCompletionItem{}
+	seen := make(map[string]bool)
+	for _, sym := range a.scopeAt(line, col).visible() {
+		seen[sym.name] = true
+		kind := lspCompletionVariable
+		if sym.kind == functionSymbol {
+			kind = lspCompletionFunction
+		}
+		items = append(items, lspCompletionItem{Label: sym.name, Kind: kind, Detail: sym.describe()})
+	}
+	for _, b := range s.builtins {
+		if !seen[b.name] {
+			items = append(items, lspCompletionItem{
+				Label:         b.name,
+				Kind:          lspCompletionFunction,
+				Detail:        b.signature,
+				Documentation: &lspMarkup{Kind: "markdown", Value: b.doc},
+			})
+		}
+	}
+	var kws []string
+	for kw := range keywords {
+		kws = append(kws, kw)
+	}
+	sort.Strings(kws)
+	for _, kw := range kws {
+		items = append(items, lspCompletionItem{Label: kw, Kind: lspCompletionKeyword})
+	}
+	return items
+}
+
+func (s *lspServer) builtin(name string) (builtin, bool) {
+	for _, b := range s.builtins {
+		if b.name == name {
+			return b, true
+		}
+	}
+	return builtin{}, false
+}
+
+// Converts a zero-based LSP position in the given file to the one-based line and column of a token.
+func (s *lspServer) fromLSPPosition(path string, pos lspPosition) (int, int) {
+	if !s.utf16 {
+		return pos.Line + 1, pos.Character + 1
+	}
+	col, units := 1, 0
+	for _, r := range s.lineText(path, pos.Line+1) {
+		if units >= pos.Character {
+			break
+		}
+		units += utf16Len(r)
+		col++
+	}
+	// Positions past the end of the line count one column per code unit
+	return pos.Line + 1, col + max(pos.Character-units, 0)
+}
+
+// Returns the LSP range of a token in the given file at the given one-based line and column.
+func (s *lspServer) toLSPRange(path string, line, col, length int) lspRange {
+	return lspRange{
+		Start: lspPosition{Line: line - 1, Character: s.toLSPCharacter(path, line, col)},
+		End:   lspPosition{Line: line - 1, Character: s.toLSPCharacter(path, line, col+length)},
+	}
+}
+
+// Converts a one-based column of the given line to a zero-based LSP character offset.
+func (s *lspServer) toLSPCharacter(path string, line, col int) int {
+	if !s.utf16 {
+		return col - 1
+	}
+	units, n := 0, 1
+	for _, r := range s.lineText(path, line) {
+		if n >= col {
+			break
+		}
+		units += utf16Len(r)
+		n++
+	}
+	return units + max(col-n, 0)
+}
+
+// Returns the text of a one-based line of the given file, "" if there is no such line. Files that aren't
+// open are read from disk every time, as they may change.
+func (s *lspServer) lineText(path string, line int) string {
+	doc, ok := s.docs[path]
+	if !ok {
+		text, _ := s.readFile(path)
+		doc = newLSPDocument(text)
+	}
+	if line < 1 || line > len(doc.lines) {
+		return ""
+	}
+	return doc.lines[line-1]
+}
+
+// Returns the number of UTF-16 code units of the character.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// Returns the file path of a file URI.
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	path := u.Path
+	// Windows paths look like /C:/dir/file.rune in URIs
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+// Returns the file URI of a file path.
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
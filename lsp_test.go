@@ -0,0 +1,342 @@
+package runevm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Talks JSON-RPC to a language server running on in-memory pipes.
+type lspTestClient struct {
+	t  *testing.T
+	in *io.PipeWriter
+	// Messages from the server, read in the background so the server never blocks on writing
+	messages chan lspMessage
+	nextID   int
+	// Notifications the server sent while the client waited for responses
+	notifications []lspMessage
+	done          chan error
+}
+
+func newLSPTestClient(t *testing.T) *lspTestClient {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	c := &lspTestClient{t: t, in: inWriter, messages: make(chan lspMessage, 100), done: make(chan error, 1)}
+	go func() {
+		err := ServeLSP(inReader, outWriter)
+		outWriter.Close()
+		c.done <- err
+	}()
+	go func() {
+		defer close(c.messages)
+		out := bufio.NewReader(outReader)
+		for {
+			body, err := readLSPMessage(out)
+			if err != nil {
+				return
+			}
+			var msg lspMessage
+			if json.Unmarshal(body, &msg) == nil {
+				c.messages <- msg
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		c.send(&lspMessage{Method: "exit"})
+		c.in.Close()
+		select {
+		case err := <-c.done:
+			if err != nil {
+				t.Errorf("server failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("server didn't exit")
+		}
+	})
+	return c
+}
+
+func (c *lspTestClient) send(msg *lspMessage) {
+	c.t.Helper()
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspTestClient) params(params interface{}) json.RawMessage {
+	c.t.Helper()
+	body, err := json.Marshal(params)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return body
+}
+
+func (c *lspTestClient) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.send(&lspMessage{Method: method, Params: c.params(params)})
+}
+
+// Sends a request and decodes the result of its response into result.
+func (c *lspTestClient) request(method string, params interface{}, result interface{}) {
+	c.t.Helper()
+	c.nextID++
+	id := json.RawMessage(fmt.Sprint(c.nextID))
+	c.send(&lspMessage{ID: id, Method: method, Params: c.params(params)})
+	for {
+		var msg lspMessage
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("server closed the connection before responding to %s", method)
+			}
+			msg = m
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("no response to %s", method)
+		}
+		if len(msg.ID) == 0 {
+			c.notifications = append(c.notifications, msg)
+			continue
+		}
+		if string(msg.ID) != string(id) {
+			c.t.Fatalf("got response to request %s, want %s", msg.ID, id)
+		}
+		if msg.Error != nil {
+			c.t.Fatalf("%s failed: %s", method, msg.Error.Message)
+		}
+		if err := json.Unmarshal(msg.Result, result); err != nil {
+			c.t.Fatalf("decoding the result of %s: %v", method, err)
+		}
+		return
+	}
+}
+
+// Initializes the server and opens a document with the given text. Returns the URI of the document.
+func (c *lspTestClient) open(encodings []string, text string) string {
+	c.t.Helper()
+	var init struct {
+		Capabilities map[string]interface{} `json:"capabilities"`
+	}
+	c.request("initialize", map[string]interface{}{
+		"capabilities": map[string]interface{}{"general": map[string]interface{}{"positionEncodings": encodings}},
+	}, &init)
+	c.notify("initialized", map[string]interface{}{})
+	uri := pathToURI(filepath.Join(c.t.TempDir(), "main.rune"))
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "rune", "version": 1, "text": text},
+	})
+	return uri
+}
+
+func positionParams(uri string, line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     lspPosition{Line: line, Character: character},
+	}
+}
+
+const lspTestScript = `greet = fun(name) {
+    message = "Hello " + name
+    println(message)
+}
+count = 1
+greet("Ann")
+count = count + 1
+`
+
+func TestLSPInitialize(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{nil, "utf-16"},
+		{[]string{"utf-16"}, "utf-16"},
+		{[]string{"utf-8", "utf-32", "utf-16"}, "utf-32"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.offered, ","), func(t *testing.T) {
+			c := newLSPTestClient(t)
+			var result struct {
+				Capabilities struct {
+					PositionEncoding       string `json:"positionEncoding"`
+					HoverProvider          bool   `json:"hoverProvider"`
+					DefinitionProvider     bool   `json:"definitionProvider"`
+					DocumentSymbolProvider bool   `json:"documentSymbolProvider"`
+				} `json:"capabilities"`
+			}
+			c.request("initialize", map[string]interface{}{
+				"capabilities": map[string]interface{}{"general": map[string]interface{}{"positionEncodings": tt.offered}},
+			}, &result)
+			caps := result.Capabilities
+			if caps.PositionEncoding != tt.want {
+				t.Errorf("got position encoding %q, want %q", caps.PositionEncoding, tt.want)
+			}
+			if !caps.HoverProvider || !caps.DefinitionProvider || !caps.DocumentSymbolProvider {
+				t.Errorf("missing capabilities: %+v", caps)
+			}
+		})
+	}
+}
+
+func TestLSPDiagnostics(t *testing.T) {
+	c := newLSPTestClient(t)
+	uri := c.open(nil, "x = (1 +\ny = 2\n")
+	// The diagnostics are sent before the response to the next request
+	var symbols []lspDocumentSymbol
+	c.request("textDocument/documentSymbol", positionParams(uri, 0, 0), &symbols)
+	for _, msg := range c.notifications {
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params struct {
+			URI         string          `json:"uri"`
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			t.Fatal(err)
+		}
+		if params.URI == uri && len(params.Diagnostics) > 0 {
+			return
+		}
+	}
+	t.Errorf("got no diagnostics for the syntax error, notifications: %+v", c.notifications)
+}
+
+func TestLSPHover(t *testing.T) {
+	c := newLSPTestClient(t)
+	uri := c.open(nil, lspTestScript)
+
+	var hover lspHover
+	c.request("textDocument/hover", positionParams(uri, 5, 1), &hover)
+	if !strings.Contains(hover.Contents.Value, "greet(name)") {
+		t.Errorf("hover over greet shows %q, want the signature", hover.Contents.Value)
+	}
+	if want := (lspRange{Start: lspPosition{5, 0}, End: lspPosition{5, 5}}); hover.Range != want {
+		t.Errorf("got hover range %+v, want %+v", hover.Range, want)
+	}
+
+	c.request("textDocument/hover", positionParams(uri, 2, 5), &hover)
+	if !strings.Contains(hover.Contents.Value, "println(") {
+		t.Errorf("hover over println shows %q, want the builtin signature", hover.Contents.Value)
+	}
+}
+
+func TestLSPDefinition(t *testing.T) {
+	c := newLSPTestClient(t)
+	uri := c.open(nil, lspTestScript)
+
+	var loc lspLocation
+	c.request("textDocument/definition", positionParams(uri, 2, 13), &loc)
+	want := lspLocation{URI: uri, Range: lspRange{Start: lspPosition{1, 4}, End: lspPosition{1, 11}}}
+	if loc != want {
+		t.Errorf("definition of message is %+v, want %+v", loc, want)
+	}
+
+	c.request("textDocument/definition", positionParams(uri, 6, 9), &loc)
+	want = lspLocation{URI: uri, Range: lspRange{Start: lspPosition{4, 0}, End: lspPosition{4, 5}}}
+	if loc != want {
+		t.Errorf("definition of count is %+v, want %+v", loc, want)
+	}
+}
+
+func TestLSPDocumentSymbols(t *testing.T) {
+	c := newLSPTestClient(t)
+	uri := c.open(nil, lspTestScript)
+
+	var symbols []lspDocumentSymbol
+	c.request("textDocument/documentSymbol", positionParams(uri, 0, 0), &symbols)
+	if len(symbols) != 2 || symbols[0].Name != "greet" || symbols[1].Name != "count" {
+		t.Fatalf("got symbols %+v, want greet and count", symbols)
+	}
+	greet := symbols[0]
+	if greet.Kind != lspSymbolFunction || greet.Range.End != (lspPosition{3, 1}) {
+		t.Errorf("got %+v, want a function ending at 3:1", greet)
+	}
+	var children []string
+	for _, child := range greet.Children {
+		children = append(children, child.Name)
+	}
+	if strings.Join(children, ",") != "name,message" {
+		t.Errorf("got children %v of greet, want name and message", children)
+	}
+}
+
+// Characters outside of the Basic Multilingual Plane take two UTF-16 code units but one column.
+func TestLSPPositionEncoding(t *testing.T) {
+	script := "größe = 1\nprintln(\"😀😀\", größe)\n"
+	tests := []struct {
+		encodings []string
+		// Start and end character of größe in the second line
+		start, end int
+	}{
+		{nil, 16, 21},
+		{[]string{"utf-32"}, 14, 19},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.encodings), func(t *testing.T) {
+			c := newLSPTestClient(t)
+			uri := c.open(tt.encodings, script)
+
+			var loc lspLocation
+			c.request("textDocument/definition", positionParams(uri, 1, tt.start+1), &loc)
+			if want := (lspRange{Start: lspPosition{0, 0}, End: lspPosition{0, 5}}); loc.Range != want {
+				t.Errorf("got definition at %+v, want %+v", loc.Range, want)
+			}
+
+			var hover lspHover
+			c.request("textDocument/hover", positionParams(uri, 1, tt.end-1), &hover)
+			if want := (lspRange{Start: lspPosition{1, tt.start}, End: lspPosition{1, tt.end}}); hover.Range != want {
+				t.Errorf("got hover range %+v, want %+v", hover.Range, want)
+			}
+		})
+	}
+}
+
+func TestLSPMessageTooLarge(t *testing.T) {
+	input := fmt.Sprintf("Content-Length: %d\r\n\r\n{}", maxLSPMessageSize+1)
+	_, err := readLSPMessage(bufio.NewReader(strings.NewReader(input)))
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("got error %v, want the message to exceed the limit", err)
+	}
+	for _, header := range []string{"Content-Length: -5", "Content-Length: abc"} {
+		_, err := readLSPMessage(bufio.NewReader(strings.NewReader(header + "\r\n\r\n{}")))
+		if err == nil || !strings.Contains(err.Error(), "invalid Content-Length") {
+			t.Errorf("%s: got error %v, want an invalid header", header, err)
+		}
+	}
+	if err := ServeLSP(strings.NewReader(input), io.Discard); err == nil {
+		t.Error("the server accepted a message above the limit")
+	}
+}
+
+// Positions are converted with the lines of the current version of a document
+func TestLSPPositionsAfterChange(t *testing.T) {
+	c := newLSPTestClient(t)
+	uri := c.open(nil, "f = 1\n")
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": "\"😀\" + f()\nf = fun() {}\ny = \"😀\" + f()\n"}},
+	})
+
+	// The emoji takes two UTF-16 code units
+	var hover lspHover
+	c.request("textDocument/hover", positionParams(uri, 2, 11), &hover)
+	if want := (lspRange{Start: lspPosition{2, 11}, End: lspPosition{2, 12}}); hover.Range != want {
+		t.Errorf("got hover range %+v, want %+v", hover.Range, want)
+	}
+	var loc lspLocation
+	c.request("textDocument/definition", positionParams(uri, 0, 7), &loc)
+	if want := (lspRange{Start: lspPosition{1, 0}, End: lspPosition{1, 1}}); loc.Range != want {
+		t.Errorf("got definition at %+v, want %+v", loc.Range, want)
+	}
+}
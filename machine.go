@@ -0,0 +1,357 @@
+package runevm
+
+// Holds a local variable that is shared between a function and the closures created within it.
+type cell struct {
+	value interface{}
+}
+
+type frame struct {
+	proto  *funcProto
+	env    *Environment
+	upvals []*cell
+	cells  []*cell
+	// Index of the first local slot in the evaluator's value stack
+	base int
+	// Handlers of the try and catch blocks that are currently executed, innermost last
+	handlers []handler
+}
+
+// Continues the execution at pc with the caught error pushed if a catchable error is raised.
+type handler struct {
+	pc int
+	// Size of the value stack when the handler was installed
+	depth int
+}
+
+func (e *Evaluator) push(value interface{}) {
+	e.stack = append(e.stack, value)
+}
+
+func (e *Evaluator) pop() interface{} {
+	value := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return value
+}
+
+// Pops n values and returns them as a new slice.
+func (e *Evaluator) popN(n int) []interface{} {
+	values := make([]interface{}, n)
+	copy(values, e.stack[len(e.stack)-n:])
+	e.stack = e.stack[:len(e.stack)-n]
+	return values
+}
+
+// Executes a compiled program in the given environment.
+func (e *Evaluator) runProto(proto *funcProto, env *Environment) interface{} {
+	return e.callProto(proto, env, nil, nil)
+}
+
+func (e *Evaluator) makeClosure(proto *funcProto, env *Environment, upvals []*cell) func(args ...interface{}) interface{} {
+	return func(args ...interface{}) interface{} {
+		return e.callProto(proto, env, upvals, args)
+	}
+}
+
+func (e *Evaluator) callProto(proto *funcProto, env *Environment, upvals []*cell, args []interface{}) interface{} {
+	f := &frame{proto: proto, env: env, upvals: upvals, base: len(e.stack)}
+	defer e.truncate(f.base)
+
+	if proto.newScope {
+		f.env = env.extend()
+	}
+	// Missing arguments default to nil, extra arguments are ignored. The other locals start out undefined.
+	for i := 0; i < proto.numLocals; i++ {
+		if i < len(args) && i < proto.numParams {
+			e.push(args[i])
+		} else if i < proto.numParams {
+			e.push(nil)
+		} else {
+			e.push(undefinedLocal{})
+		}
+	}
+	if proto.hasCells {
+		f.cells = make([]*cell, proto.numLocals)
+		for slot, captured := range proto.captured {
+			if captured {
+				f.cells[slot] = &cell{value: e.stack[f.base+slot]}
+			}
+		}
+	}
+	return e.run(f)
+}
+
+func (e *Evaluator) truncate(size int) {
+	e.stack = e.stack[:size]
+}
+
+func (e *Evaluator) run(f *frame) interface{} {
+	if !f.proto.hasTry {
+		return e.exec(f, 0)
+	}
+	pc := 0
+	for {
+		result, caught := e.execProtected(f, pc)
+		if caught == nil {
+			return result
+		}
+		// Continue at the handler of the innermost try or catch block
+		h := f.handlers[len(f.handlers)-1]
+		f.handlers = f.handlers[:len(f.handlers)-1]
+		e.truncate(h.depth)
+		e.push(caught)
+		pc = h.pc
+	}
+}
+
+// Executes the frame from pc on. Returns the error if the frame has a handler that can catch it.
+func (e *Evaluator) execProtected(f *frame, pc int) (result interface{}, caught *RuneError) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err, ok := catchable(rec)
+			if !ok || len(f.handlers) == 0 {
+				panic(rec)
+			}
+			caught = err
+		}
+	}()
+	return e.exec(f, pc), nil
+}
+
+func (e *Evaluator) exec(f *frame, start int) interface{} {
+	proto := f.proto
+	code := proto.code
+	for pc := start; pc < len(code); pc++ {
+		ins := code[pc]
+		if e.usage.limits.MaxSteps > 0 {
+			e.step(proto.exprs[pc])
+		}
+		switch ins.op {
+		case opConst:
+			e.push(proto.consts[ins.arg])
+
+		case opPop:
+			e.stack = e.stack[:len(e.stack)-1]
+
+		case opPopN:
+			e.stack = e.stack[:len(e.stack)-ins.arg]
+
+		case opDup:
+			e.push(e.stack[len(e.stack)-1])
+
+		case opGetVar:
+			e.push(f.env.get(proto.names[ins.arg], proto.exprs[pc]))
+
+		case opSetVar:
+			f.env.set(proto.names[ins.arg], e.stack[len(e.stack)-1])
+
+		case opGetLocal:
+			e.push(e.stack[f.base+ins.arg])
+
+		case opSetLocal:
+			e.stack[f.base+ins.arg] = e.stack[len(e.stack)-1]
+
+		case opGetCell:
+			e.push(f.cells[ins.arg].value)
+
+		case opSetCell:
+			f.cells[ins.arg].value = e.stack[len(e.stack)-1]
+
+		case opGetUpval:
+			e.push(f.upvals[ins.arg].value)
+
+		case opSetUpval:
+			f.upvals[ins.arg].value = e.stack[len(e.stack)-1]
+
+		case opGetPath:
+			e.push(e.getPath(f, proto.paths[ins.arg], proto.exprs[pc]))
+
+		case opSetPath:
+			e.setPath(f, proto.paths[ins.arg], e.stack[len(e.stack)-1])
+
+		case opGetIndex:
+			index := e.pop()
+			container := e.pop()
+			e.push(indexValue(container, index, proto.exprs[pc]))
+
+		case opSetIndex:
+			value := e.pop()
+			index := e.pop()
+			container := e.pop()
+			e.push(e.setIndexValue(container, index, value, proto.exprs[pc]))
+
+		case opDup2:
+			e.push(e.stack[len(e.stack)-2])
+			e.push(e.stack[len(e.stack)-2])
+
+		case opBinary:
+			b := e.pop()
+			a := e.pop()
+			op := proto.exprs[pc].Operator
+			if proto.exprs[pc].Type == assignExpr {
+				op = compoundOperator(proto.exprs[pc])
+			}
+			e.push(e.applyBinaryOp(op, a, b, proto.exprs[pc]))
+
+		case opUnary:
+			e.stack[len(e.stack)-1] = applyUnaryOp(proto.exprs[pc].Operator, e.stack[len(e.stack)-1], proto.exprs[pc])
+
+		case opJump:
+			if ins.arg <= pc {
+				// Jumping backwards starts the next loop iteration
+				e.checkContext(proto.exprs[pc])
+			}
+			pc = ins.arg - 1
+
+		case opJumpIfFalse:
+			if !isTruthy(e.pop()) {
+				pc = ins.arg - 1
+			}
+
+		case opJumpIfNotNil:
+			if e.stack[len(e.stack)-1] != nil {
+				pc = ins.arg - 1
+			} else {
+				e.stack = e.stack[:len(e.stack)-1]
+			}
+
+		case opInterp:
+			e.push(e.interpolate(e.popN(ins.arg), proto.exprs[pc]))
+
+		case opIter:
+			e.stack[len(e.stack)-1] = newIterator(e.stack[len(e.stack)-1], ins.arg, proto.exprs[pc])
+
+		case opIterNext:
+			values, ok := e.stack[len(e.stack)-1].(*iterator).next()
+			if !ok {
+				pc = ins.arg - 1
+				continue
+			}
+			e.stack = append(e.stack, values...)
+
+		case opTry:
+			f.handlers = append(f.handlers, handler{pc: ins.arg, depth: len(e.stack)})
+
+		case opEndTry:
+			f.handlers = f.handlers[:len(f.handlers)-1]
+
+		case opCatch:
+			e.stack[len(e.stack)-1] = errorTable(e.stack[len(e.stack)-1].(*RuneError))
+
+		case opRethrow:
+			panic(e.pop())
+
+		case opArray:
+			arr := e.popN(ins.arg)
+			e.alloc(arr, proto.exprs[pc])
+			e.push(arr)
+
+		case opTable:
+			pairs := e.popN(2 * ins.arg)
+			t := NewTable()
+			for i := 0; i < len(pairs); i += 2 {
+				t.Set(formatValue(pairs[i]), pairs[i+1])
+			}
+			e.alloc(t, proto.exprs[pc])
+			e.push(t)
+
+		case opClosure:
+			child := proto.protos[ins.arg]
+			upvals := make([]*cell, len(child.upvals))
+			for i, desc := range child.upvals {
+				if desc.local {
+					upvals[i] = f.cells[desc.index]
+				} else {
+					upvals[i] = f.upvals[desc.index]
+				}
+			}
+			fn := e.makeClosure(child, f.env, upvals)
+			e.alloc(fn, proto.exprs[pc])
+			e.push(fn)
+
+		case opCall:
+			args := e.popN(ins.arg)
+			fn := e.pop()
+			e.push(e.callFunction(fn, args, proto.exprs[pc]))
+
+		case opCallMethod:
+			args := e.popN(ins.arg)
+			fn := e.pop()
+			container := e.pop()
+			// Inject the table the function is called on as the 'self' argument
+			if caller, ok := container.(*Table); ok {
+				args = append([]interface{}{caller}, args...)
+			}
+			e.push(e.callFunction(fn, args, proto.exprs[pc]))
+
+		case opReturn:
+			return e.pop()
+
+		case opImport:
+			importProg := e.loadImport(e.pop(), proto.exprs[pc])
+			importProto, err := importProg.bytecode()
+			if err != nil {
+				panic(err)
+			}
+			e.runProto(importProto, f.env)
+			e.push(nil)
+
+		default:
+			evalError(proto.exprs[pc], "Unknown instruction %d", ins.op)
+		}
+	}
+	return false
+}
+
+// Returns the local, upvalue or cell of the frame at the place, nil for the Environment.
+func (e *Evaluator) varCell(f *frame, place varPlace) (*interface{}, bool) {
+	switch place.location {
+	case localLocation:
+		if f.cells != nil && f.cells[place.index] != nil {
+			return &f.cells[place.index].value, true
+		}
+		return &e.stack[f.base+place.index], true
+	case upvalLocation:
+		return &f.upvals[place.index].value, true
+	}
+	return nil, false
+}
+
+// Returns the value of the first place along the path that defines the variable.
+func (e *Evaluator) getPath(f *frame, path []varPlace, exp *expression) interface{} {
+	for _, place := range path {
+		ref, ok := e.varCell(f, place)
+		if !ok {
+			return f.env.get(f.proto.names[place.index], exp)
+		}
+		if _, undefined := (*ref).(undefinedLocal); !undefined {
+			return *ref
+		}
+	}
+	evalError(exp, "Undefined variable '%s'", exp.Value)
+	return nil
+}
+
+// Assigns the value to the first place along the path that defines the variable. If none does, the
+// variable is defined in the innermost place, like the tree walker defines it in the current scope.
+func (e *Evaluator) setPath(f *frame, path []varPlace, value interface{}) {
+	for _, place := range path {
+		ref, ok := e.varCell(f, place)
+		if !ok {
+			name := f.proto.names[place.index]
+			if scope := f.env.lookup(name); scope != nil {
+				scope.vars[name] = value
+				return
+			}
+			break
+		}
+		if _, undefined := (*ref).(undefinedLocal); !undefined {
+			*ref = value
+			return
+		}
+	}
+	if ref, ok := e.varCell(f, path[0]); ok && path[0].location == localLocation {
+		*ref = value
+		return
+	}
+	f.env.def(f.proto.names[path[len(path)-1].index], value)
+}
@@ -0,0 +1,152 @@
+package runevm
+
+import "math"
+
+// Rune has two number types: int, a 64-bit signed integer stored as Go int, and float, stored as float64.
+// Arithmetic on two ints stays exact and raises an error instead of silently overflowing. As soon as one
+// operand is a float, the other one is converted and the result is a float. '/' always divides as floats,
+// '//' is the integer division that truncates toward zero.
+
+// Converts a value to an int or float64. Numeric strings are parsed, any other type is an error.
+func toNumber(x interface{}, exp *expression) interface{} {
+	switch v := x.(type) {
+	case int, float64:
+		return v
+	case string:
+		return parseNumber(v, exp)
+	}
+	if n, ok := normalizeNumber(x); ok {
+		return n
+	}
+	evalError(exp, "Expected number but got %s", typeName(x))
+	return nil
+}
+
+// Converts the numeric types Go functions may return to int or float64.
+func normalizeNumber(x interface{}) (interface{}, bool) {
+	switch v := x.(type) {
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case uint:
+		if uint64(v) <= math.MaxInt64 {
+			return int(v), true
+		}
+		return float64(v), true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int(v), true
+		}
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	}
+	return x, false
+}
+
+// Converts ints and floats to float64. Reports false for any other type.
+func toFloat(x interface{}) (float64, bool) {
+	if n, ok := normalizeNumber(x); ok {
+		x = n
+	}
+	switch v := x.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Converts the result of toNumber to float64.
+func asFloat(x interface{}) float64 {
+	if i, ok := x.(int); ok {
+		return float64(i)
+	}
+	return x.(float64)
+}
+
+func intArith(op string, x, y int, exp *expression) interface{} {
+	switch op {
+	case "+":
+		r := x + y
+		if (x^r)&(y^r) < 0 {
+			evalError(exp, "Integer overflow: %d + %d", x, y)
+		}
+		return r
+	case "-":
+		r := x - y
+		if (x^y)&(x^r) < 0 {
+			evalError(exp, "Integer overflow: %d - %d", x, y)
+		}
+		return r
+	case "*":
+		if x == 0 || y == 0 {
+			return 0
+		}
+		r := x * y
+		if r/y != x || (x == -1 && y == math.MinInt) || (y == -1 && x == math.MinInt) {
+			evalError(exp, "Integer overflow: %d * %d", x, y)
+		}
+		return r
+	case "/":
+		if y == 0 {
+			evalError(exp, "Divide by zero")
+		}
+		return float64(x) / float64(y)
+	case "//":
+		if y == 0 {
+			evalError(exp, "Divide by zero")
+		}
+		if x == math.MinInt && y == -1 {
+			evalError(exp, "Integer overflow: %d // %d", x, y)
+		}
+		return x / y
+	case "%":
+		if y == 0 {
+			evalError(exp, "Divide by zero")
+		}
+		return x % y
+	}
+	evalError(exp, "Can't apply operator %s", op)
+	return nil
+}
+
+func floatArith(op string, x, y float64, exp *expression) interface{} {
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		if y == 0 {
+			evalError(exp, "Divide by zero")
+		}
+		return x / y
+	case "//":
+		if y == 0 {
+			evalError(exp, "Divide by zero")
+		}
+		return math.Trunc(x / y)
+	case "%":
+		if y == 0 {
+			evalError(exp, "Divide by zero")
+		}
+		return math.Mod(x, y)
+	}
+	evalError(exp, "Can't apply operator %s", op)
+	return nil
+}
@@ -0,0 +1,84 @@
+package runevm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNumericSemantics(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		// Two ints give an int, exact beyond the 53 bits of a float
+		{"int plus int", "2 + 3", "5 int"},
+		{"large ints stay exact", "9007199254740993 + 0", "9007199254740993 int"},
+		{"max int", "9223372036854775806 + 1", "9223372036854775807 int"},
+		{"min int", "-9223372036854775807 - 1", "-9223372036854775808 int"},
+		{"int times int", "3037000499 * 3037000499", "9223372030926249001 int"},
+
+		// A float operand makes the result a float
+		{"float plus float", "2.0 + 3.0", "5 float"},
+		{"int plus float", "1 + 0.5", "1.5 float"},
+		{"float times int", "1.0 * 4", "4 float"},
+		{"int minus float", "3 - 1.0", "2 float"},
+		{"compound assignment promotes", "x = 5\nx += 2.5\nx", "7.5 float"},
+
+		// / always divides as floats, // is the truncating integer division
+		{"slash on ints", "7 / 2", "3.5 float"},
+		{"slash without remainder", "6 / 3", "2 float"},
+		{"int division", "7 // 2", "3 int"},
+		{"int division truncates toward zero", "-7 // 2", "-3 int"},
+		{"int division of a float", "7.5 // 2", "3 float"},
+		{"remainder", "-7 % 3", "-1 int"},
+		{"remainder matches division", "a = -7\nb = 2\n(a // b) * b + a % b", "-7 int"},
+		{"float remainder", "7.5 % 2", "1.5 float"},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(tt.name+"/"+backendName(backend), func(t *testing.T) {
+				lines := strings.Split(tt.source, "\n")
+				last := len(lines) - 1
+				lines[last] = "result = " + lines[last] + "\nprint(result, \" \", typeof(result))"
+				out, err := runScript(backend, strings.Join(lines, "\n"))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if out != tt.want {
+					t.Errorf("got %q, want %q", out, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestNumericErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"9223372036854775807 + 1", "Integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", "Integer overflow: -9223372036854775807 - 2"},
+		{"4611686018427387904 * 2", "Integer overflow: 4611686018427387904 * 2"},
+		{"3037000500 * -3037000500", "Integer overflow: 3037000500 * -3037000500"},
+		{"x = -9223372036854775807 - 1\nx * -1", "Integer overflow: -9223372036854775808 * -1"},
+		{"x = -9223372036854775807 - 1\nx // -1", "Integer overflow: -9223372036854775808 // -1"},
+		{"x = -9223372036854775807 - 1\ny = -x", "Integer overflow: 0 - -9223372036854775808"},
+		{"x = 9223372036854775807\nx += 1", "Integer overflow: 9223372036854775807 + 1"},
+		{"1 / 0", "Divide by zero"},
+		{"1 // 0", "Divide by zero"},
+		{"1 % 0", "Divide by zero"},
+		{"1.5 // 0", "Divide by zero"},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(tt.source+"/"+backendName(backend), func(t *testing.T) {
+				_, err := runScript(backend, tt.source)
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("got error %v, want it to contain %q", err, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -2,11 +2,20 @@ package runevm
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
 type Parser struct {
 	input *TokenStream
+	// Number of loops enclosing the current expression within the current function
+	loopDepth int
+	// If set, a syntax error is recorded in errors and the parser continues with the next statement
+	recovering bool
+	errors     []SyntaxError
+	// If set, every block is kept as a block expression holding the position of its closing brace,
+	// used by the formatter. Otherwise empty blocks become false and single statements replace their block.
+	keepBlocks bool
 }
 
 func newParser(input *TokenStream) *Parser {
@@ -18,13 +27,28 @@ var FALSE = &expression{
 	Value: false,
 }
 
+// Precedence of the binary operators, operators with a higher precedence bind tighter:
+//
+//	=  +=  -=  *=  /=  %=    assignment, right associative: a = b = c assigns c to b and a
+//	??                       nil coalescing
+//	||                       logical or
+//	&&                       logical and
+//	<  >  <=  >=  ==  !=     comparison
+//	+  -                     addition and subtraction
+//	*  /  //  %              multiplication and division
+//
+// All other binary operators are left associative: a - b - c is (a - b) - c. The unary operators
+// -, +, not and ! bind tighter than all binary operators, and calls, index and field access tighter
+// still: -a.b * c is (-(a.b)) * c and not a && b is (not a) && b. A compound assignment like a += b
+// assigns a + b to a, evaluating the container and index of a only once.
 var precedence = map[string]int{
-	"=":  1,
-	"||": 2,
-	"&&": 3,
+	"=": 1, "+=": 1, "-=": 1, "*=": 1, "/=": 1, "%=": 1,
+	"??": 2,
+	"||": 3,
+	"&&": 4,
 	"<":  7, ">": 7, "<=": 7, ">=": 7, "==": 7, "!=": 7,
 	"+": 10, "-": 10,
-	"*": 20, "/": 20, "%": 20,
+	"*": 20, "/": 20, "//": 20, "%": 20,
 }
 
 func (p *Parser) isPunc(ch string) *Token {
@@ -68,11 +92,14 @@ func (p *Parser) skipKw(kw string) {
 }
 
 func (p *Parser) unexpected(tok *Token) {
-	if tok != nil {
-		p.input.error(tok, fmt.Sprintf("Unexpected token: \"%s\"", tok.Value))
+	if tok == nil {
+		p.input.error(tok, "Unexpected end of input")
 	}
+	p.input.error(tok, fmt.Sprintf("Unexpected token: \"%s\"", tok.Value))
 }
 
+// Parses the binary operators following the left operand that bind tighter than prec, by precedence climbing:
+// the right operand of an operator takes all following operators that bind tighter than the operator itself.
 func (p *Parser) parseBinaryExpression(left *expression, prec int) *expression {
 	for {
 		tok := p.isOp("")
@@ -86,18 +113,30 @@ func (p *Parser) parseBinaryExpression(left *expression, prec int) *expression {
 
 		p.input.next()
 
-		right := p.parseAtom()
-
-		nextTok := p.isOp("")
-
-		if nextTok != nil && precedence[nextTok.Value] > opPrec {
-			right = p.parseBinaryExpression(right, opPrec)
+		// The right operand of an assignment may be another assignment
+		rightPrec := opPrec
+		if opPrec == precedence["="] {
+			rightPrec = opPrec - 1
 		}
+		right := p.parseBinaryExpression(p.parseUnary(), rightPrec)
 
 		var exprType exprType
-		if tok.Value == "=" {
+		if opPrec == precedence["="] {
+			if left.Type != varExpr {
+				p.input.error(tok, fmt.Sprintf("Cannot assign to %s expression", left.Type))
+			}
+			if left.Operator == "?" {
+				p.input.error(tok, "Cannot assign to an optional access")
+			}
 			exprType = assignExpr
 		} else {
+			if tok.Value == "??" {
+				// A missing key or index anywhere in the access chain on the left of ?? yields the default
+				// instead of an error, e.g. for a.b.c ?? d when a has no b
+				for access := left; access.Type == varExpr && access.Index != nil; access = access.Left {
+					access.Operator = "?"
+				}
+			}
 			exprType = binaryExpr
 		}
 
@@ -138,14 +177,16 @@ func (p *Parser) parseDelimited(start, stop, separator string, parser func() *ex
 func (p *Parser) parseEnclosed(start string, stop string, parser func() *expression) []*expression {
 	var a []*expression
 	p.skipPunc(start)
-	for !p.input.eof() {
+	for !p.peekRecovering() {
 		if p.isPunc(stop) != nil {
 			break
 		}
 		if p.isPunc(stop) != nil {
 			break
 		}
-		a = append(a, parser())
+		if expr := parser(); expr != nil {
+			a = append(a, expr)
+		}
 	}
 	p.skipPunc(stop)
 	return a
@@ -153,22 +194,41 @@ func (p *Parser) parseEnclosed(start string, stop string, parser func() *express
 
 func (p *Parser) parseFunctionCall(funcExpr *expression) *expression {
 	tok := p.input.peek()
-	return &expression{
-		Type: callExpr,
-		Func: funcExpr,
-		Args: p.parseDelimited("(", ")", ",", p.parseExpression),
-		File: tok.File,
-		Line: tok.Line,
-		Col:  tok.Col,
-	}
+	args := p.parseDelimited("(", ")", ",", p.parseExpression)
+	end := p.input.last
+	return p.parseAccessOrCall(&expression{
+		Type:    callExpr,
+		Func:    funcExpr,
+		Args:    args,
+		File:    tok.File,
+		Line:    tok.Line,
+		Col:     tok.Col,
+		EndLine: end.Line,
+		EndCol:  end.Col + end.Length,
+	})
 }
 
 func (p *Parser) parseVarname() string {
+	return p.parseVarnameExpr().Value.(string)
+}
+
+// Parses a variable name and returns it as a var expression holding its position.
+func (p *Parser) parseVarnameExpr() *expression {
 	name := p.input.next()
+	if name == nil {
+		p.unexpected(name)
+	}
 	if name.Type != "var" {
 		p.input.error(name, fmt.Sprintf("Expecting variable name, but got: '%s'", name.Value))
 	}
-	return name.Value
+	return &expression{
+		Type:   varExpr,
+		Value:  name.Value,
+		File:   name.File,
+		Line:   name.Line,
+		Col:    name.Col,
+		Length: name.Length,
+	}
 }
 
 func (p *Parser) parseIf() *expression {
@@ -188,7 +248,8 @@ func (p *Parser) parseIf() *expression {
 		Col:  tok.Col,
 	}
 
-	var elifBlocks []*expression
+	// Each elif becomes an if expression in the else branch of the previous one
+	last := ret
 	hasElif := false
 	for p.isKw("elif") != nil {
 		hasElif = true
@@ -199,31 +260,28 @@ func (p *Parser) parseIf() *expression {
 			p.skipKw("then")
 		}
 		elifThen := p.parseExpression()
-		elifBlocks = append(elifBlocks, &expression{
-			Type: ifExpr,
-			Cond: elifCond,
-			Then: elifThen,
-			File: tok.File,
-			Line: tok.Line,
-			Col:  tok.Col,
-		})
-	}
-
-	if hasElif {
-		if p.isKw("else") != nil {
-			p.input.next()
-			elseBlock := p.parseExpression()
-			elifBlocks = append(elifBlocks, elseBlock)
-		} else {
-			p.input.error(tok, "Expecting 'else' after 'elif'")
-		}
-		ret.Else = &expression{
-			Type:  blockExpr,
-			Block: elifBlocks,
+		last.Else = &expression{
+			Type:     ifExpr,
+			Operator: "elif",
+			Cond:     elifCond,
+			Then:     elifThen,
+			File:     tok.File,
+			Line:     tok.Line,
+			Col:      tok.Col,
+			Length:   tok.Length,
 		}
-	} else if p.isKw("else") != nil {
+		last = last.Else
+	}
+
+	if p.isKw("else") != nil {
 		p.input.next()
-		ret.Else = p.parseExpression()
+		last.Else = p.parseExpression()
+	} else if hasElif {
+		// The statement is kept when recovering, so vet can point out the missing else as well
+		if !p.recovering {
+			p.input.error(tok, "Expecting 'else' after 'elif'")
+		}
+		p.addError(&RuneError{Kind: ParseError, File: tok.File, Line: tok.Line, Col: tok.Col, Message: "Expecting 'else' after 'elif'", length: tok.Length})
 	}
 
 	return ret
@@ -234,9 +292,11 @@ func (p *Parser) parseWhileExpr() *expression {
 	p.skipKw("while")
 	cond := p.parseExpression()
 	if p.isPunc("{") == nil {
-		p.input.error(p.input.current, fmt.Sprintf("Expecting token '{', bot got: \"%s\"", p.input.current.Value))
+		p.unexpected(p.input.current)
 	}
+	p.loopDepth++
 	body := p.parseBlock()
+	p.loopDepth--
 	return &expression{
 		Type: whileExpr,
 		Cond: cond,
@@ -247,25 +307,106 @@ func (p *Parser) parseWhileExpr() *expression {
 	}
 }
 
-func (p *Parser) parseFunctionDecl() *expression {
+// Parses 'for x in iterable { }' or 'for k, v in iterable { }'.
+func (p *Parser) parseForExpr() *expression {
 	tok := p.input.peek()
-	paramExprs := p.parseDelimited("(", ")", ",", func() *expression {
-		return &expression{
-			Type:  varExpr,
-			Value: p.parseVarname(),
+	p.skipKw("for")
+	nameExprs := []*expression{p.parseVarnameExpr()}
+	if p.isPunc(",") != nil {
+		p.input.next()
+		nameExprs = append(nameExprs, p.parseVarnameExpr())
+	}
+	var names []string
+	for _, expr := range nameExprs {
+		names = append(names, expr.Value.(string))
+	}
+	p.skipKw("in")
+	iterable := p.parseExpression()
+	if p.isPunc("{") == nil {
+		p.unexpected(p.input.current)
+	}
+	if iterable.Type == callExpr {
+		// Lets a call of the range builtin count lazily instead of building an array
+		iterable.Operator = "for"
+	}
+	p.loopDepth++
+	body := p.parseBlock()
+	p.loopDepth--
+	return &expression{
+		Type:       forExpr,
+		Params:     names,
+		ParamExprs: nameExprs,
+		Right:      iterable,
+		Body:       body,
+		File:       tok.File,
+		Line:       tok.Line,
+		Col:        tok.Col,
+	}
+}
+
+// Parses 'try { } catch err { } finally { }'. The error name, the catch and the finally block are optional,
+// but at least one of the blocks must be given.
+func (p *Parser) parseTryExpr() *expression {
+	tok := p.input.peek()
+	p.skipKw("try")
+	if p.isPunc("{") == nil {
+		p.unexpected(p.input.current)
+	}
+	expr := &expression{
+		Type: tryExpr,
+		Body: p.parseBlock(),
+		File: tok.File,
+		Line: tok.Line,
+		Col:  tok.Col,
+	}
+	if p.isKw("catch") != nil {
+		p.input.next()
+		if p.isPunc("{") == nil {
+			name := p.parseVarnameExpr()
+			expr.Params = []string{name.Value.(string)}
+			expr.ParamExprs = []*expression{name}
 		}
-	})
+		if p.isPunc("{") == nil {
+			p.unexpected(p.input.current)
+		}
+		expr.Then = p.parseBlock()
+	}
+	if p.isKw("finally") != nil {
+		p.input.next()
+		if p.isPunc("{") == nil {
+			p.unexpected(p.input.current)
+		}
+		expr.Else = p.parseBlock()
+	}
+	if expr.Then == nil && expr.Else == nil {
+		p.input.error(tok, "Expecting 'catch' or 'finally' after 'try'")
+	}
+	return expr
+}
+
+func (p *Parser) parseFunctionDecl() *expression {
+	tok := p.input.peek()
+	paramExprs := p.parseDelimited("(", ")", ",", p.parseVarnameExpr)
 	var params []string
 	for _, expr := range paramExprs {
 		params = append(params, expr.Value.(string))
 	}
+	// Loops outside of the function can't be left with break or continue from within it
+	outerLoopDepth := p.loopDepth
+	p.loopDepth = 0
+	body := p.parseExpression()
+	p.loopDepth = outerLoopDepth
+	end := p.input.last
 	return &expression{
-		Type:   funExpr,
-		Params: params,
-		Body:   p.parseExpression(),
-		File:   tok.File,
-		Line:   tok.Line,
-		Col:    tok.Col,
+		Type:       funExpr,
+		Params:     params,
+		ParamExprs: paramExprs,
+		Body:       body,
+		File:       tok.File,
+		Line:       tok.Line,
+		Col:        tok.Col,
+		EndLine:    end.Line,
+		EndCol:     end.Col + end.Length,
 	}
 }
 
@@ -285,12 +426,15 @@ func (p *Parser) parseArrayDecl() *expression {
 	tok := p.input.peek()
 	p.skipKw("array")
 	values := p.parseDelimited("{", "}", ",", p.parseExpression)
+	end := p.input.last
 	return &expression{
-		Type:  arrayExpr,
-		Block: values,
-		File:  tok.File,
-		Line:  tok.Line,
-		Col:   tok.Col,
+		Type:    arrayExpr,
+		Block:   values,
+		File:    tok.File,
+		Line:    tok.Line,
+		Col:     tok.Col,
+		EndLine: end.Line,
+		EndCol:  end.Col + end.Length,
 	}
 }
 
@@ -298,33 +442,39 @@ func (p *Parser) parseTableDecl() *expression {
 	tok := p.input.peek()
 	p.skipKw("table")
 	pairs := p.parseDelimited("{", "}", ",", p.parsePairDecl)
+	end := p.input.last
 	return &expression{
-		Type:  tableExpr,
-		Block: pairs,
-		File:  tok.File,
-		Line:  tok.Line,
-		Col:   tok.Col,
+		Type:    tableExpr,
+		Block:   pairs,
+		File:    tok.File,
+		Line:    tok.Line,
+		Col:     tok.Col,
+		EndLine: end.Line,
+		EndCol:  end.Col + end.Length,
 	}
 }
 
 func (p *Parser) parsePairDecl() *expression {
 	key := p.parseExpression()
-	_, ok := key.Value.(string)
-	if !ok {
-		evalError(key, "key must be of type string, but got: '%v'", key.Value)
+	// Number keys are turned into strings when the table is created
+	if key.Type != numExpr {
+		_, ok := key.Value.(string)
+		if !ok {
+			keyTok := &Token{File: key.File, Line: key.Line, Col: key.Col}
+			p.input.error(keyTok, fmt.Sprintf("key must be of type string, but got: '%v'", key.Value))
+		}
+		// remove any occurences of whitespaces including space, tabs and newlines
+		key.Value = strings.Join(strings.Fields(key.Value.(string)), "")
 	}
-	// remove any occurences of whitespaces including space, tabs and newlines
-	key.Value = strings.Join(strings.Fields(key.Value.(string)), "")
 	p.skipPunc(":")
 	value := p.parseExpression()
-	tok := p.input.peek()
 	return &expression{
 		Type:  pairExpr,
 		Left:  key,
 		Right: value,
-		File:  tok.File,
-		Line:  tok.Line,
-		Col:   tok.Col,
+		File:  key.File,
+		Line:  key.Line,
+		Col:   key.Col,
 	}
 }
 
@@ -341,14 +491,47 @@ func (p *Parser) parseAccessOrCall(expr *expression) *expression {
 	if p.isPunc(".") != nil {
 		return p.parseFieldAccessExpr(expr)
 	}
+	// Optional field and index access
+	if p.isPunc("?.") != nil || p.isPunc("?[") != nil {
+		return p.parseOptionalAccessExpr(expr)
+	}
 	return expr
 }
 
+// Parses a?.b and a?[index]. Both yield nil instead of failing if a is nil or has no such field or index.
+func (p *Parser) parseOptionalAccessExpr(expr *expression) *expression {
+	tok := p.input.next()
+	var access *expression
+	if tok.Value == "?." {
+		fieldName := p.parseVarname()
+		access = &expression{
+			Type:  varExpr,
+			Value: expr.Value,
+			Left:  expr,
+			Index: &expression{Type: strExpr, Value: fieldName, File: tok.File, Line: tok.Line, Col: tok.Col},
+		}
+	} else {
+		indexExpr := p.parseExpression()
+		p.skipPunc("]")
+		access = &expression{
+			Type:  varExpr,
+			Value: expr.Value,
+			Left:  expr,
+			Index: indexExpr,
+		}
+	}
+	access.Operator = "?"
+	access.File = tok.File
+	access.Line = tok.Line
+	access.Col = tok.Col
+	return p.parseAccessOrCall(access)
+}
+
 func (p *Parser) parseFieldAccessExpr(expr *expression) *expression {
 	tok := p.input.peek()
 	p.skipPunc(".")
 	fieldName := p.parseVarname()
-	return &expression{
+	return p.parseAccessOrCall(&expression{
 		Type:  varExpr,    // We use Var type to represent field access
 		Value: expr.Value, // Variable name that should be stored in the environment e.g. in "person.name" the string "person"
 		Left:  expr,
@@ -362,23 +545,21 @@ func (p *Parser) parseFieldAccessExpr(expr *expression) *expression {
 		File: tok.File,
 		Line: tok.Line,
 		Col:  tok.Col,
-	}
+	})
 }
 
 func (p *Parser) parseIndexExpr(expr *expression) *expression {
 	tok := p.input.peek()
 	p.skipPunc("[")
 	indexExpr := p.parseExpression()
-	switch indexExpr.Value.(type) {
-	case string, int:
-		// Valid type, proceed without doing anything
-	default:
-		p.input.error(p.input.current, fmt.Sprintf("index expression must be of type string for tables or type int for arrays, but got '%T'", indexExpr.Value))
+	switch indexExpr.Type {
+	case boolExpr, nilExpr, funExpr, arrayExpr, tableExpr:
+		p.input.error(p.input.current, fmt.Sprintf("index expression must be of type string for tables or type int for arrays, but got '%s'", indexExpr.Type))
 		return nil
 	}
 	p.skipPunc("]")
 
-	return &expression{
+	return p.parseAccessOrCall(&expression{
 		Type:  varExpr, // We use Var type to represent variable or array access
 		Value: expr.Value,
 		Left:  expr,
@@ -386,18 +567,21 @@ func (p *Parser) parseIndexExpr(expr *expression) *expression {
 		File:  tok.File,
 		Line:  tok.Line,
 		Col:   tok.Col,
-	}
+	})
 }
 
-func (p *Parser) parseNotExpr() *expression {
+// Parses an operand of a binary operator: an atom with the unary operators -, +, not and ! in front of it.
+func (p *Parser) parseUnary() *expression {
 	tok := p.input.peek()
-	p.skipKw("not")
-	expr := p.parseExpression()
-
+	isUnaryOp := p.isOp("-") != nil || p.isOp("+") != nil || p.isOp("!") != nil
+	if !isUnaryOp && p.isKw("not") == nil {
+		return p.parseAtom()
+	}
+	p.input.next()
 	return &expression{
 		Type:     unaryExpr,
-		Operator: "not",
-		Right:    expr,
+		Operator: tok.Value,
+		Right:    p.parseUnary(),
 		File:     tok.File,
 		Line:     tok.Line,
 		Col:      tok.Col,
@@ -427,6 +611,9 @@ func (p *Parser) parseReturnExpr() *expression {
 func (p *Parser) parseBreakExpr() *expression {
 	tok := p.input.peek()
 	p.skipKw("break")
+	if p.loopDepth == 0 {
+		p.input.error(tok, "'break' outside of a loop")
+	}
 	return &expression{
 		Type:  breakExpr,
 		Right: FALSE,
@@ -439,6 +626,9 @@ func (p *Parser) parseBreakExpr() *expression {
 func (p *Parser) parseContinueExpr() *expression {
 	tok := p.input.peek()
 	p.skipKw("continue")
+	if p.loopDepth == 0 {
+		p.input.error(tok, "'continue' outside of a loop")
+	}
 	return &expression{
 		Type:  continueExpr,
 		Right: FALSE,
@@ -460,8 +650,15 @@ func (p *Parser) parseAtom() *expression {
 		expr = p.parseIf()
 	} else if p.isKw("while") != nil {
 		expr = p.parseWhileExpr()
+	} else if p.isKw("for") != nil {
+		expr = p.parseForExpr()
+	} else if p.isKw("try") != nil {
+		expr = p.parseTryExpr()
 	} else if p.isKw("true") != nil || p.isKw("false") != nil {
 		expr = p.parseBoolExpr()
+	} else if p.isKw("nil") != nil {
+		tok := p.input.next()
+		expr = &expression{Type: nilExpr, File: tok.File, Line: tok.Line, Col: tok.Col, Length: tok.Length}
 	} else if p.isKw("fun") != nil {
 		p.input.next()
 		expr = p.parseFunctionDecl()
@@ -471,8 +668,6 @@ func (p *Parser) parseAtom() *expression {
 		expr = p.parseTableDecl()
 	} else if p.isKw("import") != nil {
 		expr = p.parseImport()
-	} else if p.isKw("not") != nil {
-		expr = p.parseNotExpr()
 	} else if p.isKw("return") != nil {
 		expr = p.parseReturnExpr()
 	} else if p.isKw("break") != nil {
@@ -482,7 +677,9 @@ func (p *Parser) parseAtom() *expression {
 
 	} else {
 		tok := p.input.next()
-		if tok.Type == "var" || tok.Type == "num" || tok.Type == "str" {
+		if tok != nil && tok.Type == "istr" {
+			expr = p.parseInterpolation(tok)
+		} else if tok != nil && (tok.Type == "var" || tok.Type == "num" || tok.Type == "str") {
 			expr = &expression{
 				Type:   exprType(tok.Type),
 				Value:  tok.Value,
@@ -491,6 +688,17 @@ func (p *Parser) parseAtom() *expression {
 				Col:    tok.Col,
 				Length: tok.Length,
 			}
+			if tok.Raw {
+				expr.Operator = "`"
+			}
+			if tok.Type == "num" {
+				// The number is parsed once, the formatter writes the literal as it was written
+				expr.Value = p.parseNumber(tok)
+				expr.Operator = tok.Value
+			}
+			if tok.EndLine > tok.Line {
+				expr.EndLine = tok.EndLine
+			}
 		} else {
 			p.unexpected(tok)
 		}
@@ -499,15 +707,63 @@ func (p *Parser) parseAtom() *expression {
 	return p.parseAccessOrCall(expr)
 }
 
+// Returns the int or float of a number literal.
+func (p *Parser) parseNumber(tok *Token) interface{} {
+	if strings.Contains(tok.Value, ".") {
+		f, err := strconv.ParseFloat(tok.Value, 64)
+		if err != nil {
+			p.input.error(tok, fmt.Sprintf("Invalid number '%s'", tok.Value))
+		}
+		return f
+	}
+	i, err := strconv.Atoi(tok.Value)
+	if err != nil {
+		p.input.error(tok, fmt.Sprintf("Integer %s is out of range", tok.Value))
+	}
+	return i
+}
+
+// Parses the parts of an interpolated string. Each embedded piece of code must hold exactly one expression.
+func (p *Parser) parseInterpolation(tok *Token) *expression {
+	expr := &expression{Type: interpExpr, File: tok.File, Line: tok.Line, Col: tok.Col, Length: tok.Length}
+	if tok.EndLine > tok.Line {
+		expr.EndLine = tok.EndLine
+	}
+	for _, part := range tok.Parts {
+		if part.Type == "str" {
+			expr.Block = append(expr.Block, &expression{Type: strExpr, Value: part.Value, File: tok.File, Line: tok.Line, Col: tok.Col})
+			continue
+		}
+		input := newInputStream(part.Value, part.File)
+		input.line = part.Line
+		input.Col = part.Col
+		sub := newParser(newTokenStream(input))
+		if sub.input.eof() {
+			p.input.error(part, "Empty ${} in string")
+		}
+		expr.Block = append(expr.Block, sub.parseExpression())
+		if !sub.input.eof() {
+			sub.unexpected(sub.input.peek())
+		}
+	}
+	return expr
+}
+
 func (p *Parser) parseProgram() *expression {
 	var prog []*expression
-	for !p.input.eof() {
-		prog = append(prog, p.parseExpression())
+	for !p.peekRecovering() {
+		if expr := p.parseStatement(); expr != nil {
+			prog = append(prog, expr)
+		}
 	}
-	return &expression{
+	block := &expression{
 		Type:  blockExpr,
 		Block: prog,
 	}
+	if len(prog) > 0 {
+		block.File, block.Line, block.Col = prog[0].File, prog[0].Line, prog[0].Col
+	}
+	return block
 }
 
 func (p *Parser) parseImport() *expression {
@@ -523,7 +779,20 @@ func (p *Parser) parseImport() *expression {
 }
 
 func (p *Parser) parseBlock() *expression {
-	block := p.parseEnclosed("{", "}", p.parseExpression)
+	tok := p.input.peek()
+	block := p.parseEnclosed("{", "}", p.parseStatement)
+	if p.keepBlocks {
+		end := p.input.last
+		return &expression{
+			Type:    blockExpr,
+			Block:   block,
+			File:    tok.File,
+			Line:    tok.Line,
+			Col:     tok.Col,
+			EndLine: end.Line,
+			EndCol:  end.Col + end.Length,
+		}
+	}
 	if len(block) == 0 {
 		return FALSE
 	}
@@ -533,11 +802,105 @@ func (p *Parser) parseBlock() *expression {
 	return &expression{
 		Type:  blockExpr,
 		Block: block,
+		File:  tok.File,
+		Line:  tok.Line,
+		Col:   tok.Col,
 	}
 }
 
 func (p *Parser) parseExpression() *expression {
-	left := p.parseAtom()
-	left = p.parseBinaryExpression(left, 0)
-	return p.parseAccessOrCall(left)
+	left := p.parseUnary()
+	return p.parseBinaryExpression(left, 0)
+}
+
+// Parses a statement of the program or a block. When recovering, a syntax error within the statement is
+// recorded and the parser skips to the next statement, returning nil.
+func (p *Parser) parseStatement() (expr *expression) {
+	if !p.recovering {
+		return p.parseExpression()
+	}
+	var start *Token
+	depth := p.input.depth
+	loopDepth := p.loopDepth
+	defer func() {
+		if rec := recover(); rec != nil {
+			err, ok := rec.(*RuneError)
+			if !ok || err.Kind == RuntimeError {
+				panic(rec)
+			}
+			p.addError(err)
+			p.loopDepth = loopDepth
+			p.synchronize(start, depth)
+			expr = nil
+		}
+	}()
+	start = p.input.peek()
+	return p.parseExpression()
+}
+
+// Skips the rest of a statement that failed to parse: all tokens up to the next token on a new line or
+// the closing brace of the enclosing block, after the braces opened by the statement were closed.
+func (p *Parser) synchronize(start *Token, depth int) {
+	for !p.peekRecovering() {
+		tok := p.input.peek()
+		if tok != start && p.input.depth <= depth {
+			if tok.Type == "punc" && tok.Value == "}" {
+				return
+			}
+			if p.input.last != nil && tok.Line > p.input.last.Line {
+				return
+			}
+		}
+		p.input.next()
+	}
+}
+
+// Reads the next token, recording and skipping invalid characters when recovering. Reports whether the
+// end of the input was reached.
+func (p *Parser) peekRecovering() (eof bool) {
+	if !p.recovering {
+		return p.input.eof()
+	}
+	for {
+		if done, ok := p.tryPeek(); ok {
+			return done
+		}
+	}
+}
+
+// Reads the next token. Reports false if the lexer raised an error, which is recorded.
+func (p *Parser) tryPeek() (eof bool, ok bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err, isRuneErr := rec.(*RuneError)
+			if !isRuneErr || err.Kind != LexError {
+				panic(rec)
+			}
+			p.addError(err)
+			ok = false
+		}
+	}()
+	return p.input.eof(), true
+}
+
+// Records a lex or parse error. An error at the same position as the previous one is only recorded once.
+func (p *Parser) addError(err *RuneError) {
+	if n := len(p.errors); n > 0 {
+		last := p.errors[n-1]
+		if last.Line == err.Line && last.Col == err.Col && last.Message == err.Message {
+			return
+		}
+	}
+	length := err.length
+	if length < 1 {
+		length = 1
+	}
+	p.errors = append(p.errors, SyntaxError{
+		Kind:    err.Kind,
+		File:    err.File,
+		Line:    err.Line,
+		Col:     err.Col,
+		Length:  length,
+		Message: err.Message,
+	})
 }
@@ -0,0 +1,265 @@
+package runevm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Writes the expression with explicit parentheses around every operator, e.g. (+ 1 (* 2 3)).
+func groupOperators(exp *expression) string {
+	switch exp.Type {
+	case strExpr:
+		return strconv.Quote(exp.Value.(string))
+	case numExpr, boolExpr:
+		return fmt.Sprint(exp.Value)
+	case nilExpr:
+		return "nil"
+	case varExpr:
+		if exp.Index != nil {
+			return groupOperators(exp.Left) + "[" + groupOperators(exp.Index) + "]"
+		}
+		return exp.Value.(string)
+	case binaryExpr, assignExpr:
+		return "(" + exp.Operator + " " + groupOperators(exp.Left) + " " + groupOperators(exp.Right) + ")"
+	case unaryExpr:
+		return "(" + exp.Operator + " " + groupOperators(exp.Right) + ")"
+	case callExpr:
+		var args []string
+		for _, arg := range exp.Args {
+			args = append(args, groupOperators(arg))
+		}
+		return groupOperators(exp.Func) + "(" + strings.Join(args, ", ") + ")"
+	}
+	return string(exp.Type)
+}
+
+func TestParseOperators(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		// Precedence
+		{"1 + 2 * 3", "(+ 1 (* 2 3))"},
+		{"1 * 2 + 3", "(+ (* 1 2) 3)"},
+		{"1 + 2 * 3 * 4 + 5", "(+ (+ 1 (* (* 2 3) 4)) 5)"},
+		{"a + b % c // d", "(+ a (// (% b c) d))"},
+		{"a < b + 1", "(< a (+ b 1))"},
+		{"a || b && c", "(|| a (&& b c))"},
+		{"a && b || c", "(|| (&& a b) c)"},
+		{"a ?? b || c", "(?? a (|| b c))"},
+		{"a = b ?? c", "(= a (?? b c))"},
+		{"x = 1 + 2 * 3 == 7 && ok", "(= x (&& (== (+ 1 (* 2 3)) 7) ok))"},
+
+		// Associativity
+		{"a - b - c", "(- (- a b) c)"},
+		{"a / b / c", "(/ (/ a b) c)"},
+		{"a - b + c", "(+ (- a b) c)"},
+		{"a == b < c", "(< (== a b) c)"},
+		{"a = b = c", "(= a (= b c))"},
+		{"a += b *= 2", "(+= a (*= b 2))"},
+		{"a = b += 1", "(= a (+= b 1))"},
+
+		// Unary operators
+		{"-5", "(- 5)"},
+		{"- -5", "(- (- 5))"},
+		{"-a * b", "(* (- a) b)"},
+		{"a * -b", "(* a (- b))"},
+		{"a - -b", "(- a (- b))"},
+		{"-(a + b)", "(- (+ a b))"},
+		{"+a", "(+ a)"},
+		{"not a && b", "(&& (not a) b)"},
+		{"!a == b", "(== (! a) b)"},
+		{"not not a", "(not (not a))"},
+
+		// Calls, index and field access bind tightest
+		{"-t.v * 2", "(* (- t[\"v\"]) 2)"},
+		{"-f(x)", "(- f(x))"},
+		{"t.a[i + 1] + 1", "(+ t[\"a\"][(+ i 1)] 1)"},
+		{"1 + t.f(2 * 3)", "(+ 1 t[\"f\"]((* 2 3)))"},
+		{"a[0] = -1", "(= a[0] (- 1))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			prog, errs := Parse(tt.source, "test.rune")
+			if len(errs) > 0 {
+				t.Fatalf("unexpected syntax errors: %v", errs)
+			}
+			if len(prog.ast.Block) != 1 {
+				t.Fatalf("got %d statements, want 1", len(prog.ast.Block))
+			}
+			if got := groupOperators(prog.ast.Block[0]); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateOperators(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"2 + 3 * 4", "14"},
+		{"10 - 2 - 3", "5"},
+		{"100 / 10 / 5", "2"},
+		{"2 * -3", "-6"},
+		{"2 - -1", "3"},
+		{"- -4", "4"},
+		{"-2 * 3 + 1", "-5"},
+		{"-(1 + 2) * 2", "-6"},
+		{"-1.5 + 1", "-0.5"},
+		{`+"7" + 1`, "8"},
+		{"not true && false", "false"},
+		{"not false || false", "true"},
+		{"true || false && false", "true"},
+		{"nil ?? 1 + 1", "2"},
+		{"1 < 2 == true", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			out, err := runBoth(t, "println("+tt.source+")")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want+"\n" {
+				t.Errorf("got %q, want %q", strings.TrimSuffix(out, "\n"), tt.want)
+			}
+		})
+	}
+
+	out, err := runBoth(t, "a = b = 2\na += b *= 3\nprintln(a, \" \", b)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "8 6\n" {
+		t.Errorf("chained assignment printed %q, want \"8 6\"", out)
+	}
+}
+
+func TestParseOperatorErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"1 = 2", "parse error (test.rune:1:3): Cannot assign to num expression"},
+		{`"a" = 2`, "parse error (test.rune:1:5): Cannot assign to str expression"},
+		{"f() = 1", "parse error (test.rune:1:5): Cannot assign to call expression"},
+		{"a + b = 2", "parse error (test.rune:1:7): Cannot assign to binary expression"},
+		{"-a = 1", "parse error (test.rune:1:4): Cannot assign to unary expression"},
+		{"x = (1 + 2) = 3", "parse error (test.rune:1:13): Cannot assign to binary expression"},
+		{"a + b += 1", "parse error (test.rune:1:7): Cannot assign to binary expression"},
+		{"t = table{}\nt?.a = 1", "parse error (test.rune:2:6): Cannot assign to an optional access"},
+		{"t = table{}\nt?.a += 1", "parse error (test.rune:2:6): Cannot assign to an optional access"},
+		{"x = 1 +", "parse error"},
+		{"x = * 2", "parse error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := Compile(tt.source, "test.rune")
+			var runeErr *RuneError
+			if !errors.As(err, &runeErr) || runeErr.Kind != ParseError {
+				t.Fatalf("got %v, want a parse error", err)
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error %q, want %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	prog, errs := Parse("x = 42\ny = 1.50\nt = table{1: 2}", "test.rune")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected syntax errors: %v", errs)
+	}
+	// Numbers are parsed once, when the program is parsed
+	if v := prog.ast.Block[0].Right.Value; v != 42 {
+		t.Errorf("got %#v for 42, want the int", v)
+	}
+	if v := prog.ast.Block[1].Right.Value; v != 1.5 {
+		t.Errorf("got %#v for 1.50, want the float", v)
+	}
+	if out, err := runBoth(t, "t = table{1: \"a\", 2.50: \"b\"}\nprintln(t, \" \", 1.50 + 007)"); err != nil || out != "{1: a, 2.5: b} 8.5\n" {
+		t.Errorf("got %q and %v, want number keys as strings and the sum", out, err)
+	}
+
+	for source, want := range map[string]string{
+		"x = 99999999999999999999": "parse error (test.rune:1:5): Integer 99999999999999999999 is out of range",
+		"x = 1.2.3":                "parse error (test.rune:1:5): Invalid number '1.2.3'",
+	} {
+		if _, err := Compile(source, "test.rune"); errorText(err) != want {
+			t.Errorf("got %v for %q, want %q", err, source, want)
+		}
+	}
+}
+
+func TestParseReportsAllErrors(t *testing.T) {
+	source := `x = )
+y = 2
+if y > 1 {
+    z = ]
+    w = 3
+}
+c = fun(1) {}
+b = @
+d = "\q"
+e = f(1, 2
+g = 3
+h = 4`
+	prog, errs := Parse(source, "test.rune")
+	want := []SyntaxError{
+		{Kind: ParseError, File: "test.rune", Line: 1, Col: 5, Length: 1, Message: `Unexpected token: ")"`},
+		{Kind: ParseError, File: "test.rune", Line: 4, Col: 9, Length: 1, Message: `Unexpected token: "]"`},
+		{Kind: ParseError, File: "test.rune", Line: 7, Col: 9, Length: 1, Message: "Expecting variable name, but got: '1'"},
+		{Kind: LexError, File: "test.rune", Line: 8, Col: 5, Length: 1, Message: "invalid character: @"},
+		{Kind: LexError, File: "test.rune", Line: 9, Col: 6, Length: 2, Message: `Invalid escape sequence '\q'`},
+		{Kind: ParseError, File: "test.rune", Line: 11, Col: 1, Length: 1, Message: `Expecting punctuation: ","`},
+	}
+	if len(errs) != len(want) {
+		t.Errorf("got %d errors, want %d:\n%v", len(errs), len(want), errs)
+	}
+	for i := 0; i < len(errs) && i < len(want); i++ {
+		if errs[i] != want[i] {
+			t.Errorf("error %d: got %+v, want %+v", i+1, errs[i], want[i])
+		}
+	}
+
+	// The statements around the errors are kept
+	var kept []string
+	for _, stmt := range prog.ast.Block {
+		kept = append(kept, groupOperators(stmt))
+	}
+	if got, want := strings.Join(kept, " "), "(= y 2) if (= g 3) (= h 4)"; got != want {
+		t.Errorf("got statements %s, want %s", got, want)
+	}
+}
+
+// After an error the parser skips the rest of the statement, so the error doesn't cause more of them
+func TestParseRecoveryHasNoFollowOnErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"x = (1 + ]) * 2\ny = 1", `test.rune:1:10: Unexpected token: "]"`},
+		{"f(a b c d)\ny = 1", `test.rune:1:5: Expecting punctuation: ","`},
+		{"t = table{a: 1, 2: }\ny = 1", `test.rune:1:20: Unexpected token: "}"`},
+		{"while x {\n    y = (]\n    z = 1\n}\nw = 2", `test.rune:2:10: Unexpected token: "]"`},
+		{"if x == ) {\n    y = 1\n}\nz = 2", `test.rune:1:9: Unexpected token: ")"`},
+		{"fun(a, 1, b) {\n    c = ]\n}", "test.rune:1:8: Expecting variable name, but got: '1'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, errs := Parse(tt.source, "test.rune")
+			var got []string
+			for _, err := range errs {
+				got = append(got, fmt.Sprintf("%s:%d:%d: %s", err.File, err.Line, err.Col, err.Message))
+			}
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got errors %q, want only %q", got, tt.want)
+			}
+		})
+	}
+}
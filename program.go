@@ -0,0 +1,57 @@
+package runevm
+
+import "sync"
+
+// Program is a compiled Rune script. It holds the parsed AST, which is never modified after Compile returns,
+// and the bytecode, which is compiled once on first use. A single Program can therefore be executed many
+// times and shared between goroutines and vms.
+type Program struct {
+	filepath string
+	source   string
+	ast      *expression
+	// Syntax errors found by Parse. A program with errors can't be executed.
+	errors []SyntaxError
+
+	// Bytecode is compiled on first use by the bytecode backend
+	compileOnce sync.Once
+	proto       *funcProto
+	protoErr    error
+}
+
+// Compiles the Rune source code into a Program that can be executed with RuneVM.Exec.
+// Filepath is used for error reporting. If the source fails to lex or parse, the returned error is a *RuneError
+// describing the first syntax error. Use Parse to get all of them.
+func Compile(source string, filepath string) (*Program, error) {
+	prog, errs := Parse(source, filepath)
+	if len(errs) > 0 {
+		return nil, errs[0].runeError()
+	}
+	return prog, nil
+}
+
+// Parses the Rune source code without stopping at the first syntax error. After an error the parser skips
+// to the next statement, so a single call reports every problem in the source, e.g. for editors and linters.
+// The returned program holds all statements that could be parsed. If there were errors, executing it fails
+// with the first one.
+func Parse(source string, filepath string) (*Program, []SyntaxError) {
+	stream := newInputStream(source, filepath)
+	tokenStream := newTokenStream(stream)
+	parser := newParser(tokenStream)
+	parser.recovering = true
+	ast := parser.parseProgram()
+
+	return &Program{filepath: filepath, source: source, ast: ast, errors: parser.errors}, parser.errors
+}
+
+// Returns the file path the program was compiled from.
+func (p *Program) Filepath() string {
+	return p.filepath
+}
+
+// Returns the bytecode of the program, compiling it on first use.
+func (p *Program) bytecode() (*funcProto, error) {
+	p.compileOnce.Do(func() {
+		p.proto, p.protoErr = compileBytecode(p.ast)
+	})
+	return p.proto, p.protoErr
+}
@@ -0,0 +1,218 @@
+package runevm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Runs an interactive read-eval-print loop in the vm's environment. Each input is executed like a
+// script, so variables and functions defined by one input are available in the next ones. The value of
+// an expression is printed after it ran. An input that opens more braces, brackets or parentheses than
+// it closes continues on the next line.
+//
+// Besides Rune code the REPL understands these commands:
+//
+//	:load <file>  runs a script file in the REPL environment
+//	:env          lists the variables defined in the REPL
+//	:history      lists the previous inputs, !<n> runs input n again
+//	:quit         leaves the REPL
+//
+// RunREPL returns nil when the input ends or :quit was entered. If a script called exit, it returns
+// the *ExitError.
+func (r *RuneVM) RunREPL(in io.Reader, out io.Writer) error {
+	// Names defined before the REPL started, e.g. the builtins, are left out by :env
+	predefined := make(map[string]bool)
+	for name := range r.env.vars {
+		predefined[name] = true
+	}
+	var history []string
+
+	fmt.Fprintf(out, "Rune %s, type :quit to exit\n", Version)
+	scanner := bufio.NewScanner(in)
+	for {
+		input, ok := readREPLInput(scanner, out)
+		if !ok {
+			fmt.Fprintln(out)
+			return nil
+		}
+		trimmed := strings.TrimSpace(input)
+		if trimmed == "" {
+			continue
+		}
+
+		// Running a previous input again adds it to the history once more
+		if strings.HasPrefix(trimmed, "!") {
+			n, err := strconv.Atoi(trimmed[1:])
+			if err != nil || n < 1 || n > len(history) {
+				fmt.Fprintf(out, "No input %s in the history\n", trimmed[1:])
+				continue
+			}
+			input = history[n-1]
+			trimmed = strings.TrimSpace(input)
+			fmt.Fprintln(out, input)
+		}
+		history = append(history, input)
+
+		command, arg, _ := strings.Cut(trimmed, " ")
+		switch command {
+		case ":quit", ":q":
+			return nil
+		case ":env":
+			r.printEnv(out, predefined)
+			continue
+		case ":history":
+			for i, entry := range history[:len(history)-1] {
+				fmt.Fprintf(out, "%4d  %s\n", i+1, strings.ReplaceAll(entry, "\n", "\n      "))
+			}
+			continue
+		case ":load":
+			path := strings.TrimSpace(arg)
+			source, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(out, "Can't read file '%s': %v\n", path, err)
+				continue
+			}
+			input = string(source)
+		default:
+			if strings.HasPrefix(command, ":") {
+				fmt.Fprintf(out, "Unknown command %s, the commands are :load <file>, :env, :history and :quit\n", command)
+				continue
+			}
+		}
+
+		filepath := "<repl>"
+		if command == ":load" {
+			filepath = strings.TrimSpace(arg)
+		}
+		if err := r.evalREPLInput(input, filepath, command != ":load", out); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads one input, which spans multiple lines while braces, brackets or parentheses are open.
+// Reports false at the end of the input.
+func readREPLInput(scanner *bufio.Scanner, out io.Writer) (string, bool) {
+	var lines []string
+	prompt := "> "
+	for {
+		fmt.Fprint(out, prompt)
+		if !scanner.Scan() {
+			if len(lines) > 0 {
+				return strings.Join(lines, "\n"), true
+			}
+			return "", false
+		}
+		lines = append(lines, scanner.Text())
+		input := strings.Join(lines, "\n")
+		if strings.HasPrefix(strings.TrimSpace(input), ":") || !isIncomplete(input) {
+			return input, true
+		}
+		prompt = "... "
+	}
+}
+
+// Reports whether the source opens more braces, brackets or parentheses than it closes, or ends within
+// a string.
+func isIncomplete(source string) (incomplete bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err, ok := rec.(*RuneError)
+			if !ok {
+				panic(rec)
+			}
+			// Strings may span lines, so the next line may close them. Other lex errors are reported
+			// when the input is executed.
+			switch err.Message {
+			case "Unterminated string", "Unterminated raw string", "Unterminated ${ in string":
+				incomplete = true
+			default:
+				incomplete = false
+			}
+		}
+	}()
+	ts := newTokenStream(newInputStream(source, "<repl>"))
+	depth := 0
+	for !ts.eof() {
+		tok := ts.next()
+		if tok.Type != "punc" {
+			continue
+		}
+		switch tok.Value {
+		case "{", "(", "[", "?[":
+			depth++
+		case "}", ")", "]":
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// Executes an input and prints the value of a trailing expression. Errors of the input are printed,
+// only an *ExitError is returned.
+func (r *RuneVM) evalREPLInput(source string, filepath string, printResult bool, out io.Writer) error {
+	prog, errs := Parse(source, filepath)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(out, err)
+		}
+		return nil
+	}
+	result, err := r.exec(context.Background(), prog)
+	if err != nil {
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr
+		}
+		fmt.Fprintln(out, err)
+		return nil
+	}
+	if printResult && printsValue(prog.ast) && result != nil && !isJump(result) {
+		fmt.Fprintln(out, displayValue(result))
+	}
+	return nil
+}
+
+// Reports whether the value of the last statement is worth printing. Assignments, loops and imports
+// only yield a value because everything in Rune is an expression.
+func printsValue(ast *expression) bool {
+	if len(ast.Block) == 0 {
+		return false
+	}
+	switch ast.Block[len(ast.Block)-1].Type {
+	case assignExpr, whileExpr, forExpr, importExpr:
+		return false
+	default:
+		return true
+	}
+}
+
+// Returns the string representation of a value for the REPL and the debugger. Functions have no useful
+// string representation, so they are shown as <function>.
+func displayValue(value interface{}) string {
+	if typeName(value) == "function" {
+		return "<function>"
+	}
+	return formatValue(value)
+}
+
+// Prints the global variables defined in the REPL, sorted by name.
+func (r *RuneVM) printEnv(out io.Writer, predefined map[string]bool) {
+	var names []string
+	for name := range r.env.vars {
+		if !predefined[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%s = %s\n", name, displayValue(r.env.vars[name]))
+	}
+}
@@ -0,0 +1,48 @@
+package runevm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsIncomplete(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"x = 1", false},
+		{"f = fun() {", true},
+		{"f = fun() {\n}", false},
+		{"a = array{1,\n2", true},
+		{"println(1", true},
+		{"x = )", false},
+		{`s = "abc`, true},
+		{"s = \"abc\ndef\"", false},
+		{"s = `abc", true},
+		{"s = `abc\ndef`", false},
+		{`s = "${x`, true},
+		{`s = "abc\`, true},
+		{"x = @", false},
+		{`s = "\q"`, false},
+	}
+	for _, tt := range tests {
+		if got := isIncomplete(tt.source); got != tt.want {
+			t.Errorf("isIncomplete(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestREPLContinuesStrings(t *testing.T) {
+	in := "s = `first\nsecond`\nprintln(s)\nt = \"a\nb\"\nlen(t)\n:quit\n"
+	var out strings.Builder
+	vm := newTestVM(TreeWalker, &out)
+	if err := vm.RunREPL(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "first\nsecond\n") || !strings.Contains(out.String(), "3\n") {
+		t.Errorf("strings spanning lines were not continued:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "Unterminated") {
+		t.Errorf("got a lex error for a string spanning lines:\n%s", out.String())
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 
@@ -14,19 +17,199 @@ import (
 **********************************************************/
 
 func main() {
-	args := os.Args
-	if len(args) < 2 {
+	bytecode := flag.Bool("bytecode", false, "run the script with the bytecode backend")
+	timeout := flag.Duration("timeout", 0, "abort the script after the given duration, e.g. 10s")
+	flag.Usage = func() {
 		fmt.Printf("Rune interpreter %s\n", runevm.Version)
-		fmt.Println("  USAGE: rune <sourcefile>")
-		os.Exit(1)
+		fmt.Println("  USAGE: rune [-bytecode] [-timeout <duration>] <sourcefile>")
+		fmt.Println("         rune [-bytecode]           starts the interactive REPL")
+		fmt.Println("         rune debug <sourcefile>    runs the script in the debugger")
+		fmt.Println("         rune fmt [-w] [-d] <sourcefiles>    formats the scripts, see rune fmt -h")
+		fmt.Println("         rune vet <sourcefiles>     reports likely mistakes in the scripts")
+		fmt.Println("         rune lsp                   runs the language server on stdin and stdout")
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		// Without a source file rune starts the interactive REPL
+		vm := runevm.NewRuneVM()
+		if *bytecode {
+			vm.SetBackend(runevm.Bytecode)
+		}
+		if err := vm.RunREPL(os.Stdin, os.Stdout); err != nil {
+			var exitErr *runevm.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.Code)
+			}
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if args[0] == "debug" {
+		if len(args) < 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		debug(args[1])
+		return
 	}
-	source, err := os.ReadFile(args[1])
+	if args[0] == "fmt" {
+		os.Exit(format(args[1:]))
+	}
+	if args[0] == "vet" {
+		os.Exit(vet(args[1:]))
+	}
+	if args[0] == "lsp" {
+		if err := runevm.ServeLSP(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	source, err := os.ReadFile(args[0])
 	if err != nil {
-		fmt.Printf("ERROR: Can't find source file '%s'.\n", args[1])
+		fmt.Printf("ERROR: Can't find source file '%s'.\n", args[0])
 		os.Exit(1)
 	}
 
-	filepath := args[1]
+	filepath := args[0]
 	vm := runevm.NewRuneVM()
-	vm.Run(string(source), filepath)
+	if *bytecode {
+		vm.SetBackend(runevm.Bytecode)
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	prog, syntaxErrs := runevm.Parse(string(source), filepath)
+	if len(syntaxErrs) > 0 {
+		// Report every syntax error at once
+		for _, syntaxErr := range syntaxErrs {
+			fmt.Println(syntaxErr)
+		}
+		os.Exit(1)
+	}
+	if err := vm.ExecContext(ctx, prog); err != nil {
+		var exitErr *runevm.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Runs the script in the interactive debugger.
+func debug(filepath string) {
+	source, err := os.ReadFile(filepath)
+	if err != nil {
+		fmt.Printf("ERROR: Can't find source file '%s'.\n", filepath)
+		os.Exit(1)
+	}
+	prog, syntaxErrs := runevm.Parse(string(source), filepath)
+	if len(syntaxErrs) > 0 {
+		for _, syntaxErr := range syntaxErrs {
+			fmt.Println(syntaxErr)
+		}
+		os.Exit(1)
+	}
+	debugger := runevm.NewDebugger(runevm.NewRuneVM(), os.Stdin, os.Stdout)
+	if err := debugger.Run(prog); err != nil {
+		var exitErr *runevm.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Formats the given files and returns the exit code. Without flags the formatted code is printed.
+func format(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the formatted code back to the files")
+	diff := flags.Bool("d", false, "print a diff of the changes instead of the formatted code")
+	flags.Usage = func() {
+		fmt.Println("  USAGE: rune fmt [-w] [-d] <sourcefiles>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	code := 0
+	for _, filepath := range flags.Args() {
+		source, err := os.ReadFile(filepath)
+		if err != nil {
+			fmt.Printf("ERROR: Can't find source file '%s'.\n", filepath)
+			code = 1
+			continue
+		}
+		formatted, err := runevm.Format(string(source), filepath)
+		if err != nil {
+			fmt.Println(err)
+			code = 1
+			continue
+		}
+		if *diff {
+			fmt.Print(unifiedDiff(filepath+".orig", filepath, string(source), formatted))
+		}
+		if *write {
+			if formatted != string(source) {
+				info, err := os.Stat(filepath)
+				if err == nil {
+					err = os.WriteFile(filepath, []byte(formatted), info.Mode().Perm())
+				}
+				if err != nil {
+					fmt.Printf("ERROR: Can't write file '%s': %v\n", filepath, err)
+					code = 1
+				}
+			}
+		} else if !*diff {
+			fmt.Print(formatted)
+		}
+	}
+	return code
+}
+
+// Checks the given files for syntax errors and likely mistakes and returns the exit code, 1 if any
+// problem was found.
+func vet(files []string) int {
+	if len(files) == 0 {
+		fmt.Println("  USAGE: rune vet <sourcefiles>")
+		return 1
+	}
+	code := 0
+	for _, filepath := range files {
+		source, err := os.ReadFile(filepath)
+		if err != nil {
+			fmt.Printf("ERROR: Can't find source file '%s'.\n", filepath)
+			code = 1
+			continue
+		}
+		prog, syntaxErrs := runevm.Parse(string(source), filepath)
+		warnings := runevm.NewRuneVM().Vet(prog)
+		// A syntax error that vet explains, like a missing else after elif, is only printed as warning
+		warned := make(map[[2]int]bool)
+		for _, warning := range warnings {
+			warned[[2]int{warning.Line, warning.Col}] = true
+		}
+		for _, syntaxErr := range syntaxErrs {
+			if !warned[[2]int{syntaxErr.Line, syntaxErr.Col}] {
+				fmt.Println(syntaxErr)
+			}
+			code = 1
+		}
+		for _, warning := range warnings {
+			fmt.Println(warning)
+			code = 1
+		}
+	}
+	return code
 }
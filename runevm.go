@@ -1,75 +1,234 @@
 package runevm
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 )
 
 const Version = "v0.1.49"
 
+// Backend selects how a RuneVM executes programs.
+type Backend int
+
+const (
+	// Evaluates programs by walking their syntax tree
+	TreeWalker Backend = iota
+	// Compiles programs to bytecode and executes it on a stack machine
+	Bytecode
+)
+
 type RuneVM struct {
 	filepath string
 	source   string
 	env      *Environment
+	backend  Backend
+	// Context of the running script, nil while no script is executed
+	ctx    context.Context
+	limits Limits
+	// Budgets used by the running script
+	usage   *usage
+	sandbox sandbox
+}
+
+// A builtin function together with the capability a vm needs to install it and its documentation.
+type builtin struct {
+	name       string
+	fn         func(args ...interface{}) interface{}
+	capability Capability
+	// Call syntax and a one-sentence description, shown by the language server. Vet checks the number of
+	// arguments of calls against the signature.
+	signature string
+	doc       string
 }
 
-func NewRuneVM() *RuneVM {
-	vm := &RuneVM{}
+// Returns the builtin functions bound to the vm.
+func (r *RuneVM) builtins() []builtin {
+	return []builtin{
+		{"version", builtin_VmVersion, 0,
+			"version()", "Returns the rune interpreter version in the format: `x.x.x`."},
+		{"print", builtin_Print, 0,
+			"print(<args>...)", "Prints the given arguments to the standard out."},
+		{"println", builtin_Println, 0,
+			"println(<args>...)", "Prints the given arguments to the standard out and adds a newline character at the end."},
+		{"wait", r.builtin_Wait, 0,
+			"wait(<milliseconds>)", "Waits the given amount of milliseconds."},
+		{"millis", builtin_Millisecs, 0,
+			"millis()", "Return the milliseconds since the Unix epoch as an `int`."},
+		{"exit", builtin_Exit, CapExit,
+			"exit([code])", "Stops the script immediately. The exit code is optional and defaults to `0`."},
+		{"readfile", r.builtin_ReadFileStr, CapFS,
+			"readfile(<path>)", "Reads a file from the given path and returns the contents as a string."},
+		{"writefile", r.builtin_WriteFileStr, CapFS,
+			"writefile(<path>, <content>)", "Creates (and overwrites) a file to the given path and writes the given string into it."},
+		{"fileexist", r.builtin_FileExists, CapFS,
+			"fileexist(<path>)", "Returns true if the given file exists, otherwise false."},
+		{"direxists", r.builtin_DirExists, CapFS,
+			"direxists(<path>)", "Returns true if the given directory exists, otherwise false."},
+		{"isfileordir", r.builtin_IsFileOrDir, CapFS,
+			"isfileordir(<path>)", "Checks if a given path is a file or directory. Returns `0` if the path does not exist, `1` when it is a file, `2` when it is a directory."},
+		{"strsplit", builtin_StrSplit, 0,
+			"strsplit(<str>, <delimiter>)", "Splits a string into an array of substrings based on a specified delimiter."},
+		{"strtrim", builtin_StrTrim, 0,
+			"strtrim(<string>)", "Trim whitespace from both ends of a string and returns the new string."},
+		{"trimleft", builtin_TrimLeft, 0,
+			"trimleft(<string>)", "Trim whitespace from the beginning of a string and returns the new string."},
+		{"trimright", builtin_TrimRight, 0,
+			"trimright(<string>)", "Trim whitespace from the end of a string and returns the new string."},
+		{"isdigit", builtin_IsDigit, 0,
+			"isdigit(<string>)", "Returns true if a given string character is a digit."},
+		{"isalpha", builtin_IsAlpha, 0,
+			"isalpha(<string>)", "Returns true if a given string character is an alphabetical character."},
+		{"iswhite", builtin_IsWhite, 0,
+			"iswhite(<string>)", "Returns true if a given string character is a whitespace character."},
+		{"strreplace", r.builtin_Replace, 0,
+			"strreplace(<string>, <old>, <new>)", "Replaces occurrences of old within a string with new."},
+		{"strcontains", builtin_Contains, 0,
+			"strcontains(<string>, <substr>)", "Returns true if the substring is found within the string, and false otherwise."},
+		{"strhasprefix", builtin_HasPrefix, 0,
+			"strhasprefix(<string>, <substr>)", "Returns true if a string starts with the given substring, otherwise false."},
+		{"strhassuffix", builtin_HasSuffix, 0,
+			"strhassuffix(<string>, <substr>)", "Returns true if a string ends with the given substring, otherwise false."},
+		{"cutprefix", builtin_CutPrefix, 0,
+			"cutprefix(<string>, <prefix>)", "Cuts the given prefix from the given string. Returns the new string."},
+		{"cutsuffix", builtin_CutSuffix, 0,
+			"cutsuffix(<string>, <suffix>)", "Cuts the given suffix from the given string. Returns the new string."},
+		{"strlower", builtin_StrToLower, 0,
+			"strlower(<string>)", "Returns the given string with all Unicode letters mapped to their lower case."},
+		{"strupper", builtin_StrToUpper, 0,
+			"strupper(<string>)", "Returns the given string with all Unicode letters mapped to their upper case."},
+		{"format", r.builtin_Format, 0,
+			"format(<format>, <args>...)", "Returns a string built from the format string and the arguments, like `printf` in other languages."},
+		{"typeof", builtin_TypeOf, 0,
+			"typeof(<arg>)", "Returns the type name as string of the given argument."},
+		{"append", r.builtin_append, 0,
+			"append(<array|table|string>, [key], <value>)", "Appends the given value to the given array, table or string, tables also take the key. Returns the new array, table or string."},
+		{"remove", builtin_remove, 0,
+			"remove(<array|table|string>, <index>)", "Removes the given index from the given array, table or string. Returns the new array, table or string."},
+		{"haskey", builtin_hasKey, 0,
+			"haskey(<table>, <key>)", "Returns true if the given table has the given key, otherwise false."},
+		{"slice", builtin_slice, 0,
+			"slice(<array|table|string>, <start>, <end>)", "Returns a slice of the given array, table, or string from the start index to the end index."},
+		{"sliceleft", builtin_sliceLeft, 0,
+			"sliceleft(<array|table|string>, <end>)", "Returns a slice of the given array, table, or string from the start to the given end index."},
+		{"sliceright", builtin_sliceRight, 0,
+			"sliceright(<array|table|string>, <start>)", "Returns a slice of the given array, table, or string from the given start index to the end."},
+		{"len", builtin_Len, 0,
+			"len(<array|table|string>)", "Returns the length of the given array, table or string."},
+		{"range", r.builtin_Range, 0,
+			"range([start], <end>, [step])", "Returns an array of the ints from start (0 if omitted) up to, but not including, end."},
+		{"new", r.builtin_New, 0,
+			"new(<array|table>)", "Returns a deep copy of the given array or table."},
+		{"exec", builtin_Exec, CapExec,
+			"exec(<command>, [workdir])", "Executes the given shell command, optionally in the given working directory. Returns the output prefixed with `ok: ` or `err: `."},
+		{"assert", builtin_Assert, 0,
+			"assert(<condition>, <message>)", "Errors with the given message if the condition is false."},
+		{"throw", builtin_Throw, 0,
+			"throw(<value>)", "Raises a runtime error that can be caught with `try` and `catch`."},
+	}
+}
+
+// Creates a vm with all builtins installed. Options can restrict the builtins and the paths scripts can access,
+// e.g. NewRuneVM(WithCapabilities(CapFS), WithFSRoot("scripts")).
+func NewRuneVM(options ...Option) *RuneVM {
+	vm := &RuneVM{usage: &usage{}, sandbox: sandbox{caps: CapAll}}
+	for _, option := range options {
+		option(vm)
+	}
 
 	vm.env = newEnvironment(nil)
-	vm.set("version", builtin_VmVersion)
-	vm.set("print", builtin_Print)
-	vm.set("println", builtin_Println)
-	vm.set("wait", builtin_Wait)
-	vm.set("millis", builtin_Millisecs)
-	vm.set("exit", builtin_Exit)
-	vm.set("readfile", builtin_ReadFileStr)
-	vm.set("writefile", builtin_WriteFileStr)
-	vm.set("fileexist", builtin_FileExists)
-	vm.set("direxists", builtin_DirExists)
-	vm.set("isfileordir", builtin_IsFileOrDir)
-	vm.set("strsplit", builtin_StrSplit)
-	vm.set("strtrim", builtin_StrTrim)
-	vm.set("trimleft", builtin_TrimLeft)
-	vm.set("trimright", builtin_TrimRight)
-	vm.set("isdigit", builtin_IsDigit)
-	vm.set("isalpha", builtin_IsAlpha)
-	vm.set("iswhite", builtin_IsWhite)
-	vm.set("strreplace", builtin_Replace)
-	vm.set("strcontains", builtin_Contains)
-	vm.set("strhasprefix", builtin_HasPrefix)
-	vm.set("strhassuffix", builtin_HasSuffix)
-	vm.set("cutprefix", builtin_CutPrefix)
-	vm.set("cutsuffix", builtin_CutSuffix)
-	vm.set("strlower", builtin_StrToLower)
-	vm.set("strupper", builtin_StrToUpper)
-	vm.set("typeof", builtin_TypeOf)
-	vm.set("append", builtin_append)
-	vm.set("remove", builtin_remove)
-	vm.set("haskey", builtin_hasKey)
-	vm.set("slice", builtin_slice)
-	vm.set("sliceleft", builtin_sliceLeft)
-	vm.set("sliceright", builtin_sliceRight)
-	vm.set("len", builtin_Len)
-	vm.set("new", builtin_New)
-	vm.set("exec", builtin_Exec)
-	vm.set("assert", builtin_Assert)
+	for _, b := range vm.builtins() {
+		if vm.sandbox.has(b.capability) {
+			vm.set(b.name, b.fn)
+		}
+	}
 
 	return vm
 }
 
+// Creates a vm that only installs pure builtins: no filesystem access, no imports, no exec and no exit.
+// Options can grant capabilities back, e.g. NewSandboxedVM(WithCapabilities(CapImport), WithFSRoot("plugins")).
+func NewSandboxedVM(options ...Option) *RuneVM {
+	return NewRuneVM(append([]Option{WithCapabilities(0)}, options...)...)
+}
+
 // Executes the Rune source code from the provided source string. Filepath is used for error reporting.
-func (r *RuneVM) Run(source string, filepath string) {
-	r.filepath = filepath
-	r.source = source
+// If the script fails to lex, parse or run, the returned error is a *RuneError. If the script called exit,
+// the returned error is an *ExitError holding the exit code.
+// To run the same script multiple times, compile it once with Compile and execute it with Exec.
+func (r *RuneVM) Run(source string, filepath string) error {
+	return r.RunContext(context.Background(), source, filepath)
+}
+
+// Like Run, but aborts the script once ctx is done. The script is interrupted on the next loop iteration
+// or function call, or while it waits in 'wait'. The returned *RuneError then wraps ErrCanceled or ErrTimeout,
+// which can be tested with errors.Is.
+func (r *RuneVM) RunContext(ctx context.Context, source string, filepath string) error {
+	prog, err := Compile(source, filepath)
+	if err != nil {
+		return err
+	}
+	return r.ExecContext(ctx, prog)
+}
+
+// Executes a compiled program in the vm's environment. Variables and functions defined by previous
+// runs are kept. If the program fails, the returned error is a *RuneError, if it called exit an *ExitError.
+func (r *RuneVM) Exec(prog *Program) error {
+	return r.ExecContext(context.Background(), prog)
+}
+
+// Like Exec, but aborts the program once ctx is done. See RunContext.
+func (r *RuneVM) ExecContext(ctx context.Context, prog *Program) error {
+	_, err := r.exec(ctx, prog)
+	return err
+}
+
+// Executes the program and returns the value of its last statement.
+func (r *RuneVM) exec(ctx context.Context, prog *Program) (result interface{}, err error) {
+	if len(prog.errors) > 0 {
+		return nil, prog.errors[0].runeError()
+	}
+	r.filepath = prog.filepath
+	r.source = prog.source
 
-	stream := newInputStream(string(source), filepath)
-	tokenStream := newTokenStream(stream)
-	parser := newParser(tokenStream)
-	ast := parser.parseProgram()
-	evaluator := newEvaluator()
+	defer recoverError(&err)
 
-	evaluator.evaluate(ast, r.env)
+	r.usage = &usage{limits: r.limits}
+	evaluator := newEvaluator(r.usage, &r.sandbox)
+	if ctx.Done() != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			cause := contextError(ctxErr)
+			return nil, &RuneError{Kind: RuntimeError, Message: cause.Error(), Err: cause}
+		}
+		// Functions handed out by GetFun outlive this call and must not be canceled by ctx afterwards
+		prevCtx := r.ctx
+		r.ctx = ctx
+		evaluator.setContext(ctx)
+		defer func() {
+			r.ctx = prevCtx
+			evaluator.setContext(nil)
+		}()
+	}
+	if r.backend == Bytecode {
+		proto, err := prog.bytecode()
+		if err != nil {
+			return nil, err
+		}
+		return evaluator.runProto(proto, r.env), nil
+	}
+	return evaluator.evaluate(prog.ast, r.env), nil
+}
+
+// Selects the backend used by Run and Exec. The default is TreeWalker.
+// Both backends share the same environment, builtins and semantics.
+func (r *RuneVM) SetBackend(backend Backend) {
+	r.backend = backend
+}
+
+// Sets the resource budgets enforced while scripts are executed. The budgets apply to each call
+// of Run or Exec separately. Exhausting a budget aborts the script with a *RuneError that wraps a *LimitError.
+func (r *RuneVM) SetLimits(limits Limits) {
+	r.limits = limits
 }
 
 func (r *RuneVM) set(name string, value interface{}) {
@@ -77,7 +236,26 @@ func (r *RuneVM) set(name string, value interface{}) {
 }
 
 func (r *RuneVM) get(name string) interface{} {
-	return r.env.get(name, nil)
+	scope := r.env.lookup(name)
+	if scope == nil {
+		return nil
+	}
+	return scope.vars[name]
+}
+
+// Wraps a function so that a Rune error raised while calling it from Go is returned as a *RuneError
+// instead of unwinding the caller.
+func guardFun(fn func(...interface{}) interface{}) func(...interface{}) interface{} {
+	return func(args ...interface{}) (ret interface{}) {
+		var err error
+		defer func() {
+			if err != nil {
+				ret = err
+			}
+		}()
+		defer recoverError(&err)
+		return fn(args...)
+	}
 }
 
 // Defines a function in the Rune environment.
@@ -105,13 +283,13 @@ func (r *RuneVM) SetString(name string, value string) {
 	r.set(name, value)
 }
 
-// Defines an array variable in the Rune environment.
+// Defines an array variable in the Rune environment. Go maps nested in the array are converted to tables.
 func (r *RuneVM) SetArray(name string, value []interface{}) {
-	r.set(name, value)
+	r.set(name, fromGoValue(value))
 }
 
-// Defines a table (map) variable in the Rune environment.
-func (r *RuneVM) SetTable(name string, value map[string]interface{}) {
+// Defines a table variable in the Rune environment. Use TableFromMap to pass a Go map.
+func (r *RuneVM) SetTable(name string, value *Table) {
 	r.set(name, value)
 }
 
@@ -174,11 +352,11 @@ func (r *RuneVM) GetArray(name string) ([]interface{}, error) {
 	return nil, fmt.Errorf("variable '%s' is not an array", name)
 }
 
-// Retrieves a table (map) variable from the Rune environment.
-func (r *RuneVM) GetTable(name string) (map[string]interface{}, error) {
+// Retrieves a table variable from the Rune environment. Use Table.Map to convert it to a Go map.
+func (r *RuneVM) GetTable(name string) (*Table, error) {
 	val := r.get(name)
-	if arr, ok := val.(map[string]interface{}); ok {
-		return arr, nil
+	if t, ok := val.(*Table); ok {
+		return t, nil
 	}
 	return nil, fmt.Errorf("variable '%s' is not a table", name)
 }
@@ -189,19 +367,20 @@ func (r *RuneVM) GetFun(name string) (func(...interface{}) interface{}, error) {
 	if !ok {
 		return nil, fmt.Errorf("'%s' is not a function", name)
 	}
-	return fn, nil
+	return guardFun(fn), nil
 }
 
-// Retrieves a function from a table (map) in the Rune environment.
-func (r *RuneVM) GetTableFun(tableName string, funName string) (map[string]interface{}, func(...interface{}) interface{}, error) {
+// Retrieves a function from a table in the Rune environment.
+func (r *RuneVM) GetTableFun(tableName string, funName string) (*Table, func(...interface{}) interface{}, error) {
 	table, err := r.GetTable(tableName)
 	if err != nil {
 		return nil, nil, fmt.Errorf(tableName, " is not a rune table")
 	}
 
-	fun, ok := table[funName].(func(args ...interface{}) interface{})
+	value, _ := table.Get(funName)
+	fun, ok := value.(func(args ...interface{}) interface{})
 	if !ok {
 		return nil, nil, fmt.Errorf(funName, " is not a function on table ", tableName)
 	}
-	return table, fun, nil
+	return table, guardFun(fun), nil
 }
@@ -0,0 +1,113 @@
+package runevm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Capability grants scripts access to builtins that reach outside the vm.
+type Capability int
+
+const (
+	// readfile, writefile, fileexist, direxists and isfileordir
+	CapFS Capability = 1 << iota
+	// The import statement
+	CapImport
+	// exec, which runs shell commands
+	CapExec
+	// exit, which ends the script early
+	CapExit
+
+	// All capabilities, the default of NewRuneVM
+	CapAll = CapFS | CapImport | CapExec | CapExit
+)
+
+// Option configures a vm created by NewRuneVM or NewSandboxedVM.
+type Option func(*RuneVM)
+
+// Installs only the builtins that need no capability plus those granted by caps.
+func WithCapabilities(caps Capability) Option {
+	return func(r *RuneVM) {
+		r.sandbox.caps = caps
+	}
+}
+
+// Confines readfile, writefile, import and the other filesystem builtins to the given directory.
+// Relative paths are resolved against it.
+func WithFSRoot(dir string) Option {
+	return func(r *RuneVM) {
+		r.sandbox.root = realPath(dir)
+	}
+}
+
+// Allows the filesystem builtins and import to access the given files and directories, including
+// everything below a directory. Can be combined with WithFSRoot.
+func WithFSAllow(paths ...string) Option {
+	return func(r *RuneVM) {
+		for _, path := range paths {
+			r.sandbox.allow = append(r.sandbox.allow, realPath(path))
+		}
+	}
+}
+
+// Restricts which builtins a vm installs and which paths scripts can access.
+type sandbox struct {
+	caps  Capability
+	root  string
+	allow []string
+}
+
+// Reports whether the script may use the given capability.
+func (s *sandbox) has(capability Capability) bool {
+	return s.caps&capability == capability
+}
+
+// Returns the path a script should access for the given path, or an error if the path lies
+// outside of the root and the allow-list. Symlinks are resolved, so a link inside the root can't
+// point outside of it, and the returned path is the checked one: a symlink swapped in after the
+// check isn't followed.
+func (s *sandbox) resolve(path string) (string, error) {
+	if s.root == "" && len(s.allow) == 0 {
+		return path, nil
+	}
+	if s.root != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(s.root, path)
+	}
+	real := realPath(path)
+	if s.root != "" && isWithin(real, s.root) {
+		return real, nil
+	}
+	for _, allowed := range s.allow {
+		if isWithin(real, allowed) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("access to '%s' is not allowed", path)
+}
+
+// Returns the absolute path with all symlinks resolved. If the path doesn't exist,
+// the symlinks of its closest existing parent directory are resolved.
+func realPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real
+	}
+	parent := filepath.Dir(abs)
+	if parent == abs {
+		return abs
+	}
+	return filepath.Join(realPath(parent), filepath.Base(abs))
+}
+
+// Reports whether path is dir itself or lies below it.
+func isWithin(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,80 @@
+package runevm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandboxResolve(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var vm RuneVM
+	WithFSRoot(root)(&vm)
+	realRoot := realPath(root)
+
+	tests := []struct {
+		path string
+		// Expected result relative to the root, "" if access is denied
+		want string
+	}{
+		{"file.txt", "file.txt"},
+		{"sub/file.txt", "sub/file.txt"},
+		{"link/file.txt", "sub/file.txt"},
+		{"escape/file.txt", ""},
+		{"../outside/file.txt", ""},
+		{filepath.Join(outside, "file.txt"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := vm.sandbox.resolve(tt.path)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %q, want access to be denied", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// The resolved path is returned, so the link isn't followed again when the file is opened
+			if want := filepath.Join(realRoot, tt.want); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSandboxedBuiltinsUseResolvedPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "data"), filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	out, err := runBoth(t, `writefile("link/a.txt", "hello")
+println(readfile("link/a.txt"))`, WithFSRoot(root))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "hello\n" {
+		t.Errorf("got output %q, want %q", out, "hello\n")
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "data", "a.txt")); err != nil || string(content) != "hello" {
+		t.Errorf("file not written to the link target: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,331 @@
+package runevm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTruthiness(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"true", "yes"},
+		{"false", "no"},
+		{"nil", "no"},
+		{"0", "no"},
+		{"0.0", "no"},
+		{"1", "yes"},
+		{"-2.5", "yes"},
+		{`""`, "no"},
+		{`"0"`, "yes"},
+		{"array{}", "yes"},
+		{"table{}", "yes"},
+		{"fun() {}", "yes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			source := "v = " + tt.value + "\nif v { println(\"yes\") } else { println(\"no\") }\nprintln(not not v)"
+			out, err := runBoth(t, source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			wantNot := "true"
+			if tt.want == "no" {
+				wantNot = "false"
+			}
+			if want := tt.want + "\n" + wantNot + "\n"; out != want {
+				t.Errorf("got output %q, want %q", out, want)
+			}
+		})
+	}
+}
+
+func TestControlFlowLeavesEnclosingConstruct(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"return from nested blocks", `f = fun() {
+    while true {
+        if true {
+            return = "inner"
+        }
+    }
+    "after loop"
+}
+println(f())`, "inner\n"},
+		{"break from nested if", `i = 0
+while true {
+    i = i + 1
+    if i > 2 {
+        if true { break }
+    }
+}
+println(i)`, "3\n"},
+		{"continue from nested if", `n = 0
+for i in range(5) {
+    if i % 2 == 0 {
+        { continue }
+    }
+    n = n + i
+}
+println(n)`, "4\n"},
+		{"break leaves only the innermost loop", `count = 0
+for i in range(3) {
+    for j in range(3) {
+        if j == 1 then break
+        count = count + 1
+    }
+}
+println(count)`, "3\n"},
+		{"single statement while body", `i = 0
+while i < 4 { i = i + 1 }
+println(i)`, "4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runBoth(t, tt.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got output %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestElif(t *testing.T) {
+	source := `classify = fun(n) {
+    if n < 0 {
+        "negative"
+    } elif n == 0 {
+        "zero"
+    } elif n < 10 {
+        "small"
+    } else {
+        "large"
+    }
+}
+println(classify(-1), " ", classify(0), " ", classify(5), " ", classify(50))
+x = "unset"
+if false { x = "a" } elif false { x = "b" } else {}
+println(x)`
+	out, err := runBoth(t, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "negative zero small large\nunset\n"; out != want {
+		t.Errorf("got output %q, want %q", out, want)
+	}
+
+	// elif chains are nested if expressions
+	prog, errs := Parse("if a { 1 } elif b { 2 } else { 3 }", "test.rune")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected syntax errors: %v", errs)
+	}
+	outer := prog.ast.Block[0]
+	if outer.Type != ifExpr || outer.Else == nil || outer.Else.Type != ifExpr || outer.Else.Else == nil {
+		t.Errorf("elif is not parsed as a nested if: %+v", outer)
+	}
+}
+
+func TestControlFlowParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"break outside of a loop", "x = 1\nbreak", "parse error (test.rune:2:1): 'break' outside of a loop"},
+		{"continue outside of a loop", "continue", "parse error (test.rune:1:1): 'continue' outside of a loop"},
+		{"break in a function within a loop", "while true {\n    f = fun() { break }\n}", "'break' outside of a loop"},
+		{"elif without else", "if a { 1 } elif b { 2 }", "Expecting 'else' after 'elif'"},
+		{"assign to a call", "f() = 1", "Cannot assign to call expression"},
+		{"assign to a number", "1 = 2", "Cannot assign to num expression"},
+		{"assign to a binary expression", "a + b = 2", "Cannot assign to binary expression"},
+		{"assign to an optional access", "t = table{}\nt?.a = 1", "Cannot assign to an optional access"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.source, "test.rune")
+			var runeErr *RuneError
+			if !errors.As(err, &runeErr) || runeErr.Kind != ParseError {
+				t.Fatalf("got %v, want a parse error", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %q, want it to contain %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+// The bytecode backend keeps the variables of functions in local slots, the tree walker in an
+// Environment per call. Both have to resolve names the same way.
+func TestFunctionScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"assignment updates a global", "x = 1\nf = fun() { x = 2 }\nf()\nprintln(x)", "2\n"},
+		{"assignment defines a local", "f = fun() { x = 2\nx + 1 }\nprintln(f(), \" \", f())", "3 3\n"},
+		{"global defined after the first call", `f = fun() { x = 1
+    x += 1 }
+f()
+x = 10
+f()
+println(x)`, "2\n"},
+		{"local read before assignment reads the global", `g = 5
+f = fun() {
+    a = g
+    g = 7
+    a
+}
+println(f(), " ", g)`, "5 7\n"},
+		{"closure updates the enclosing local", `counter = fun() {
+    n = 0
+    fun() { n += 1 }
+}
+c = counter()
+c()
+println(c(), " ", c())`, "2 3\n"},
+		{"closure defines its own local until the enclosing one is assigned", `outer = fun() {
+    g = fun() {
+        v = 5
+        v
+    }
+    a = g()
+    v = 1
+    b = g()
+    array{a, b, v}
+}
+println(outer())`, "[5, 5, 5]\n"},
+		{"closures share a captured local", `make = fun() {
+    shared = 0
+    array{fun() { shared += 1 }, fun() { shared }}
+}
+fns = make()
+fns[0]()
+fns[0]()
+println(fns[1]())`, "2\n"},
+		{"loop and catch variables", `f = fun() {
+    total = 0
+    for i, v in array{10, 20} { total += i * v }
+    try { throw("x") } catch e { total += len(e.message) }
+    total
+}
+println(f())`, "21\n"},
+		{"recursion keeps locals apart", `fact = fun(n) {
+    if n < 2 then return = 1
+    rest = fact(n - 1)
+    n * rest
+}
+println(fact(10))`, "3628800\n"},
+		{"parameter shadows a global", "p = 1\nf = fun(p) { p = p + 1\np }\nprintln(f(5), \" \", p)", "6 1\n"},
+		{"nested function reads a parameter", "f = fun(a) { g = fun() { b = a * 2\nb }\ng() }\nprintln(f(4))", "8\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runBoth(t, tt.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got output %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	// Reading a local of a function before it was assigned, or after the call, is an error on both backends
+	_, err := runBoth(t, "f = fun() {\n    y = x\n    x = 1\n}\nf()")
+	if err == nil || !strings.Contains(err.Error(), "runtime error (test.rune:2:9): Undefined variable 'x'") {
+		t.Errorf("got %v, want an undefined variable error", err)
+	}
+	_, err = runBoth(t, "f = fun() { x = 2 }\nf()\nprintln(x)")
+	if err == nil || !strings.Contains(err.Error(), "runtime error (test.rune:3:9): Undefined variable 'x'") {
+		t.Errorf("got %v, want an undefined variable error", err)
+	}
+}
+
+// A function that imports a file keeps its variables in the Environment, where the import defines its own.
+func TestImportInFunction(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "lib.rune"), []byte("libval = 3\ncount = 100"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lib := filepath.ToSlash(filepath.Join(dir, "lib"))
+	source := "load = fun() {\n    count = 1\n    import \"" + lib + "\"\n    count + libval\n}\nprintln(load())"
+	out, err := runBoth(t, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "103\n" {
+		t.Errorf("got output %q, want %q", out, "103\n")
+	}
+}
+
+func TestDefaultedAccessChains(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"missing key", `t = table{}
+println(t.a ?? "d")`, "d\n"},
+		{"missing key inside the chain", `t = table{"a": table{}}
+println(t.a.b.c ?? "d")`, "d\n"},
+		{"missing first key", `t = table{}
+println(t.a.b.c ?? "d")`, "d\n"},
+		{"existing chain", `t = table{"a": table{"b": table{"c": 1}}}
+println(t.a.b.c ?? "d")`, "1\n"},
+		{"index out of bounds inside the chain", `t = table{"a": array{table{"b": 1}}}
+println(t.a[3].b ?? "d", " ", t.a[0].b ?? "d")`, "d 1\n"},
+		{"mixed keys and indexes", `t = array{table{"k": array{}}}
+println(t[0]["k"][2][1] ?? "d")`, "d\n"},
+		{"nil value inside the chain", `t = table{"a": nil}
+println(t.a.b ?? "d")`, "d\n"},
+		{"chain after a call", `f = fun() { return = table{} }
+println(f().a.b ?? "d")`, "d\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runBoth(t, tt.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+// Only the accesses of the chain are optional, other errors on the left of ?? are still reported
+func TestDefaultedAccessErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`println(missing.a.b ?? "d")`, "Undefined variable 'missing'"},
+		{`t = table{"a": 1}
+println(t.a.b ?? "d")`, "is not an array or table"},
+		{`t = table{}
+f = fun() { return = t.a.b }
+println(f() ?? "d")`, "Key 'a' not found"},
+		{`t = table{}
+println(t.a.b)`, "Key 'a' not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := runBoth(t, tt.source)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
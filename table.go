@@ -0,0 +1,126 @@
+package runevm
+
+import "sort"
+
+// Table is a Rune table. It maps string keys to values and remembers the order in which the keys were
+// first inserted, so printing and iterating a table is deterministic. Tables are passed by reference:
+// a Go function receiving a *Table can modify the table of the script.
+type Table struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Creates an empty table.
+func NewTable() *Table {
+	return &Table{values: make(map[string]interface{})}
+}
+
+// Creates a table from a Go map. Go maps have no order, so the keys are inserted in sorted order.
+// Nested maps are converted to tables as well.
+func TableFromMap(m map[string]interface{}) *Table {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	t := &Table{keys: keys, values: make(map[string]interface{}, len(m))}
+	for _, key := range keys {
+		t.values[key] = fromGoValue(m[key])
+	}
+	return t
+}
+
+// Returns the entries of the table as a Go map. Nested tables are converted to maps as well.
+func (t *Table) Map() map[string]interface{} {
+	m := make(map[string]interface{}, len(t.keys))
+	for _, key := range t.keys {
+		m[key] = toGoValue(t.values[key])
+	}
+	return m
+}
+
+// Returns the number of entries.
+func (t *Table) Len() int {
+	return len(t.keys)
+}
+
+// Returns the keys in insertion order. The returned slice must not be modified.
+func (t *Table) Keys() []string {
+	return t.keys
+}
+
+// Returns the value stored at the given key and whether the key exists.
+func (t *Table) Get(key string) (interface{}, bool) {
+	value, ok := t.values[key]
+	return value, ok
+}
+
+// Reports whether the table has the given key.
+func (t *Table) Has(key string) bool {
+	_, ok := t.values[key]
+	return ok
+}
+
+// Stores the value at the given key. A new key is appended to the end, an existing key keeps its position.
+func (t *Table) Set(key string, value interface{}) {
+	if _, exists := t.values[key]; !exists {
+		t.keys = append(t.keys, key)
+	}
+	t.values[key] = value
+}
+
+// Removes the given key. Reports false if the key didn't exist.
+func (t *Table) Delete(key string) bool {
+	if _, exists := t.values[key]; !exists {
+		return false
+	}
+	delete(t.values, key)
+	for i, k := range t.keys {
+		if k == key {
+			t.keys = append(t.keys[:i:i], t.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Returns a new table holding the entries from start up to, but not including, end in insertion order.
+func (t *Table) slice(start, end int) *Table {
+	sliced := NewTable()
+	for _, key := range t.keys[start:end] {
+		sliced.Set(key, t.values[key])
+	}
+	return sliced
+}
+
+// Converts Go maps to tables, including maps nested in arrays.
+func fromGoValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return TableFromMap(v)
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fromGoValue(elem)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Converts tables to Go maps, including tables nested in arrays. Arrays are copied, so the original
+// Rune values are left untouched.
+func toGoValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *Table:
+		return v.Map()
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, elem := range v {
+			arr[i] = toGoValue(elem)
+		}
+		return arr
+	default:
+		return v
+	}
+}
@@ -0,0 +1,119 @@
+package runevm
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestTableInsertionOrder(t *testing.T) {
+	table := NewTable()
+	table.Set("a", 1)
+	table.Set("b", 2)
+	table.Set("c", 3)
+	// Setting an existing key keeps its position
+	table.Set("b", 20)
+	if want := []string{"a", "b", "c"}; !slices.Equal(table.Keys(), want) {
+		t.Fatalf("got keys %v, want %v", table.Keys(), want)
+	}
+
+	keys := table.Keys()
+	if !table.Delete("b") {
+		t.Fatal("Delete reported a missing key for b")
+	}
+	if table.Delete("b") {
+		t.Error("Delete reported an existing key for b after it was deleted")
+	}
+	// A deleted key that is set again goes to the end
+	table.Set("b", 200)
+	table.Set("d", 4)
+	if want := []string{"a", "c", "b", "d"}; !slices.Equal(table.Keys(), want) {
+		t.Errorf("got keys %v, want %v", table.Keys(), want)
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(keys, want) {
+		t.Errorf("Delete changed the keys returned before, got %v, want %v", keys, want)
+	}
+	if value, ok := table.Get("b"); !ok || value != 200 {
+		t.Errorf("got %v, %v for b, want 200, true", value, ok)
+	}
+	if table.Len() != 4 {
+		t.Errorf("got length %d, want 4", table.Len())
+	}
+}
+
+func TestTableOrderInScripts(t *testing.T) {
+	source := `t = table{"z": 1, "a": 2}
+t.m = 3
+remove(t, "z")
+t.z = 4
+t.a = 5
+println(t)
+for k, v in t { print(k, "=", v, " ") }`
+	out, err := runBoth(t, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "{a: 5, m: 3, z: 4}\na=5 m=3 z=4 "; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTableFromMap(t *testing.T) {
+	table := TableFromMap(map[string]interface{}{
+		"zeta":  1,
+		"alpha": map[string]interface{}{"y": true, "x": false},
+		"mu":    []interface{}{map[string]interface{}{"b": 1, "a": 2}, "s"},
+	})
+	if want := []string{"alpha", "mu", "zeta"}; !slices.Equal(table.Keys(), want) {
+		t.Errorf("got keys %v, want them sorted as %v", table.Keys(), want)
+	}
+	alpha, _ := table.Get("alpha")
+	nested, ok := alpha.(*Table)
+	if !ok {
+		t.Fatalf("got %T for a nested map, want *Table", alpha)
+	}
+	if want := []string{"x", "y"}; !slices.Equal(nested.Keys(), want) {
+		t.Errorf("got nested keys %v, want %v", nested.Keys(), want)
+	}
+	mu, _ := table.Get("mu")
+	inArray, ok := mu.([]interface{})[0].(*Table)
+	if !ok {
+		t.Fatalf("got %T for a map in an array, want *Table", mu.([]interface{})[0])
+	}
+	if want := []string{"a", "b"}; !slices.Equal(inArray.Keys(), want) {
+		t.Errorf("got keys %v of the map in the array, want %v", inArray.Keys(), want)
+	}
+}
+
+func TestTableMapRoundTrip(t *testing.T) {
+	inner := NewTable()
+	inner.Set("k", "v")
+	table := NewTable()
+	table.Set("b", 1)
+	table.Set("a", inner)
+	table.Set("c", []interface{}{inner, 2.5})
+
+	m := table.Map()
+	want := map[string]interface{}{
+		"b": 1,
+		"a": map[string]interface{}{"k": "v"},
+		"c": []interface{}{map[string]interface{}{"k": "v"}, 2.5},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %v, want %v", m, want)
+	}
+	// The arrays of the map are copies, changing them leaves the table alone
+	m["c"].([]interface{})[1] = "changed"
+	if c, _ := table.Get("c"); c.([]interface{})[1] != 2.5 {
+		t.Errorf("changing the map changed the table to %v", c)
+	}
+
+	// Back from the map the keys are sorted, the entries are the same
+	back := TableFromMap(table.Map())
+	if want := []string{"a", "b", "c"}; !slices.Equal(back.Keys(), want) {
+		t.Errorf("got keys %v, want %v", back.Keys(), want)
+	}
+	if !reflect.DeepEqual(back.Map(), table.Map()) {
+		t.Errorf("got %v after the round trip, want %v", back.Map(), table.Map())
+	}
+}
@@ -2,8 +2,10 @@ package runevm
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type Token struct {
@@ -13,6 +15,12 @@ type Token struct {
 	Line   int
 	Col    int
 	Length int
+	// Literal text ("str") and embedded source code ("code") of an interpolated string ("istr")
+	Parts []*Token
+	// Set for a raw string written in backticks
+	Raw bool
+	// Line of the closing quote of a string
+	EndLine int
 }
 
 type TokenStream struct {
@@ -20,13 +28,26 @@ type TokenStream struct {
 	current  *Token
 	last     *Token
 	keywords map[string]bool
+	// Number of braces opened by the tokens consumed so far and not closed yet
+	depth int
+	// If set, comments are recorded in comments instead of being dropped, used by the formatter
+	keepComments bool
+	comments     []*Token
+}
+
+var keywords = map[string]bool{
+	"if": true, "then": true, "elif": true, "else": true, "while": true, "for": true, "in": true, "break": true, "continue": true, "fun": true, "return": true,
+	"try": true, "catch": true, "finally": true,
+	"true": true, "false": true, "nil": true, "array": true, "table": true, "import": true, "not": true,
+}
+
+// Operators of two characters. Any other operator is a single character.
+var ops = map[string]bool{
+	"??": true, "||": true, "&&": true, "<=": true, ">=": true, "==": true, "!=": true, "//": true,
+	"+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
 }
 
 func newTokenStream(input *InputStream) *TokenStream {
-	keywords := map[string]bool{
-		"if": true, "then": true, "elif": true, "else": true, "while": true, "break": true, "continue": true, "fun": true, "return": true,
-		"true": true, "false": true, "array": true, "table": true, "import": true, "not": true,
-	}
 	return &TokenStream{input: input, keywords: keywords}
 }
 
@@ -34,41 +55,51 @@ func (ts *TokenStream) isKeyword(x string) bool {
 	return ts.keywords[x]
 }
 
-func (ts *TokenStream) isDigit(ch byte) bool {
-	return unicode.IsDigit(rune(ch))
+// Numbers are written with the ASCII digits only
+func (ts *TokenStream) isDigit(ch rune) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// Identifiers start with a letter of any script or '_', e.g. größe or 名前
+func (ts *TokenStream) isIdStart(ch rune) bool {
+	return unicode.IsLetter(ch) || ch == '_'
 }
 
-func (ts *TokenStream) isIdStart(ch byte) bool {
-	return unicode.IsLetter(rune(ch)) || ch == '_'
+// Besides letters, identifiers may contain digits and combining marks, like the accents of decomposed letters
+func (ts *TokenStream) isId(ch rune) bool {
+	return ts.isIdStart(ch) || unicode.IsDigit(ch) || unicode.In(ch, unicode.Mn, unicode.Mc) || strings.ContainsRune("?!-<>=", ch)
 }
 
-func (ts *TokenStream) isId(ch byte) bool {
-	return ts.isIdStart(ch) || strings.ContainsRune("?!-<>=0123456789", rune(ch))
+func (ts *TokenStream) isOpChar(ch rune) bool {
+	return strings.ContainsRune("+-*/%=&|<>!?", ch)
 }
 
-func (ts *TokenStream) isOpChar(ch byte) bool {
-	return strings.ContainsRune("+-*/%=&|<>!", rune(ch))
+// Reports whether the input continues with the optional access punctuation "?." or "?[" or the operator "??".
+func (ts *TokenStream) isOptionalAccess() bool {
+	return ts.input.peek() == '?' && strings.ContainsRune(".[?", ts.input.peekAt(1))
 }
 
-func (ts *TokenStream) isPunc(ch byte) bool {
-	return strings.ContainsRune(".,:(){}[]", rune(ch))
+func (ts *TokenStream) isPunc(ch rune) bool {
+	return strings.ContainsRune(".,:(){}[]", ch)
 }
 
-func (ts *TokenStream) isWhitespace(ch byte) bool {
-	return strings.ContainsRune(" \r\t\n", rune(ch))
+func (ts *TokenStream) isWhitespace(ch rune) bool {
+	return strings.ContainsRune(" \r\t\n", ch)
 }
 
-func (ts *TokenStream) readWhile(predicate func(byte) bool) (string, int) {
+// Reads characters while the predicate holds. Returns them and their number.
+func (ts *TokenStream) readWhile(predicate func(rune) bool) (string, int) {
 	var str strings.Builder
-	startPos := ts.input.Pos
+	length := 0
 	for !ts.input.eof() && predicate(ts.input.peek()) {
-		str.WriteByte(ts.input.next())
+		str.WriteRune(ts.input.next())
+		length++
 	}
-	return str.String(), ts.input.Pos - startPos
+	return str.String(), length
 }
 
 func (ts *TokenStream) readNumber() *Token {
-	number, length := ts.readWhile(func(ch byte) bool {
+	number, length := ts.readWhile(func(ch rune) bool {
 		if ch == '.' {
 			return true
 		}
@@ -78,42 +109,203 @@ func (ts *TokenStream) readNumber() *Token {
 }
 
 func (ts *TokenStream) readIdent() *Token {
-	id, length := ts.readWhile(ts.isId)
+	// A trailing '?' belongs to the identifier, unless it starts "?.", "?[" or "??"
+	id, length := ts.readWhile(func(ch rune) bool {
+		return ts.isId(ch) && !ts.isOptionalAccess()
+	})
 	if ts.isKeyword(id) {
 		return &Token{Type: "kw", Value: id, File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col - length, Length: length}
 	}
 	return &Token{Type: "var", Value: id, File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col - length, Length: length}
 }
 
-func (ts *TokenStream) readEscaped(end byte) (string, int) {
-	var escaped bool
-	var str strings.Builder
+// Reads a string literal. Expressions embedded with ${...} turn it into an interpolated string token
+// whose parts are parsed by the parser. Escape sequences are replaced by the characters they stand for.
+// An invalid escape sequence is reported after the whole literal was read, so the lexer can continue after it.
+func (ts *TokenStream) readString() *Token {
+	tok := &Token{Type: "str", File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col}
 	startPos := ts.input.Pos
+	var str strings.Builder
+	var escapeErr *RuneError
 	ts.input.next() // Consume initial quote
+	terminated := false
 	for !ts.input.eof() {
+		if ts.input.peek() == '$' && ts.input.peekAt(1) == '{' {
+			if str.Len() > 0 {
+				tok.Parts = append(tok.Parts, &Token{Type: "str", Value: str.String()})
+				str.Reset()
+			}
+			tok.Parts = append(tok.Parts, ts.readInterpolation())
+			continue
+		}
+		if ts.input.peek() == '\\' {
+			if err := ts.readEscaped(&str); err != nil && escapeErr == nil {
+				escapeErr = err
+			}
+			continue
+		}
 		ch := ts.input.next()
-		if escaped {
-			str.WriteByte(ch)
-			escaped = false
-		} else if ch == '\\' {
-			escaped = true
-		} else if ch == end {
+		if ch == '"' {
+			terminated = true
 			break
-		} else {
-			str.WriteByte(ch)
 		}
+		str.WriteRune(ch)
+	}
+	tok.Length = utf8.RuneCountInString(ts.input.source[startPos:ts.input.Pos])
+	tok.EndLine = ts.input.line
+	if !terminated {
+		ts.input.error(&Token{File: tok.File, Line: tok.Line, Col: tok.Col, Length: 1}, "Unterminated string")
+	}
+	if escapeErr != nil {
+		panic(escapeErr)
 	}
-	return str.String(), ts.input.Pos - startPos
+	if tok.Parts == nil {
+		tok.Value = str.String()
+		return tok
+	}
+	if str.Len() > 0 {
+		tok.Parts = append(tok.Parts, &Token{Type: "str", Value: str.String()})
+	}
+	tok.Type = "istr"
+	return tok
 }
 
-func (ts *TokenStream) readString() *Token {
-	str, length := ts.readEscaped('"')
-	return &Token{Type: "str", Value: str, File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col - length, Length: length}
+// Reads an escape sequence and writes the character it stands for. Returns the lex error of an invalid
+// escape sequence, which is skipped.
+func (ts *TokenStream) readEscaped(str *strings.Builder) *RuneError {
+	errTok := &Token{File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col, Length: 2}
+	ts.input.next() // Consume '\\'
+	ch := ts.input.next()
+	switch ch {
+	case 'n':
+		str.WriteByte('\n')
+	case 't':
+		str.WriteByte('\t')
+	case 'r':
+		str.WriteByte('\r')
+	case '0':
+		str.WriteByte(0)
+	case '\\', '"', '$':
+		// '\\$' keeps "${" from starting an embedded expression
+		str.WriteRune(ch)
+	case 'x':
+		// Exactly two hex digits, the code of a character up to U+00FF. Hex digits after them are literal text.
+		count := 0
+		digits, _ := ts.readWhile(func(ch rune) bool {
+			count++
+			return count <= 2 && isHexDigit(ch)
+		})
+		errTok.Length += utf8.RuneCountInString(digits)
+		code, err := strconv.ParseUint(digits, 16, 8)
+		if len(digits) != 2 || err != nil {
+			return ts.escapeError(errTok, "Invalid escape sequence '\\x%s', expecting two hex digits", digits)
+		}
+		str.WriteRune(rune(code))
+	case 'u':
+		// One to six hex digits in braces, the code point of any character
+		if ts.input.peek() != '{' {
+			return ts.escapeError(errTok, "Invalid escape sequence '\\u', expecting a code point like \\u{00E4}")
+		}
+		ts.input.next()
+		digits, _ := ts.readWhile(func(ch rune) bool { return isHexDigit(ch) })
+		errTok.Length += utf8.RuneCountInString(digits) + 1
+		if ts.input.peek() != '}' {
+			return ts.escapeError(errTok, "Invalid escape sequence '\\u{%s', expecting a closing '}'", digits)
+		}
+		ts.input.next()
+		errTok.Length++
+		code, err := strconv.ParseUint(digits, 16, 32)
+		if len(digits) == 0 || len(digits) > 6 || err != nil || !utf8.ValidRune(rune(code)) {
+			return ts.escapeError(errTok, "Invalid escape sequence '\\u{%s}', expecting a valid code point", digits)
+		}
+		str.WriteRune(rune(code))
+	case 0:
+		// The end of the input is reported as unterminated string
+		errTok.Length = 1
+	default:
+		return ts.escapeError(errTok, "Invalid escape sequence '\\%c'", ch)
+	}
+	return nil
+}
+
+func (ts *TokenStream) escapeError(tok *Token, format string, args ...interface{}) *RuneError {
+	return &RuneError{Kind: LexError, File: tok.File, Line: tok.Line, Col: tok.Col, Message: fmt.Sprintf(format, args...), length: tok.Length}
+}
+
+// Reads a raw string enclosed in backticks. It may span multiple lines and is taken as written, without
+// escape sequences or embedded expressions.
+func (ts *TokenStream) readRawString() *Token {
+	tok := &Token{Type: "str", File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col, Raw: true}
+	startPos := ts.input.Pos
+	ts.input.next() // Consume initial backtick
+	value, _ := ts.readWhile(func(ch rune) bool { return ch != '`' })
+	if ts.input.eof() {
+		ts.input.error(&Token{File: tok.File, Line: tok.Line, Col: tok.Col, Length: 1}, "Unterminated raw string")
+	}
+	ts.input.next() // Consume closing backtick
+	tok.Value = value
+	tok.Length = utf8.RuneCountInString(ts.input.source[startPos:ts.input.Pos])
+	tok.EndLine = ts.input.line
+	return tok
+}
+
+func isHexDigit(ch rune) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// Reads the source code of an expression embedded in a string with ${...}.
+func (ts *TokenStream) readInterpolation() *Token {
+	startTok := &Token{File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col}
+	ts.input.next() // Consume '$'
+	ts.input.next() // Consume '{'
+	tok := &Token{Type: "code", File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col}
+	var code strings.Builder
+	depth := 0
+	var inString, inRawString, escaped bool
+	for !ts.input.eof() {
+		ch := ts.input.next()
+		switch {
+		case inString:
+			// Braces inside a nested string literal don't count
+			if escaped {
+				escaped = false
+			} else if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				inString = false
+			}
+		case inRawString:
+			inRawString = ch != '`'
+		case ch == '"':
+			inString = true
+		case ch == '`':
+			inRawString = true
+		case ch == '{':
+			depth++
+		case ch == '}':
+			if depth == 0 {
+				tok.Value = code.String()
+				tok.Length = utf8.RuneCountInString(tok.Value)
+				return tok
+			}
+			depth--
+		}
+		code.WriteRune(ch)
+	}
+	ts.input.error(startTok, "Unterminated ${ in string")
+	return nil
 }
 
 func (ts *TokenStream) skipComment() {
-	ts.readWhile(func(ch byte) bool { return ch != '\n' })
+	tok := &Token{Type: "comment", File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col}
+	text, length := ts.readWhile(func(ch rune) bool { return ch != '\n' })
 	ts.input.next()
+	if ts.keepComments {
+		// The text excludes the leading '#'
+		tok.Value = strings.TrimRight(text[1:], " \t\r")
+		tok.Length = length
+		ts.comments = append(ts.comments, tok)
+	}
 }
 
 func (ts *TokenStream) readNext() *Token {
@@ -130,18 +322,31 @@ func (ts *TokenStream) readNext() *Token {
 		return ts.readNext()
 	case ch == '"':
 		return ts.readString()
+	case ch == '`':
+		return ts.readRawString()
 	case ts.isDigit(ch):
 		return ts.readNumber()
 	case ts.isIdStart(ch):
 		return ts.readIdent()
+	case ch == '?' && ts.isOptionalAccess() && ts.input.peekAt(1) != '?':
+		ts.input.next()
+		length := 2
+		return &Token{Type: "punc", Value: "?" + string(ts.input.next()), File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col - length, Length: length}
 	case ts.isPunc(ch):
 		length := 1
 		return &Token{Type: "punc", Value: string(ts.input.next()), File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col - length, Length: length}
 	case ts.isOpChar(ch):
-		op, length := ts.readWhile(ts.isOpChar)
+		// The longest operator wins, so "2*-1" multiplies by -1 and "2<=1" compares
+		op := string(ts.input.next())
+		if ops[op+string(ts.input.peek())] {
+			op += string(ts.input.next())
+		}
+		length := utf8.RuneCountInString(op)
 		return &Token{Type: "op", Value: op, File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col - length, Length: length}
 	default:
-		errTok := &Token{Type: "", Value: "", File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col, Length: 0}
+		errTok := &Token{Type: "", Value: "", File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col, Length: 1}
+		// Skip the character, so the parser can continue after the error
+		ts.input.next()
 		ts.input.error(errTok, fmt.Sprintf("invalid character: %c", ch))
 		return nil
 	}
@@ -160,7 +365,14 @@ func (ts *TokenStream) next() *Token {
 	if tok == nil {
 		tok = ts.readNext()
 	}
-	ts.last = ts.copyToken(tok)
+	if tok != nil {
+		ts.last = ts.copyToken(tok)
+		if tok.Type == "punc" && tok.Value == "{" {
+			ts.depth++
+		} else if tok.Type == "punc" && tok.Value == "}" {
+			ts.depth--
+		}
+	}
 	return tok
 }
 
@@ -169,7 +381,11 @@ func (ts *TokenStream) eof() bool {
 }
 
 func (ts *TokenStream) error(tok *Token, msg string) {
-	ts.input.error(tok, msg)
+	if tok == nil {
+		// Reached the end of the input, report the error at the last position
+		tok = &Token{File: ts.input.filepath, Line: ts.input.line, Col: ts.input.Col}
+	}
+	raiseError(ParseError, tok, msg)
 }
 
 func (ts *TokenStream) copyToken(tok *Token) *Token {
@@ -180,6 +396,10 @@ func (ts *TokenStream) copyToken(tok *Token) *Token {
 		Line:   tok.Line,
 		Col:    tok.Col,
 		Length: tok.Length,
+		Parts:  tok.Parts,
+		Raw:    tok.Raw,
+
+		EndLine: tok.EndLine,
 	}
 	return t
 }
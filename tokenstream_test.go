@@ -0,0 +1,158 @@
+package runevm
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Reads the first token of the source.
+func lexFirst(t *testing.T, source string) *Token {
+	t.Helper()
+	defer func() {
+		if rec := recover(); rec != nil {
+			t.Fatalf("unexpected error: %v", rec)
+		}
+	}()
+	return newTokenStream(newInputStream(source, "test.rune")).next()
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`"a\nb"`, "a\nb"},
+		{`"a\tb"`, "a\tb"},
+		{`"a\rb"`, "a\rb"},
+		{`"a\0b"`, "a\x00b"},
+		{`"a\\b"`, `a\b`},
+		{`"a\"b"`, `a"b`},
+		{`"\$5"`, "$5"},
+		{`"\${x}"`, "${x}"},
+		{`"\x41"`, "A"},
+		{`"\xe4"`, "ä"},
+		{`"\x01b"`, "\x01b"},
+		{`"\x41BC"`, "ABC"},
+		{`"\u{41}"`, "A"},
+		{`"\u{00E4}"`, "ä"},
+		{`"\u{1F600}!"`, "😀!"},
+		{"\"first\nsecond\"", "first\nsecond"},
+		{"`C:\\Users\\rune`", `C:\Users\rune`},
+		{"`no ${x} or \\n`", `no ${x} or \n`},
+		{"`first\nsecond`", "first\nsecond"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			tok := lexFirst(t, tt.source)
+			if tok.Type != "str" || tok.Value != tt.want {
+				t.Errorf("got %s token %q, want str %q", tok.Type, tok.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringSpans(t *testing.T) {
+	tok := lexFirst(t, "`one\ntwo\nthree` + 1")
+	if tok.Line != 1 || tok.Col != 1 || tok.EndLine != 3 || tok.Length != 15 {
+		t.Errorf("got raw string at %d:%d to line %d with length %d, want 1:1 to line 3 with length 15", tok.Line, tok.Col, tok.EndLine, tok.Length)
+	}
+	tok = lexFirst(t, "\"a\\x41\"")
+	if tok.Length != 7 || tok.EndLine != 1 {
+		t.Errorf("got string of length %d ending on line %d, want 7 and 1", tok.Length, tok.EndLine)
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+		length int
+	}{
+		{`s = "a\qb"`, "lex error (test.rune:1:7): Invalid escape sequence '\\q'", 2},
+		{`s = "\x4"`, "lex error (test.rune:1:6): Invalid escape sequence '\\x4', expecting two hex digits", 3},
+		{`s = "\xg1"`, "lex error (test.rune:1:6): Invalid escape sequence '\\x', expecting two hex digits", 2},
+		{`s = "\u41"`, "lex error (test.rune:1:6): Invalid escape sequence '\\u', expecting a code point like \\u{00E4}", 2},
+		{`s = "\u{41"`, "lex error (test.rune:1:6): Invalid escape sequence '\\u{41', expecting a closing '}'", 5},
+		{`s = "\u{110000}"`, "lex error (test.rune:1:6): Invalid escape sequence '\\u{110000}', expecting a valid code point", 10},
+		{`s = "\u{}"`, "lex error (test.rune:1:6): Invalid escape sequence '\\u{}', expecting a valid code point", 4},
+		{"x = 1\ns = \"abc", "lex error (test.rune:2:5): Unterminated string", 1},
+		{"s = `abc\ndef", "lex error (test.rune:1:5): Unterminated raw string", 1},
+		{"s = \"${x\"", "lex error (test.rune:1:6): Unterminated ${ in string", 1},
+		{"x = \"äö\\q\"", "lex error (test.rune:1:8): Invalid escape sequence '\\q'", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, errs := Parse(tt.source, "test.rune")
+			if len(errs) == 0 {
+				t.Fatal("got no error")
+			}
+			if got := errs[0].Error(); got != tt.want {
+				t.Errorf("got error %q, want %q", got, tt.want)
+			}
+			if errs[0].Length != tt.length {
+				t.Errorf("got error length %d, want %d", errs[0].Length, tt.length)
+			}
+		})
+	}
+}
+
+// An invalid escape doesn't hide the errors after it.
+func TestStringErrorsAreAllReported(t *testing.T) {
+	_, errs := Parse("a = \"\\q\"\nb = \"\\xZZ\"", "test.rune")
+	var got []string
+	for _, err := range errs {
+		got = append(got, fmt.Sprintf("%d:%d", err.Line, err.Col))
+	}
+	if fmt.Sprint(got) != "[1:6 2:6]" {
+		t.Errorf("got errors at %v, want 1:6 and 2:6", got)
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"größe = 2\nprintln(größe * 3)", "6\n"},
+		{"π = 3\nnaïve_ß = π + 1\nprintln(naïve_ß)", "4\n"},
+		// A combining accent continues the name
+		{"ét́é = 1\nprintln(ét́é)", "1\n"},
+		{"日本 = table{}\n日本.東京 = 5\nprintln(日本.東京)", "5\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			out, err := runBoth(t, tt.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+// Columns in errors count characters, so multi-byte characters before the error don't shift it
+func TestColumnsCountCharacters(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"größe = undefined_ü", "runtime error (test.rune:1:9): Undefined variable 'undefined_ü'"},
+		{"x = \"äöü\" + größe", "runtime error (test.rune:1:13): Undefined variable 'größe'"},
+		{"x = \"😀😀\" - 1", "runtime error (test.rune:1:10): Expected number but got string"},
+		{"größe = )", `parse error (test.rune:1:9): Unexpected token: ")"`},
+		{"ä = \"😀\\q\"", "lex error (test.rune:1:7): Invalid escape sequence '\\q'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := runBoth(t, tt.source)
+			if err == nil {
+				t.Fatalf("got no error, want %q", tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got error %q, want %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package runevm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Warning is a likely mistake in a script found by RuneVM.Vet. The warning spans Length characters from Line and Col.
+type Warning struct {
+	File    string
+	Line    int
+	Col     int
+	Length  int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("warning (%s:%d:%d): %s", w.File, w.Line, w.Col, w.Message)
+}
+
+// Checks the program for mistakes that parse fine, but fail at runtime or don't do what was intended:
+//
+//   - reading a variable that is never defined
+//   - assigning to a misspelled name, which defines a new variable instead of changing the existing one
+//   - 'return x' instead of 'return = x', which returns false and never evaluates x
+//   - code after break, continue, return or throw in the same block, which never runs
+//   - calling a value that isn't a function, e.g. a number or a variable only ever assigned strings
+//   - calling a builtin with the wrong number of arguments
+//   - an elif chain without else, which fails to compile
+//
+// The names defined in the vm, like the builtins and the values set by the host, are known to the checks.
+// Imports with a constant path are read to learn the names they define. Other syntax errors aren't reported
+// again, Parse returns them. The warnings are sorted by position.
+func (r *RuneVM) Vet(prog *Program) []Warning {
+	var importDirs []string
+	if r.sandbox.root != "" {
+		importDirs = []string{r.sandbox.root}
+	}
+	readFile := func(path string) (string, bool) {
+		source, err := os.ReadFile(path)
+		return string(source), err == nil
+	}
+	v := &vetter{
+		vm:       r,
+		file:     prog.filepath,
+		analysis: analyzeFile(prog.ast, prog.filepath, readFile, importDirs),
+		refs:     make(map[[2]int]*reference),
+		reads:    make(map[*symbol]int),
+		values:   make(map[*symbol][]*expression),
+		builtins: make(map[string]builtin),
+	}
+	for _, b := range r.builtins() {
+		if _, ok := r.env.vars[b.name]; ok {
+			v.builtins[b.name] = b
+		}
+	}
+	v.collect(prog.ast)
+	v.check(prog.ast)
+	v.checkAssignments()
+
+	sort.SliceStable(v.warnings, func(i, j int) bool {
+		a, b := v.warnings[i], v.warnings[j]
+		return a.Line < b.Line || (a.Line == b.Line && a.Col < b.Col)
+	})
+	return v.warnings
+}
+
+// State of a single Vet call.
+type vetter struct {
+	vm       *RuneVM
+	file     string
+	analysis *analysis
+	// References of the analysis by position
+	refs map[[2]int]*reference
+	// Number of times each symbol is read
+	reads map[*symbol]int
+	// Values assigned to each symbol. A nil entry stands for a value that isn't known, e.g. a loop variable.
+	values map[*symbol][]*expression
+	// Builtins installed in the vm by name
+	builtins map[string]builtin
+	// Set if an import couldn't be read, so names may be defined that the analysis doesn't know
+	unknownImports bool
+	warnings       []Warning
+}
+
+func (v *vetter) warn(exp *expression, format string, args ...interface{}) {
+	length := exp.Length
+	if length < 1 {
+		length = 1
+	}
+	v.warnings = append(v.warnings, Warning{
+		File:    exp.File,
+		Line:    exp.Line,
+		Col:     exp.Col,
+		Length:  length,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Returns the symbol the var expression refers to, nil for builtins, host values and unknown names.
+func (v *vetter) symbolOf(exp *expression) *symbol {
+	if ref := v.refs[[2]int{exp.Line, exp.Col}]; ref != nil {
+		return ref.sym
+	}
+	return nil
+}
+
+// Records which symbols are read and which values are assigned to them.
+func (v *vetter) collect(ast *expression) {
+	for i := range v.analysis.refs {
+		ref := &v.analysis.refs[i]
+		v.refs[[2]int{ref.line, ref.col}] = ref
+	}
+	writes := make(map[*expression]bool)
+	var walk func(exp *expression)
+	walk = func(exp *expression) {
+		switch exp.Type {
+		case assignExpr:
+			if exp.Left.Index == nil {
+				// A compound assignment reads the variable as well and assigns a value unknown to vet
+				value := exp.Right
+				if exp.Operator != "=" {
+					value = nil
+				} else {
+					writes[exp.Left] = true
+				}
+				if sym := v.symbolOf(exp.Left); sym != nil {
+					v.values[sym] = append(v.values[sym], value)
+				}
+			}
+		case funExpr, forExpr, tryExpr:
+			for _, name := range exp.ParamExprs {
+				writes[name] = true
+				if sym := v.symbolOf(name); sym != nil {
+					v.values[sym] = append(v.values[sym], nil)
+				}
+			}
+		case importExpr:
+			if _, _, ok := v.analysis.findImport(exp); !ok {
+				v.unknownImports = true
+			}
+		case pairExpr:
+			walk(exp.Right)
+			return
+		case varExpr:
+			if exp.Index == nil && !writes[exp] {
+				if sym := v.symbolOf(exp); sym != nil {
+					v.reads[sym]++
+				}
+			}
+		}
+		for _, child := range exp.children() {
+			walk(child)
+		}
+	}
+	walk(ast)
+}
+
+// Checks the expression and its sub-expressions.
+func (v *vetter) check(exp *expression) {
+	switch exp.Type {
+	case blockExpr:
+		v.checkBlock(exp.Block)
+	case varExpr:
+		v.checkUndefined(exp)
+	case callExpr:
+		v.checkCall(exp)
+	case ifExpr:
+		if exp.Operator == "elif" && exp.Else == nil {
+			v.warn(exp, "'elif' without 'else', an if with elif branches needs an else branch, e.g. 'else {}'")
+		}
+	case pairExpr:
+		// A table key written as a name is a string, not a variable
+		v.check(exp.Right)
+		return
+	}
+	for _, child := range exp.children() {
+		v.check(child)
+	}
+}
+
+// Reports statements that never run because a statement before them in the block always leaves it.
+func (v *vetter) checkBlock(stmts []*expression) {
+	for i, stmt := range stmts[:max(len(stmts)-1, 0)] {
+		next := stmts[i+1]
+		if ret := trailingReturn(stmt); ret != nil && firstLine(next) == ret.Line {
+			v.warn(ret, "'return' without '=' returns false and the rest of the line never runs, use 'return = <value>' to return a value")
+			return
+		}
+		if keyword := v.leaveKeyword(stmt); keyword != "" {
+			v.warn(firstExpr(next), "Unreachable code after '%s'", keyword)
+			return
+		}
+	}
+}
+
+// Returns the return without value that ends the statement, nil if there is none. A return in the last
+// branch of an if ends it as well, like in 'if done then return x'.
+func trailingReturn(stmt *expression) *expression {
+	switch stmt.Type {
+	case returnExpr:
+		if stmt.Right == FALSE {
+			return stmt
+		}
+	case ifExpr:
+		if stmt.Else != nil {
+			return trailingReturn(stmt.Else)
+		}
+		return trailingReturn(stmt.Then)
+	}
+	return nil
+}
+
+// Returns the keyword or builtin that makes the statement always leave the enclosing block, "" if it doesn't.
+func (v *vetter) leaveKeyword(stmt *expression) string {
+	switch stmt.Type {
+	case breakExpr:
+		return "break"
+	case continueExpr:
+		return "continue"
+	case returnExpr:
+		return "return"
+	case callExpr:
+		if stmt.Func.Type == varExpr && stmt.Func.Index == nil && stmt.Func.Value == "throw" && v.isBuiltin(stmt.Func) {
+			return "throw"
+		}
+	}
+	return ""
+}
+
+// Reports whether the var expression refers to a builtin that the script doesn't redefine.
+func (v *vetter) isBuiltin(exp *expression) bool {
+	_, ok := v.builtins[exp.Value.(string)]
+	return ok && v.symbolOf(exp) == nil
+}
+
+// Reports reading a name that is neither defined by the script nor by the vm.
+func (v *vetter) checkUndefined(exp *expression) {
+	if exp.Index != nil || v.unknownImports {
+		return
+	}
+	ref := v.refs[[2]int{exp.Line, exp.Col}]
+	if ref == nil || ref.sym != nil {
+		return
+	}
+	if _, ok := v.vm.env.vars[ref.name]; ok {
+		return
+	}
+	if similar := v.similarName(ref.name, v.analysis.scopeAt(exp.Line, exp.Col), nil); similar != "" {
+		v.warn(exp, "Undefined variable '%s', did you mean '%s'?", ref.name, similar)
+		return
+	}
+	v.warn(exp, "Undefined variable '%s'", ref.name)
+}
+
+// Reports calls of values that aren't functions and calls of builtins with the wrong number of arguments.
+func (v *vetter) checkCall(call *expression) {
+	fn := call.Func
+	if kind := literalKind(fn); kind != "" {
+		v.warn(fn, "Calling %s, which is not a function", kind)
+		return
+	}
+	if fn.Type != varExpr || fn.Index != nil {
+		return
+	}
+	name := fn.Value.(string)
+	if sym := v.symbolOf(fn); sym != nil {
+		values := v.values[sym]
+		if len(values) == 0 || sym.file != v.file {
+			return
+		}
+		for _, value := range values {
+			if value == nil || literalKind(value) == "" {
+				return
+			}
+		}
+		v.warn(fn, "Calling '%s', which is only ever assigned %s", name, literalKind(values[0]))
+		return
+	}
+	if b, ok := v.builtins[name]; ok {
+		min, max := builtinArity(b.signature)
+		n := len(call.Args)
+		if n < min || (max >= 0 && n > max) {
+			v.warn(fn, "'%s' expects %s, but is called with %d", name, describeArity(min, max), n)
+		}
+		return
+	}
+	if value, ok := v.vm.env.vars[name]; ok && typeName(value) != "function" {
+		v.warn(fn, "Calling '%s', which is a %s", name, typeName(value))
+	}
+}
+
+// Reports assignments that define a new variable which is never read, while a similar name is defined.
+// Such an assignment most likely misspells the name of the variable it should change.
+func (v *vetter) checkAssignments() {
+	for _, sc := range v.analysis.scopes {
+		for _, sym := range sc.symbols {
+			if sym.file != v.file || sym.kind == parameterSymbol || v.reads[sym] > 0 {
+				continue
+			}
+			if similar := v.similarName(sym.name, sc, sym); similar != "" {
+				exp := &expression{File: sym.file, Line: sym.line, Col: sym.col, Length: sym.length}
+				v.warn(exp, "Assignment to '%s' defines a new variable that is never used, did you mean '%s'?", sym.name, similar)
+			}
+		}
+	}
+}
+
+// Returns a name visible in the scope that differs from the given one by a typo, "" if there is none.
+// Names of the vm count as well. Skip is left out.
+func (v *vetter) similarName(name string, sc *scope, skip *symbol) string {
+	var candidates []string
+	for _, sym := range sc.visible() {
+		if sym != skip && (v.reads[sym] > 0 || sym.file != v.file) {
+			candidates = append(candidates, sym.name)
+		}
+	}
+	var globals []string
+	for global := range v.vm.env.vars {
+		globals = append(globals, global)
+	}
+	sort.Strings(globals)
+	candidates = append(candidates, globals...)
+	for _, candidate := range candidates {
+		if candidate != name && isTypo(name, candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Reports whether two names differ only in case or by a single inserted, removed, replaced or swapped
+// character. Names of up to three characters must match except for case, numbered names never match.
+func isTypo(a, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	if utf8.RuneCountInString(a) <= 3 || utf8.RuneCountInString(b) <= 3 {
+		return false
+	}
+	// Names numbered like item1 and item2 are different variables on purpose
+	if strings.TrimRight(a, "0123456789") == strings.TrimRight(b, "0123456789") {
+		return false
+	}
+	return editDistance([]rune(strings.ToLower(a)), []rune(strings.ToLower(b))) <= 1
+}
+
+// Returns the number of single character insertions, deletions, substitutions and transpositions of
+// adjacent characters needed to turn a into b.
+func editDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// Returns the sub-expression that starts first in the source, e.g. the variable of an assignment.
+func firstExpr(exp *expression) *expression {
+	first := exp
+	for _, child := range exp.children() {
+		if child.Line == 0 {
+			continue
+		}
+		start := firstExpr(child)
+		if first.Line == 0 || start.Line < first.Line || (start.Line == first.Line && start.Col < first.Col) {
+			first = start
+		}
+	}
+	return first
+}
+
+// Returns a description of the value of a literal that isn't a function, like "a number", or "" if the
+// expression isn't such a literal.
+func literalKind(exp *expression) string {
+	switch exp.Type {
+	case numExpr:
+		return "a number"
+	case strExpr, interpExpr:
+		return "a string"
+	case boolExpr:
+		return "a bool"
+	case nilExpr:
+		return "nil"
+	case arrayExpr:
+		return "an array"
+	case tableExpr:
+		return "a table"
+	}
+	return ""
+}
+
+// Returns the minimum and maximum number of arguments of a builtin from its signature, e.g. 1 and 3 for
+// "range(<start>, <end>, [step])". Arguments in angle brackets are required, those in square brackets
+// optional, and "..." marks any number of arguments. The maximum is -1 if there is no limit.
+func builtinArity(signature string) (int, int) {
+	open := strings.Index(signature, "(")
+	params := strings.TrimSuffix(signature[open+1:], ")")
+	if params == "" {
+		return 0, 0
+	}
+	min, max := 0, 0
+	for _, param := range strings.Split(params, ",") {
+		param = strings.TrimSpace(param)
+		if strings.HasSuffix(param, "...") {
+			max = -1
+			continue
+		}
+		if max >= 0 {
+			max++
+		}
+		if strings.HasPrefix(param, "<") {
+			min++
+		}
+	}
+	return min, max
+}
+
+func describeArity(min, max int) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+	switch {
+	case max < 0:
+		return "at least " + plural(min)
+	case min == max:
+		return plural(min)
+	default:
+		return fmt.Sprintf("%d to %s", min, plural(max))
+	}
+}
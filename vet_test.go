@@ -0,0 +1,107 @@
+package runevm
+
+import (
+	"strings"
+	"testing"
+)
+
+// Vets the source with a fresh vm and returns the warnings as strings.
+func vetSource(t *testing.T, source string) []string {
+	t.Helper()
+	prog, _ := Parse(source, "test.rune")
+	var warnings []string
+	for _, warning := range NewRuneVM().Vet(prog) {
+		warnings = append(warnings, warning.String())
+	}
+	return warnings
+}
+
+func TestVet(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"misspelled assignment", "count = 0\nconut = count + 1\nprintln(count)", []string{
+			"warning (test.rune:2:1): Assignment to 'conut' defines a new variable that is never used, did you mean 'count'?",
+		}},
+		{"misspelled read", "helper = fun() { 1 }\nhelper()\nhelpr()", []string{
+			"warning (test.rune:3:1): Undefined variable 'helpr', did you mean 'helper'?",
+		}},
+		{"undefined variable", "println(total)", []string{
+			"warning (test.rune:1:9): Undefined variable 'total'",
+		}},
+		{"return without =", "f = fun(x) {\n    return x\n}\nf(1)", []string{
+			"warning (test.rune:2:5): 'return' without '=' returns false and the rest of the line never runs, use 'return = <value>' to return a value",
+		}},
+		{"return in a then branch", "f = fun(x) {\n    if x then return x\n}\nf(1)", []string{
+			"warning (test.rune:2:15): 'return' without '=' returns false and the rest of the line never runs, use 'return = <value>' to return a value",
+		}},
+		{"unreachable after break", "while true {\n    break\n    println(1)\n}", []string{
+			"warning (test.rune:3:5): Unreachable code after 'break'",
+		}},
+		{"unreachable after throw", "f = fun() {\n    throw(\"no\")\n    x = 1\n}\nf()", []string{
+			"warning (test.rune:3:5): Unreachable code after 'throw'",
+		}},
+		{"calling a literal", `"text"()`, []string{
+			"warning (test.rune:1:1): Calling a string, which is not a function",
+		}},
+		{"calling a variable only assigned numbers", "n = 1\nn = 2\nn()", []string{
+			"warning (test.rune:3:1): Calling 'n', which is only ever assigned a number",
+		}},
+		{"builtin with too few arguments", "len()", []string{
+			"warning (test.rune:1:1): 'len' expects 1 argument, but is called with 0",
+		}},
+		{"builtin with too many arguments", "range(1, 2, 3, 4)", []string{
+			"warning (test.rune:1:1): 'range' expects 1 to 3 arguments, but is called with 4",
+		}},
+		{"elif without else", "x = 1\nif x == 1 { 1 } elif x == 2 { 2 }", []string{
+			"warning (test.rune:2:17): 'elif' without 'else', an if with elif branches needs an else branch, e.g. 'else {}'",
+		}},
+		{"clean script", `greet = fun(name) {
+    if name == "" then return = "nobody"
+    "Hello " + name
+}
+for i in range(3) {
+    if i == 1 then continue
+    println(greet("Ann"), i)
+}
+if true { 1 } elif false { 2 } else { 3 }
+if true { 1 } else if false { 2 }`, nil},
+		{"numbered names are no typos", "item1 = 1\nitem2 = 2\nprintln(item1)", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := vetSource(t, tt.source)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got warnings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestVetKnowsHostValues(t *testing.T) {
+	vm := NewRuneVM()
+	vm.SetInt("limit", 3)
+	vm.SetFun("notify", func(args ...interface{}) interface{} { return nil })
+	prog, errs := Parse("notify(limit)\nlimit()", "test.rune")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected syntax errors: %v", errs)
+	}
+	warnings := vm.Vet(prog)
+	if len(warnings) != 1 || warnings[0].Message != "Calling 'limit', which is a int" {
+		t.Errorf("got warnings %v, want only the call of limit", warnings)
+	}
+}
+
+func TestElifWithoutElseFailsToCompile(t *testing.T) {
+	source := "if a { 1 } elif b { 2 }\nprintln(1)"
+	if _, err := Compile(source, "test.rune"); err == nil || !strings.Contains(err.Error(), "Expecting 'else' after 'elif'") {
+		t.Errorf("got %v, want the missing else as parse error", err)
+	}
+	// Parse keeps the statement, so the rest of the program is still known
+	prog, errs := Parse(source, "test.rune")
+	if len(errs) != 1 || len(prog.ast.Block) != 2 {
+		t.Errorf("got errors %v and %d statements, want one error and both statements", errs, len(prog.ast.Block))
+	}
+}